@@ -0,0 +1,814 @@
+package pubd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+)
+
+var _ billy.Filesystem = &ArchiveFileSystem{}
+
+// Returns whether a filename looks like an archive supported by OpenArchive.
+func IsArchive(filename string) bool {
+	return archiveFormat(filename) != ""
+}
+
+func archiveFormat(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	default:
+		return ""
+	}
+}
+
+// Default limit on how much of an archive may be decompressed into a temporary file at once:
+// the whole of a tar.gz archive, or a compressed file in a zip archive; see zipContents.
+const DefaultMaxArchiveSpool = 1 << 30
+
+// A file or directory in an archive.
+type archiveEntry struct {
+	info     fileInfo
+	link     string // Symlink target, as written in the archive.
+	open     func() (readOnlyContents, error)
+	children map[string]*archiveEntry
+}
+
+// A read-only filesystem serving the contents of a zip or (optionally gzipped) tar archive.
+//
+// Uncompressed files are read directly from the archive, compressed files in zip archives are
+// decompressed as they're read; see zipContents. Compressed tar archives can't be seeked in, so
+// they're decompressed into an (unlinked) temporary file when the archive is opened. Neither
+// may exceed the limit given to NewArchiveFileSystem(), so a small archive can't fill up the disk.
+type ArchiveFileSystem struct {
+	readOnlyFS
+	closer   io.Closer
+	root     *archiveEntry
+	maxSpool int64
+}
+
+// Opens an archive in fs; the format is guessed from its extension, see IsArchive().
+// The returned filesystem must be closed when no longer needed.
+func OpenArchive(fs billy.Filesystem, filename string, maxSpool int64) (*ArchiveFileSystem, error) {
+	format := archiveFormat(filename)
+	if format == "" {
+		return nil, fmt.Errorf("%s: unsupported archive format", filename)
+	}
+	info, err := fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	afs, err := NewArchiveFileSystem(f, info.Size(), info.ModTime(), format, maxSpool)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return afs, nil
+}
+
+// Reads an archive of the given format ("zip", "tar" or "tar.gz") from f, which will be
+// closed along with the filesystem. modTime is used for implied parent directories. At most
+// maxSpool bytes are decompressed into a temporary file at once; 0 means DefaultMaxArchiveSpool.
+func NewArchiveFileSystem(f billy.File, size int64, modTime time.Time, format string, maxSpool int64) (*ArchiveFileSystem, error) {
+	if maxSpool <= 0 {
+		maxSpool = DefaultMaxArchiveSpool
+	}
+	afs := &ArchiveFileSystem{closer: f, maxSpool: maxSpool, root: &archiveEntry{
+		info:     fileInfo{name: "/", mode: os.ModeDir | 0755, modTime: modTime},
+		children: make(map[string]*archiveEntry),
+	}}
+	var err error
+	switch format {
+	case "zip":
+		err = afs.readZip(f, size)
+	case "tar":
+		err = afs.readTar(f, size)
+	case "tar.gz":
+		err = afs.readTarGz(f)
+	default:
+		err = fmt.Errorf("unsupported archive format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return afs, nil
+}
+
+func (fs *ArchiveFileSystem) Close() error {
+	return fs.closer.Close()
+}
+
+// Adds an entry to the tree, creating any missing parent directories. Entries with absolute
+// paths or paths containing ".." are ignored, as are duplicates after the first one.
+func (fs *ArchiveFileSystem) add(name string, entry *archiveEntry) {
+	name = strings.TrimLeft(filepath.ToSlash(name), "/")
+	if name == "" || path.Clean(name) == ".." || strings.HasPrefix(path.Clean(name), "../") {
+		return
+	}
+	segments := splitPath(name)
+	if len(segments) == 0 {
+		return
+	}
+	dir := fs.root
+	for _, seg := range segments[:len(segments)-1] {
+		next, ok := dir.children[seg]
+		if !ok {
+			next = &archiveEntry{
+				info:     fileInfo{name: seg, mode: os.ModeDir | 0755, modTime: fs.root.info.modTime},
+				children: make(map[string]*archiveEntry),
+			}
+			dir.children[seg] = next
+		} else if next.children == nil {
+			return // A file is in the way.
+		}
+		dir = next
+	}
+	base := segments[len(segments)-1]
+	if existing, ok := dir.children[base]; ok {
+		// Explicit directory entries may come after their contents; keep the contents.
+		if existing.children != nil && entry.children != nil {
+			existing.info = entry.info
+		}
+		return
+	}
+	entry.info.name = base
+	dir.children[base] = entry
+}
+
+func (fs *ArchiveFileSystem) readZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		zf := zf
+		mode := zf.Mode()
+		entry := &archiveEntry{info: fileInfo{size: int64(zf.UncompressedSize64), mode: mode, modTime: zf.Modified}}
+		switch {
+		case mode.IsDir():
+			entry.info.mode = os.ModeDir | mode.Perm() | 0700
+			entry.info.size = 0
+			entry.children = make(map[string]*archiveEntry)
+		case mode&os.ModeSymlink != 0:
+			target, err := readZipLink(zf)
+			if err != nil {
+				return err
+			}
+			entry.link = target
+		case mode.IsRegular():
+			if zf.Method == zip.Store {
+				offset, err := zf.DataOffset()
+				if err != nil {
+					return err
+				}
+				entry.open = func() (readOnlyContents, error) {
+					return io.NewSectionReader(ra, offset, int64(zf.UncompressedSize64)), nil
+				}
+			} else {
+				entry.open = func() (readOnlyContents, error) {
+					return &zipContents{zf: zf, size: int64(zf.UncompressedSize64), maxSpool: fs.maxSpool}, nil
+				}
+			}
+		default:
+			continue
+		}
+		fs.add(zf.Name, entry)
+	}
+	return nil
+}
+
+// Longest symlink target we'll read from a zip archive, same as Linux' PATH_MAX.
+const maxZipLink = 4096
+
+func readZipLink(zf *zip.File) (string, error) {
+	if zf.UncompressedSize64 > maxZipLink {
+		return "", fmt.Errorf("%s: symlink target too long", zf.Name)
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := ioutil.ReadAll(io.LimitReader(r, maxZipLink))
+	return string(target), err
+}
+
+// Contents of a compressed file in a zip archive. Sequential reads are decompressed straight
+// from the archive; anything else, eg. seeking backwards after reading, or ReadAt(), first
+// spools the whole file into an (unlinked) temporary file, as a decompressor can't seek. Files
+// larger than maxSpool can only be read sequentially.
+type zipContents struct {
+	zf       *zip.File
+	size     int64
+	maxSpool int64
+
+	mu    sync.Mutex
+	pos   int64
+	r     io.ReadCloser // Decompressor, if streaming; positioned at read.
+	read  int64
+	spool *os.File
+}
+
+func (c *zipContents) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spool == nil && c.pos == c.read {
+		if c.r == nil {
+			r, err := c.zf.Open()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		c.pos += int64(n)
+		c.read += int64(n)
+		return n, err
+	}
+	if err := c.spoolLocked(); err != nil {
+		return 0, err
+	}
+	n, err := c.spool.ReadAt(p, c.pos)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *zipContents) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	err := c.spoolLocked()
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.spool.ReadAt(p, off)
+}
+
+func (c *zipContents) Seek(offset int64, whence int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%s: negative position", c.zf.Name)
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+// Decompresses the whole file into a temporary file, if that hasn't happened yet.
+func (c *zipContents) spoolLocked() error {
+	if c.spool != nil {
+		return nil
+	}
+	if c.size > c.maxSpool {
+		return fmt.Errorf("%s: can only be read sequentially: decompresses to %d bytes, limit is %d", c.zf.Name, c.size, c.maxSpool)
+	}
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+	r, err := c.zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := ioutil.TempFile("", "pubd-archive-")
+	if err != nil {
+		return err
+	}
+	// Unlink it right away; it sticks around until closed, and no one else can see it.
+	if err := os.Remove(tmp.Name()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The decompressor refuses to return more than the file's declared size; don't rely on it.
+	if n, err := io.Copy(tmp, io.LimitReader(r, c.size+1)); err != nil || n > c.size {
+		tmp.Close()
+		if err == nil {
+			err = fmt.Errorf("%s: decompresses to more than its declared size", c.zf.Name)
+		}
+		return err
+	}
+	c.spool = tmp
+	return nil
+}
+
+func (c *zipContents) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+	if c.spool != nil {
+		c.spool.Close()
+		c.spool = nil
+	}
+	return nil
+}
+
+// Indexes a tar archive; file contents are read from ra when opened.
+func (fs *ArchiveFileSystem) readTar(ra io.ReaderAt, size int64) error {
+	// tar.Reader reads headers in whole blocks without buffering, so after Next(), the
+	// underlying reader is positioned at the start of the entry's data.
+	sr := io.NewSectionReader(ra, 0, size)
+	tr := tar.NewReader(sr)
+	hardlinks := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		info := hdr.FileInfo()
+		entry := &archiveEntry{info: fileInfo{size: hdr.Size, mode: info.Mode(), modTime: hdr.ModTime}}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry.info.size = 0
+			entry.children = make(map[string]*archiveEntry)
+		case tar.TypeSymlink:
+			entry.link = hdr.Linkname
+		case tar.TypeLink:
+			hardlinks[hdr.Name] = hdr.Linkname
+			continue
+		case tar.TypeReg:
+			size := hdr.Size
+			entry.open = func() (readOnlyContents, error) {
+				return io.NewSectionReader(ra, offset, size), nil
+			}
+		default:
+			continue
+		}
+		fs.add(hdr.Name, entry)
+	}
+
+	// Hard links may refer to any preceding entry; resolve them once we have all of them.
+	for name, target := range hardlinks {
+		if entry, err := fs.lookup(target, false); err == nil && entry.open != nil {
+			link := *entry
+			fs.add(name, &link)
+		}
+	}
+	return nil
+}
+
+// Decompresses a tar.gz into a temporary file, then indexes that.
+func (fs *ArchiveFileSystem) readTarGz(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tmp, err := ioutil.TempFile("", "pubd-archive-")
+	if err != nil {
+		return err
+	}
+	// Unlink it right away; it sticks around until closed, and no one else can see it.
+	if err := os.Remove(tmp.Name()); err != nil {
+		tmp.Close()
+		return err
+	}
+	size, err := io.Copy(tmp, io.LimitReader(zr, fs.maxSpool+1))
+	if err != nil || size > fs.maxSpool {
+		tmp.Close()
+		if err == nil {
+			err = fmt.Errorf("decompresses to more than %d bytes", fs.maxSpool)
+		}
+		return err
+	}
+	if err := fs.readTar(tmp, size); err != nil {
+		tmp.Close()
+		return err
+	}
+	fs.closer = multiCloser{tmp, fs.closer}
+	return nil
+}
+
+type multiCloser []io.Closer
+
+func (cs multiCloser) Close() error {
+	var firstErr error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Looks up a path, resolving symlinks along the way; see symlinkFileSystem.resolve().
+// Symlinks pointing outside of the archive are treated as nonexistent.
+func (fs *ArchiveFileSystem) lookup(filename string, followLast bool) (*archiveEntry, error) {
+	pending := splitPath(filename)
+	resolved := ""
+	entry := fs.root
+	for hops := 0; len(pending) > 0; {
+		seg := pending[0]
+		pending = pending[1:]
+
+		next, ok := entry.children[seg]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		if next.info.mode&os.ModeSymlink == 0 || (len(pending) == 0 && !followLast) {
+			entry = next
+			resolved = path.Join(resolved, seg)
+			continue
+		}
+
+		if hops++; hops > maxSymlinks {
+			return nil, fmt.Errorf("%s: too many levels of symbolic links", filename)
+		}
+		linkPath := path.Join(resolved, next.link)
+		if path.IsAbs(next.link) || linkPath == ".." || strings.HasPrefix(linkPath, "../") {
+			return nil, os.ErrNotExist
+		}
+		pending = append(splitPath(linkPath), pending...)
+		resolved = ""
+		entry = fs.root
+	}
+	return entry, nil
+}
+
+func (fs *ArchiveFileSystem) Open(filename string) (billy.File, error) {
+	entry, err := fs.lookup(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.open == nil {
+		return nil, fmt.Errorf("%s: is a directory", filename)
+	}
+	contents, err := entry.open()
+	if err != nil {
+		return nil, err
+	}
+	f := &readOnlyFile{name: filename, readOnlyContents: contents}
+	if c, ok := contents.(io.Closer); ok {
+		f.onClose = c.Close
+	}
+	return f, nil
+}
+
+func (fs *ArchiveFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if fs.isWrite(flag) {
+		return nil, billy.ErrReadOnly
+	}
+	return fs.Open(filename)
+}
+
+func (fs *ArchiveFileSystem) Stat(filename string) (os.FileInfo, error) {
+	entry, err := fs.lookup(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	info := entry.info
+	info.name = path.Base(path.Clean("/" + filename))
+	return info, nil
+}
+
+func (fs *ArchiveFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	entry, err := fs.lookup(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+func (fs *ArchiveFileSystem) Readlink(link string) (string, error) {
+	entry, err := fs.lookup(link, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.info.mode&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("%s: not a symlink", link)
+	}
+	return entry.link, nil
+}
+
+func (fs *ArchiveFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entry, err := fs.lookup(dirname, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.children == nil {
+		return nil, fmt.Errorf("%s: not a directory", dirname)
+	}
+	infos := make([]os.FileInfo, 0, len(entry.children))
+	for _, child := range entry.children {
+		infos = append(infos, child.info)
+	}
+	SortFileInfos(infos)
+	return infos, nil
+}
+
+func (fs *ArchiveFileSystem) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(fs, path), nil
+}
+
+func (fs *ArchiveFileSystem) Join(elem ...string) string { return filepath.Join(elem...) }
+
+// Maximum number of archives kept open by FileSystemArchives.
+const maxOpenArchives = 16
+
+type openArchive struct {
+	modTime time.Time
+	size    int64
+	refs    int // One for being in the cache, plus one per user.
+
+	ready chan struct{} // Closed once fs or err is set.
+	fs    *ArchiveFileSystem
+	err   error
+}
+
+type archivesFileSystem struct {
+	billy.Filesystem
+	symlinks SymlinkPolicy
+	maxSpool int64
+
+	mu    sync.Mutex
+	open  map[string]*openArchive
+	order []string // Least recently used first.
+}
+
+// Returns a filesystem which lets archives be browsed as directories. The archive itself is
+// still a file, but a path with a trailing slash ("/bundle.zip/"), or a path below it
+// ("/bundle.zip/README.txt") refers to its contents. Archives inside of archives are not
+// browsable. Symlinks inside of archives are subject to the given policy, see
+// FileSystemSymlinks(); the root of an archive counts as the root for SymlinksWithinRoot.
+// maxSpool is passed to OpenArchive().
+//
+// Recently used archives are kept open, and reopened if they're modified. The returned
+// filesystem is an io.Closer, which closes them once they're no longer in use.
+func FileSystemArchives(fs billy.Filesystem, symlinks SymlinkPolicy, maxSpool int64) billy.Filesystem {
+	return &archivesFileSystem{Filesystem: fs, symlinks: symlinks, maxSpool: maxSpool, open: make(map[string]*openArchive)}
+}
+
+// If filename is inside an archive, returns the archive's path and the path inside it.
+func (fs *archivesFileSystem) split(filename string) (string, string, bool) {
+	segments := splitPath(filename)
+	trailingSlash := strings.HasSuffix(filename, "/")
+	for i, seg := range segments {
+		if !IsArchive(seg) || (i == len(segments)-1 && !trailingSlash) {
+			continue
+		}
+		archive := "/" + path.Join(segments[:i+1]...)
+		if info, err := fs.Filesystem.Stat(archive); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		return archive, "/" + path.Join(segments[i+1:]...), true
+	}
+	return "", "", false
+}
+
+// Returns an open archive, which must be released when no longer used.
+func (fs *archivesFileSystem) acquire(filename string) (*openArchive, error) {
+	info, err := fs.Filesystem.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	if a, ok := fs.open[filename]; ok {
+		if a.modTime.Equal(info.ModTime()) && a.size == info.Size() {
+			a.refs++
+			fs.touch(filename)
+			fs.mu.Unlock()
+
+			<-a.ready
+			if a.err != nil {
+				fs.release(a)
+				return nil, a.err
+			}
+			return a, nil
+		}
+		fs.evict(filename)
+	}
+	a := &openArchive{modTime: info.ModTime(), size: info.Size(), refs: 2, ready: make(chan struct{})}
+	fs.open[filename] = a
+	fs.order = append(fs.order, filename)
+	for len(fs.order) > maxOpenArchives {
+		fs.evict(fs.order[0])
+	}
+	fs.mu.Unlock()
+
+	// Opening an archive can take a while, eg. decompressing a tar.gz, so it's done without
+	// holding the lock; anyone else wanting the same archive waits for us instead.
+	a.fs, a.err = OpenArchive(fs.Filesystem, filename, fs.maxSpool)
+	close(a.ready)
+	if a.err != nil {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.open[filename] == a {
+			fs.evict(filename)
+		}
+		fs.unref(a)
+		return nil, a.err
+	}
+	return a, nil
+}
+
+func (fs *archivesFileSystem) release(a *openArchive) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.unref(a)
+}
+
+// The caller must hold fs.mu.
+func (fs *archivesFileSystem) unref(a *openArchive) {
+	if a.refs--; a.refs == 0 && a.fs != nil {
+		a.fs.Close()
+	}
+}
+
+// Moves an archive to the back of the LRU list. The caller must hold fs.mu.
+func (fs *archivesFileSystem) touch(filename string) {
+	for i, name := range fs.order {
+		if name == filename {
+			fs.order = append(append(fs.order[:i:i], fs.order[i+1:]...), filename)
+			return
+		}
+	}
+}
+
+// Removes an archive from the cache; it's closed once no longer in use. The caller must
+// hold fs.mu.
+func (fs *archivesFileSystem) evict(filename string) {
+	for i, name := range fs.order {
+		if name == filename {
+			fs.order = append(fs.order[:i:i], fs.order[i+1:]...)
+			break
+		}
+	}
+	if a, ok := fs.open[filename]; ok {
+		delete(fs.open, filename)
+		fs.unref(a)
+	}
+}
+
+// Returns an archive's contents, with the symlink policy applied.
+func (fs *archivesFileSystem) contents(a *openArchive) billy.Filesystem {
+	return FileSystemSymlinks(a.fs, fs.symlinks)
+}
+
+// Calls fn with the archive filename is in, or returns ok=false if it's not in one.
+func (fs *archivesFileSystem) inArchive(filename string, fn func(afs billy.Filesystem, inner string) error) (bool, error) {
+	archive, inner, ok := fs.split(filename)
+	if !ok {
+		return false, nil
+	}
+	a, err := fs.acquire(archive)
+	if err != nil {
+		return true, err
+	}
+	defer fs.release(a)
+	return true, fn(fs.contents(a), inner)
+}
+
+// Files opened from an archive keep it open until they're closed.
+func (fs *archivesFileSystem) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *archivesFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	archive, inner, ok := fs.split(filename)
+	if !ok {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+	a, err := fs.acquire(archive)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.contents(a).OpenFile(inner, flag, perm)
+	if err != nil {
+		fs.release(a)
+		return nil, err
+	}
+	rf := f.(*readOnlyFile)
+	rf.name = filename
+	closeContents := rf.onClose
+	rf.onClose = func() error {
+		defer fs.release(a)
+		if closeContents != nil {
+			return closeContents()
+		}
+		return nil
+	}
+	return rf, nil
+}
+
+// The root of an archive is named after the archive, rather than "/".
+func (fs *archivesFileSystem) stat(filename string, stat func(billy.Filesystem, string) (os.FileInfo, error), fallback func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	var info os.FileInfo
+	if ok, err := fs.inArchive(filename, func(afs billy.Filesystem, inner string) (err error) {
+		info, err = stat(afs, inner)
+		if err == nil && inner == "/" {
+			info = fileInfo{name: path.Base(path.Clean(filename)), mode: info.Mode(), modTime: info.ModTime()}
+		}
+		return err
+	}); ok {
+		return info, err
+	}
+	return fallback(filename)
+}
+
+func (fs *archivesFileSystem) Stat(filename string) (os.FileInfo, error) {
+	return fs.stat(filename, billy.Filesystem.Stat, fs.Filesystem.Stat)
+}
+
+func (fs *archivesFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	return fs.stat(filename, billy.Filesystem.Lstat, fs.Filesystem.Lstat)
+}
+
+func (fs *archivesFileSystem) Readlink(link string) (string, error) {
+	var target string
+	if ok, err := fs.inArchive(link, func(afs billy.Filesystem, inner string) (err error) {
+		target, err = afs.Readlink(inner)
+		return err
+	}); ok {
+		return target, err
+	}
+	return fs.Filesystem.Readlink(link)
+}
+
+func (fs *archivesFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	if ok, err := fs.inArchive(dirname, func(afs billy.Filesystem, inner string) (err error) {
+		infos, err = afs.ReadDir(inner)
+		return err
+	}); ok {
+		return infos, err
+	}
+	return fs.Filesystem.ReadDir(dirname)
+}
+
+// Chrooting into an archive keeps it open for as long as the process lives.
+func (fs *archivesFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	archive, inner, ok := fs.split(dir)
+	if !ok {
+		inner, err := fs.Filesystem.Chroot(dir)
+		if err != nil {
+			return nil, err
+		}
+		return FileSystemArchives(inner, fs.symlinks, fs.maxSpool), nil
+	}
+	a, err := fs.acquire(archive)
+	if err != nil {
+		return nil, err
+	}
+	return fs.contents(a).Chroot(inner)
+}
+
+// Closes all open archives once files opened from them are closed. Archives opened after this
+// are closed as usual, when evicted.
+func (fs *archivesFileSystem) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for len(fs.order) > 0 {
+		fs.evict(fs.order[0])
+	}
+	return nil
+}
+
+// Directories inside archives get the configs of the directory the archive is in.
+func (fs *archivesFileSystem) DirConfig(dir string) (DirConfig, error) {
+	if archive, _, ok := fs.split(dir); ok {
+		dir = path.Dir(archive)
+	}
+	return DirConfigOf(fs.Filesystem, dir)
+}
+
+func (fs *archivesFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
@@ -0,0 +1,318 @@
+package pubd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testArchiveTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func mkTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		Name   string
+		Method uint16
+		Data   string
+	}{
+		{"stored.txt", zip.Store, "stored contents"},
+		{"dir/deflated.txt", zip.Deflate, "deflated contents"},
+	} {
+		hdr := &zip.FileHeader{Name: f.Name, Method: f.Method, Modified: testArchiveTime}
+		hdr.SetMode(0644)
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, f.Data)
+		require.NoError(t, err)
+	}
+	hdr := &zip.FileHeader{Name: "link.txt", Modified: testArchiveTime}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, err := zw.CreateHeader(hdr)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "dir/deflated.txt")
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func mkTestTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "stored.txt", Mode: 0644, Size: 15},
+		{Typeflag: tar.TypeReg, Name: "dir/deflated.txt", Mode: 0644, Size: 17},
+		{Typeflag: tar.TypeSymlink, Name: "link.txt", Linkname: "dir/deflated.txt"},
+		{Typeflag: tar.TypeLink, Name: "hardlink.txt", Linkname: "stored.txt"},
+		{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0644},
+	} {
+		hdr.ModTime = testArchiveTime
+		require.NoError(t, tw.WriteHeader(hdr))
+		switch hdr.Name {
+		case "stored.txt":
+			_, err := io.WriteString(tw, "stored contents")
+			require.NoError(t, err)
+		case "dir/deflated.txt":
+			_, err := io.WriteString(tw, "deflated contents")
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func mkTestTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(mkTestTar(t))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestIsArchive(t *testing.T) {
+	testdata := map[string]bool{
+		"a.zip":    true,
+		"A.ZIP":    true,
+		"a.tar":    true,
+		"a.tar.gz": true,
+		"a.tgz":    true,
+		"a.gz":     false,
+		"a.txt":    false,
+		"zip":      false,
+	}
+	for name, isArchive := range testdata {
+		assert.Equal(t, isArchive, IsArchive(name), name)
+	}
+}
+
+func TestArchiveFileSystem(t *testing.T) {
+	hostFS := memfs.New()
+	require.NoError(t, util.WriteFile(hostFS, "/test.zip", mkTestZip(t), 0644))
+	require.NoError(t, util.WriteFile(hostFS, "/test.tar", mkTestTar(t), 0644))
+	require.NoError(t, util.WriteFile(hostFS, "/test.tar.gz", mkTestTarGz(t), 0644))
+
+	for _, name := range []string{"/test.zip", "/test.tar", "/test.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			fs, err := OpenArchive(hostFS, name, 0)
+			require.NoError(t, err)
+			defer fs.Close()
+
+			t.Run("Open", func(t *testing.T) {
+				for path, contents := range map[string]string{
+					"/stored.txt":       "stored contents",
+					"/dir/deflated.txt": "deflated contents",
+					"/link.txt":         "deflated contents",
+				} {
+					f, err := fs.Open(path)
+					require.NoError(t, err, path)
+					data, err := ioutil.ReadAll(f)
+					require.NoError(t, err)
+					assert.Equal(t, contents, string(data), path)
+					require.NoError(t, f.Close())
+				}
+			})
+
+			t.Run("Seek", func(t *testing.T) {
+				f, err := fs.Open("/dir/deflated.txt")
+				require.NoError(t, err)
+				defer f.Close()
+				_, err = f.Seek(9, io.SeekStart)
+				require.NoError(t, err)
+				data, err := ioutil.ReadAll(f)
+				require.NoError(t, err)
+				assert.Equal(t, "contents", string(data))
+
+				// Going back after reading, and reading at an offset, work too.
+				_, err = f.Seek(0, io.SeekStart)
+				require.NoError(t, err)
+				data, err = ioutil.ReadAll(f)
+				require.NoError(t, err)
+				assert.Equal(t, "deflated contents", string(data))
+				buf := make([]byte, 8)
+				_, err = f.ReadAt(buf, 9)
+				require.NoError(t, err)
+				assert.Equal(t, "contents", string(buf))
+			})
+
+			t.Run("Stat", func(t *testing.T) {
+				info, err := fs.Stat("/stored.txt")
+				require.NoError(t, err)
+				assert.Equal(t, "stored.txt", info.Name())
+				assert.Equal(t, int64(15), info.Size())
+				assert.True(t, testArchiveTime.Equal(info.ModTime()))
+
+				info, err = fs.Stat("/dir")
+				require.NoError(t, err)
+				assert.True(t, info.IsDir())
+
+				info, err = fs.Lstat("/link.txt")
+				require.NoError(t, err)
+				assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+
+				_, err = fs.Stat("/nope.txt")
+				assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+			})
+
+			t.Run("Readlink", func(t *testing.T) {
+				target, err := fs.Readlink("/link.txt")
+				require.NoError(t, err)
+				assert.Equal(t, "dir/deflated.txt", target)
+			})
+
+			t.Run("ReadDir", func(t *testing.T) {
+				infos, err := fs.ReadDir("/")
+				require.NoError(t, err)
+				names := make([]string, len(infos))
+				for i, info := range infos {
+					names[i] = info.Name()
+				}
+				if name == "/test.zip" {
+					assert.Equal(t, []string{"dir", "link.txt", "stored.txt"}, names)
+				} else {
+					assert.Equal(t, []string{"dir", "hardlink.txt", "link.txt", "stored.txt"}, names)
+				}
+			})
+
+			t.Run("ReadOnly", func(t *testing.T) {
+				_, err := fs.Create("/new.txt")
+				assert.Equal(t, billy.ErrReadOnly, err)
+				_, err = fs.OpenFile("/stored.txt", os.O_RDWR, 0)
+				assert.Equal(t, billy.ErrReadOnly, err)
+			})
+		})
+	}
+
+	t.Run("MaxSpool", func(t *testing.T) {
+		fs, err := OpenArchive(hostFS, "/test.zip", 10)
+		require.NoError(t, err)
+		defer fs.Close()
+
+		// Files larger than the limit can still be read sequentially, but not seeked in.
+		f, err := fs.Open("/dir/deflated.txt")
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "deflated contents", string(data))
+		_, err = f.ReadAt(make([]byte, 8), 9)
+		assert.EqualError(t, err, "dir/deflated.txt: can only be read sequentially: decompresses to 17 bytes, limit is 10")
+
+		// A tar.gz archive has to be decompressed whole.
+		_, err = OpenArchive(hostFS, "/test.tar.gz", 10)
+		assert.EqualError(t, err, "/test.tar.gz: decompresses to more than 10 bytes")
+	})
+}
+
+func TestFileSystemArchives(t *testing.T) {
+	hostFS := memfs.New()
+	require.NoError(t, util.WriteFile(hostFS, "/sub/test.zip", mkTestZip(t), 0644))
+	require.NoError(t, util.WriteFile(hostFS, "/index.html", []byte("index"), 0644))
+	fs := FileSystemArchives(hostFS, SymlinksFollow, 0)
+
+	info, err := fs.Stat("/sub/test.zip")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir(), "without a trailing slash, the archive is a file")
+
+	info, err = fs.Stat("/sub/test.zip/")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir(), "with a trailing slash, the archive is a directory")
+	assert.Equal(t, "test.zip", info.Name())
+
+	infos, err := fs.ReadDir("/sub/test.zip/")
+	require.NoError(t, err)
+	assert.Len(t, infos, 3)
+
+	f, err := fs.Open("/sub/test.zip/dir/deflated.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "/sub/test.zip/dir/deflated.txt", f.Name())
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "deflated contents", string(data))
+	require.NoError(t, f.Close())
+
+	f, err = fs.Open("/index.html")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = fs.Stat("/sub/test.zip/nope")
+	assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+
+	t.Run("Symlinks", func(t *testing.T) {
+		fs := FileSystemArchives(hostFS, SymlinksDeny, 0)
+		defer fs.(io.Closer).Close()
+		_, err := fs.Stat("/sub/test.zip/link.txt")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		infos, err := fs.ReadDir("/sub/test.zip/")
+		require.NoError(t, err)
+		assert.Len(t, infos, 2)
+
+		fs = FileSystemArchives(hostFS, SymlinksWithinRoot, 0)
+		defer fs.(io.Closer).Close()
+		f, err := fs.Open("/sub/test.zip/link.txt")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "deflated contents", string(data))
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		fs := FileSystemArchives(hostFS, SymlinksFollow, 0)
+		defer fs.(io.Closer).Close()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				info, err := fs.Stat("/sub/test.zip/stored.txt")
+				if assert.NoError(t, err) {
+					assert.Equal(t, int64(15), info.Size())
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, fs.(*archivesFileSystem).open, 1)
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("new.txt")
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "new")
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		require.NoError(t, util.WriteFile(hostFS, "/sub/test.zip", buf.Bytes(), 0644))
+
+		_, err = fs.Stat("/sub/test.zip/new.txt")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		f, err := fs.Open("/sub/test.zip/new.txt")
+		require.NoError(t, err)
+		require.NoError(t, fs.(io.Closer).Close())
+
+		// Files that are still open keep their archive open.
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(data))
+		require.NoError(t, f.Close())
+		assert.Empty(t, fs.(*archivesFileSystem).open)
+	})
+}
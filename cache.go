@@ -0,0 +1,227 @@
+package pubd
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+)
+
+// Maximum number of cached results; the cache is pruned of expired entries when it's exceeded,
+// and flushed entirely if that doesn't help.
+const maxCacheEntries = 100000
+
+type cacheKind int
+
+const (
+	cacheStat cacheKind = iota
+	cacheLstat
+	cacheReadDir
+)
+
+type cacheKey struct {
+	kind cacheKind
+	name string // Cleaned, with a leading slash.
+}
+
+type cacheEntry struct {
+	at    time.Time
+	info  os.FileInfo
+	infos []os.FileInfo
+	err   error
+}
+
+// A filesystem which caches the results of Stat(), Lstat() and ReadDir() for up to a TTL,
+// including errors. Changes made through it invalidate the affected entries; changes made
+// elsewhere are picked up when entries expire, or sooner if Watch() is used.
+type CachingFileSystem struct {
+	billy.Filesystem
+	ttl time.Duration
+
+	hits, misses uint64
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	gen     uint64 // Bumped on invalidation, so results racing with it aren't cached.
+}
+
+// Returns a filesystem caching results from fs for up to ttl.
+func NewCachingFileSystem(fs billy.Filesystem, ttl time.Duration) *CachingFileSystem {
+	return &CachingFileSystem{Filesystem: fs, ttl: ttl, entries: make(map[cacheKey]*cacheEntry)}
+}
+
+// Returns the number of cache hits and misses so far.
+func (fs *CachingFileSystem) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&fs.hits), atomic.LoadUint64(&fs.misses)
+}
+
+func cacheName(filename string) string {
+	return path.Clean("/" + filename)
+}
+
+// Returns a cached entry, or calls fn to fill it in.
+func (fs *CachingFileSystem) get(kind cacheKind, filename string, fn func(name string, e *cacheEntry)) *cacheEntry {
+	key := cacheKey{kind, cacheName(filename)}
+	now := time.Now()
+
+	fs.mu.Lock()
+	e, gen := fs.entries[key], fs.gen
+	fs.mu.Unlock()
+	if e != nil && now.Sub(e.at) < fs.ttl {
+		atomic.AddUint64(&fs.hits, 1)
+		return e
+	}
+	atomic.AddUint64(&fs.misses, 1)
+
+	e = &cacheEntry{at: now}
+	fn(key.name, e)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.gen != gen {
+		return e
+	}
+	if len(fs.entries) >= maxCacheEntries {
+		fs.prune(now)
+	}
+	fs.entries[key] = e
+	return e
+}
+
+// The caller must hold fs.mu.
+func (fs *CachingFileSystem) prune(now time.Time) {
+	for key, e := range fs.entries {
+		if now.Sub(e.at) >= fs.ttl {
+			delete(fs.entries, key)
+		}
+	}
+	if len(fs.entries) >= maxCacheEntries {
+		fs.entries = make(map[cacheKey]*cacheEntry)
+	}
+}
+
+// Drops cached results for filename, anything below it, and its parent directory's listing.
+func (fs *CachingFileSystem) Invalidate(filename string) {
+	name := cacheName(filename)
+	parent := path.Dir(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	for key := range fs.entries {
+		if key.name == name || strings.HasPrefix(key.name, prefix) || key.name == parent {
+			delete(fs.entries, key)
+		}
+	}
+}
+
+// Drops all cached results.
+func (fs *CachingFileSystem) InvalidateAll() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	fs.entries = make(map[cacheKey]*cacheEntry)
+}
+
+// Invalidates cached results as w reports changes, until its channel is closed. w should watch
+// the host directory backing the filesystem, see NewWatcher(); for layered filesystems, call
+// this once for each layer.
+func (fs *CachingFileSystem) Watch(w Watcher) {
+	fs.InvalidateAll() // Anything cached so far wasn't being watched.
+	go func() {
+		for ev := range w.Events() {
+			if ev.From != "" {
+				fs.Invalidate(ev.From)
+			}
+			fs.Invalidate(ev.Path) // For EventOverflow, that's "/", ie. everything.
+		}
+	}()
+}
+
+func (fs *CachingFileSystem) Stat(filename string) (os.FileInfo, error) {
+	e := fs.get(cacheStat, filename, func(name string, e *cacheEntry) {
+		e.info, e.err = fs.Filesystem.Stat(name)
+	})
+	return e.info, e.err
+}
+
+func (fs *CachingFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	e := fs.get(cacheLstat, filename, func(name string, e *cacheEntry) {
+		e.info, e.err = fs.Filesystem.Lstat(name)
+	})
+	return e.info, e.err
+}
+
+// Callers get their own copy of the cached slice, which they may eg. sort.
+func (fs *CachingFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	e := fs.get(cacheReadDir, dirname, func(name string, e *cacheEntry) {
+		e.infos, e.err = fs.Filesystem.ReadDir(name)
+	})
+	if e.infos == nil {
+		return nil, e.err
+	}
+	return append(make([]os.FileInfo, 0, len(e.infos)), e.infos...), e.err
+}
+
+func (fs *CachingFileSystem) Create(filename string) (billy.File, error) {
+	defer fs.Invalidate(filename)
+	return fs.Filesystem.Create(filename)
+}
+
+func (fs *CachingFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		defer fs.Invalidate(filename)
+	}
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (fs *CachingFileSystem) Rename(oldpath, newpath string) error {
+	defer fs.Invalidate(newpath)
+	defer fs.Invalidate(oldpath)
+	return fs.Filesystem.Rename(oldpath, newpath)
+}
+
+func (fs *CachingFileSystem) Remove(filename string) error {
+	defer fs.Invalidate(filename)
+	return fs.Filesystem.Remove(filename)
+}
+
+// Invalidates the topmost directory, as any number of them may be created.
+func (fs *CachingFileSystem) MkdirAll(filename string, perm os.FileMode) error {
+	if segments := splitPath(filename); len(segments) > 0 {
+		defer fs.Invalidate(segments[0])
+	}
+	return fs.Filesystem.MkdirAll(filename, perm)
+}
+
+func (fs *CachingFileSystem) Symlink(target, link string) error {
+	defer fs.Invalidate(link)
+	return fs.Filesystem.Symlink(target, link)
+}
+
+func (fs *CachingFileSystem) TempFile(dir, prefix string) (billy.File, error) {
+	f, err := fs.Filesystem.TempFile(dir, prefix)
+	if err == nil {
+		fs.Invalidate(f.Name())
+	}
+	return f, err
+}
+
+// The chrooted filesystem shares the cache.
+func (fs *CachingFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	return chroot.New(fs, dir), nil
+}
+
+func (fs *CachingFileSystem) DirConfig(dir string) (DirConfig, error) {
+	return DirConfigOf(fs.Filesystem, dir)
+}
+
+func (fs *CachingFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
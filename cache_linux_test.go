@@ -0,0 +1,54 @@
+package pubd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCachingFileSystemWatch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	require.NoError(t, os.Mkdir(filepath.Join(tmp, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "a.txt"), []byte("a"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := NewCachingFileSystem(osfs.New(tmp), time.Hour)
+	w, err := NewWatcher(ctx, zap.NewNop(), nil, tmp, nil, 0)
+	require.NoError(t, err)
+	fs.Watch(w)
+
+	assert.Equal(t, []string{"a.txt"}, readDirNames(t, fs, "dir"))
+	info, err := fs.Stat("dir/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), info.Size())
+
+	// Changes made behind the cache's back should be noticed shortly.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "a.txt"), []byte("aaa"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "b.txt"), []byte("b"), 0644))
+	assert.Eventually(t, func() bool {
+		info, err := fs.Stat("dir/a.txt")
+		return err == nil && info.Size() == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		infos, err := fs.ReadDir("dir")
+		return err == nil && len(infos) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Replacing a whole directory should drop everything below it.
+	require.NoError(t, os.RemoveAll(filepath.Join(tmp, "dir")))
+	assert.Eventually(t, func() bool {
+		_, err := fs.Stat("dir/a.txt")
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package pubd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingFileSystem(t *testing.T) {
+	inner := memfs.New()
+	require.NoError(t, util.WriteFile(inner, "dir/a.txt", []byte("a"), 0644))
+	fs := NewCachingFileSystem(inner, time.Hour)
+
+	// The first lookup is a miss, the rest are hits; this includes errors.
+	for i := 0; i < 3; i++ {
+		info, err := fs.Stat("/dir/a.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), info.Size())
+		_, err = fs.Stat("dir/missing.txt")
+		assert.True(t, os.IsNotExist(err), "%v", err)
+		assert.Equal(t, []string{"a.txt"}, readDirNames(t, fs, "dir"))
+	}
+	hits, misses := fs.Stats()
+	assert.Equal(t, uint64(6), hits)
+	assert.Equal(t, uint64(3), misses)
+
+	t.Run("Copy", func(t *testing.T) {
+		infos, err := fs.ReadDir("dir")
+		require.NoError(t, err)
+		infos[0] = nil
+		assert.Equal(t, []string{"a.txt"}, readDirNames(t, fs, "dir"), "callers shouldn't share a slice")
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		require.NoError(t, util.WriteFile(inner, "dir/b.txt", []byte("b"), 0644))
+		assert.Equal(t, []string{"a.txt"}, readDirNames(t, fs, "dir"))
+		fs.Invalidate("dir/b.txt")
+		assert.ElementsMatch(t, []string{"a.txt", "b.txt"}, readDirNames(t, fs, "dir"))
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		require.NoError(t, util.WriteFile(fs, "dir/missing.txt", []byte("hi"), 0644))
+		info, err := fs.Stat("dir/missing.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), info.Size())
+		assert.ElementsMatch(t, []string{"a.txt", "b.txt", "missing.txt"}, readDirNames(t, fs, "dir"))
+
+		require.NoError(t, fs.Rename("dir", "dir2"))
+		_, err = fs.Stat("dir/a.txt")
+		assert.True(t, os.IsNotExist(err), "%v", err)
+		assert.ElementsMatch(t, []string{"a.txt", "b.txt", "missing.txt"}, readDirNames(t, fs, "dir2"))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		fs := NewCachingFileSystem(inner, time.Nanosecond)
+		_, err := fs.Stat("dir2/a.txt")
+		require.NoError(t, err)
+		require.NoError(t, inner.Remove("dir2/a.txt"))
+		time.Sleep(time.Millisecond)
+		_, err = fs.Stat("dir2/a.txt")
+		assert.True(t, os.IsNotExist(err), "%v", err)
+	})
+}
@@ -0,0 +1,114 @@
+package pubd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+)
+
+// Restricts which clients can connect to a tls/ listener, by their certificates.
+type ClientAuth struct {
+	CAs      *x509.CertPool // Client certificates must be signed by one of these.
+	Optional bool           // Allow clients without certificates; those that present one are still checked.
+
+	// Glob patterns (see path.Match) for allowed identities, matched against a certificate's
+	// subject common name and DNS, email and URI SANs. If empty, any verified client is allowed.
+	Allow []string
+}
+
+// Loads a PEM-encoded CA bundle.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", filename)
+	}
+	return pool, nil
+}
+
+// Configures a server-side tls.Config to verify client certificates.
+func (ca ClientAuth) Apply(cfg *tls.Config) error {
+	if ca.CAs == nil {
+		return errors.New("client auth: no CAs configured")
+	}
+	for _, pattern := range ca.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("client auth: invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	cfg.ClientCAs = ca.CAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if ca.Optional {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	// Unlike VerifyPeerCertificate, this is also called for resumed sessions.
+	cfg.VerifyConnection = ca.verify
+	return nil
+}
+
+// Checks a verified client certificate against the allowed patterns.
+func (ca ClientAuth) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(ca.Allow) == 0 {
+		return nil // No certificate (if optional), or no restrictions.
+	}
+	leaf := cs.VerifiedChains[0][0]
+	for _, id := range CertIdentities(leaf) {
+		for _, pattern := range ca.Allow {
+			if ok, _ := path.Match(pattern, id); ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate '%s' is not allowed", CertIdentity(leaf))
+}
+
+// Returns all identities a certificate vouches for: its subject common name, followed
+// by its DNS, email and URI SANs.
+func CertIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	if cn := cert.Subject.CommonName; cn != "" {
+		ids = append(ids, cn)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// Returns a certificate's primary identity, for logging.
+func CertIdentity(cert *x509.Certificate) string {
+	if ids := CertIdentities(cert); len(ids) > 0 {
+		return ids[0]
+	}
+	return cert.Subject.String()
+}
+
+// Returns the identity of a verified client certificate, or "" if there isn't one.
+func TLSIdentity(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return CertIdentity(cs.VerifiedChains[0][0])
+}
+
+// Returns the verified client identity for a connection accepted from a tls/ listener,
+// completing the handshake if needed, or "" for other kinds of connections.
+func ConnIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	return TLSIdentity(tlsConn.ConnectionState()), nil
+}
@@ -0,0 +1,152 @@
+package pubd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/pubd/testutil"
+)
+
+func TestLoadCertPool(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	ca := writeCert(t, tmp, "ca")
+	pool, err := LoadCertPool(filepath.Join(tmp, "cert.pem"))
+	require.NoError(t, err)
+	assert.True(t, pool.Equal(ca.Pool()))
+
+	_, err = LoadCertPool(filepath.Join(tmp, "key.pem"))
+	assert.EqualError(t, err, filepath.Join(tmp, "key.pem")+": no certificates found")
+}
+
+func TestClientAuth(t *testing.T) {
+	ca, err := testutil.NewCert("ca", nil)
+	require.NoError(t, err)
+	otherCA, err := testutil.NewCert("other-ca", nil)
+	require.NoError(t, err)
+	server, err := testutil.NewCert("127.0.0.1", ca)
+	require.NoError(t, err)
+	alice, err := testutil.NewCert("alice.ops.example.com", ca)
+	require.NoError(t, err)
+	mallory, err := testutil.NewCert("mallory.example.com", ca)
+	require.NoError(t, err)
+	impostor, err := testutil.NewCert("alice.ops.example.com", otherCA)
+	require.NoError(t, err)
+
+	// Returns the server-side result of a handshake between the given configs.
+	handshake := func(t *testing.T, cfg, clientCfg *tls.Config) (string, error) {
+		ls, err := ListenConfig{TLS: cfg}.Listen("tls/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+
+		type result struct {
+			id  string
+			err error
+		}
+		resC := make(chan result, 1)
+		go func() {
+			conn, err := ls[0].Accept()
+			if err != nil {
+				resC <- result{err: err}
+				return
+			}
+			defer conn.Close()
+			id, err := ConnIdentity(conn)
+			resC <- result{id, err}
+		}()
+
+		if conn, err := tls.Dial("tcp", ls[0].Addr().String(), clientCfg); err == nil {
+			conn.Read(make([]byte, 1)) // Wait for the server to accept or reject us.
+			conn.Close()
+		}
+		res := <-resC
+		return res.id, res.err
+	}
+	clientConfig := func(client *testutil.Cert) *tls.Config {
+		clientCfg := &tls.Config{RootCAs: ca.Pool()}
+		if client != nil {
+			// Present the certificate even if the server doesn't list its issuer.
+			cert := client.TLS()
+			clientCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+		return clientCfg
+	}
+	connect := func(t *testing.T, auth ClientAuth, client *testutil.Cert) (string, error) {
+		cfg := &tls.Config{Certificates: []tls.Certificate{server.TLS()}}
+		require.NoError(t, auth.Apply(cfg))
+		return handshake(t, cfg, clientConfig(client))
+	}
+
+	testdata := map[string]struct {
+		Auth   ClientAuth
+		Client *testutil.Cert
+		ID     string
+		Err    bool
+	}{
+		"Required":                {Auth: ClientAuth{CAs: ca.Pool()}, Client: alice, ID: "alice.ops.example.com"},
+		"Required, Missing":       {Auth: ClientAuth{CAs: ca.Pool()}, Err: true},
+		"Required, Wrong CA":      {Auth: ClientAuth{CAs: ca.Pool()}, Client: impostor, Err: true},
+		"Optional":                {Auth: ClientAuth{CAs: ca.Pool(), Optional: true}, Client: alice, ID: "alice.ops.example.com"},
+		"Optional, Missing":       {Auth: ClientAuth{CAs: ca.Pool(), Optional: true}, ID: ""},
+		"Optional, Wrong CA":      {Auth: ClientAuth{CAs: ca.Pool(), Optional: true}, Client: impostor, Err: true},
+		"Allow":                   {Auth: ClientAuth{CAs: ca.Pool(), Allow: []string{"*.ops.example.com"}}, Client: alice, ID: "alice.ops.example.com"},
+		"Allow, Mismatch":         {Auth: ClientAuth{CAs: ca.Pool(), Allow: []string{"*.ops.example.com"}}, Client: mallory, Err: true},
+		"Allow, Optional, Absent": {Auth: ClientAuth{CAs: ca.Pool(), Optional: true, Allow: []string{"*.ops.example.com"}}, ID: ""},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			id, err := connect(t, tdata.Auth, tdata.Client)
+			if tdata.Err {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tdata.ID, id)
+			}
+		})
+	}
+
+	t.Run("Resumed", func(t *testing.T) {
+		// Resume a session under narrower patterns, eg. after a reload; it must be rechecked.
+		key := [32]byte{1} // A zero key is replaced with a random one.
+		clientCfg := clientConfig(mallory)
+		clientCfg.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+		cfg := &tls.Config{Certificates: []tls.Certificate{server.TLS()}, SessionTicketKey: key}
+		require.NoError(t, ClientAuth{CAs: ca.Pool(), Allow: []string{"*.example.com"}}.Apply(cfg))
+		id, err := handshake(t, cfg, clientCfg)
+		require.NoError(t, err)
+		assert.Equal(t, "mallory.example.com", id)
+
+		cfg = &tls.Config{Certificates: []tls.Certificate{server.TLS()}, SessionTicketKey: key}
+		require.NoError(t, ClientAuth{CAs: ca.Pool(), Allow: []string{"*.ops.example.com"}}.Apply(cfg))
+		_, err = handshake(t, cfg, clientCfg)
+		assert.EqualError(t, err, "client certificate 'mallory.example.com' is not allowed")
+	})
+	t.Run("No CAs", func(t *testing.T) {
+		assert.EqualError(t, ClientAuth{}.Apply(&tls.Config{}), "client auth: no CAs configured")
+	})
+	t.Run("Bad Pattern", func(t *testing.T) {
+		err := ClientAuth{CAs: ca.Pool(), Allow: []string{"["}}.Apply(&tls.Config{})
+		assert.EqualError(t, err, "client auth: invalid pattern '[': syntax error in pattern")
+	})
+}
+
+func TestConnIdentityPlain(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	id, err := ConnIdentity(a)
+	require.NoError(t, err)
+	assert.Equal(t, "", id)
+}
@@ -0,0 +1,115 @@
+package cliutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/proto/httppub"
+)
+
+// Flags for automatically obtaining certificates over ACME (RFC 8555), eg. from Let's Encrypt.
+type ACMEConfig struct {
+	Domains   []string `toml:"domains"`   // Domains to obtain certificates for; enables ACME.
+	Directory string   `toml:"directory"` // ACME directory URL; default: Let's Encrypt.
+	Email     string   `toml:"email"`     // Contact address for the account, optional.
+	CacheDir  string   `toml:"cache-dir"` // Where to store certificates and the account key.
+	CAFile    string   `toml:"ca-file"`   // CA bundle to verify the ACME server with, for testing.
+	HTTPAddr  string   `toml:"http-addr"` // Extra plain HTTP address for HTTP-01 challenges.
+}
+
+func (c *ACMEConfig) Flags(f *pflag.FlagSet) {
+	f.StringSliceVar(&c.Domains, "tls.acme.domains", c.Domains, "obtain certificates for a domain over ACME, instead of using --tls.cert-file")
+	f.StringVar(&c.Directory, "tls.acme.directory", c.Directory, "ACME directory URL (default: Let's Encrypt)")
+	f.StringVar(&c.Email, "tls.acme.email", c.Email, "contact email for the ACME account")
+	f.StringVar(&c.CacheDir, "tls.acme.cache-dir", c.CacheDir, "directory to store ACME certificates in (default: user cache dir)")
+	f.StringVar(&c.CAFile, "tls.acme.ca-file", c.CAFile, "trust this CA bundle when talking to the ACME server")
+	f.StringVar(&c.HTTPAddr, "tls.acme.http-addr", c.HTTPAddr, "also listen for plain HTTP here, to answer HTTP-01 challenges")
+
+	deprecatedAlias(f, "tls.acme.domain", "tls.acme.domains")
+}
+
+// Returns a certificate manager for the configured domains, or nil if ACME isn't enabled.
+// Certificates are obtained when first requested, and renewed in the background.
+func (c ACMEConfig) Manager() (*autocert.Manager, error) {
+	if len(c.Domains) == 0 {
+		if c.HTTPAddr != "" {
+			return nil, errors.New("--tls.acme.http-addr requires --tls.acme.domains")
+		}
+		return nil, nil
+	}
+	cacheDir := c.CacheDir
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("acme: couldn't find a cache directory, try --tls.acme.cache-dir: %w", err)
+		}
+		cacheDir = filepath.Join(userCacheDir, "pubd", "acme")
+	}
+	client := &acme.Client{DirectoryURL: c.Directory}
+	if c.CAFile != "" {
+		pool, err := pubd.LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Client:     client,
+		Email:      c.Email,
+	}, nil
+}
+
+// Like sc.ListenAndServe(), but if acm is non-nil and there's an HTTPAddr, also listens there,
+// answering HTTP-01 challenges and redirecting anything else to HTTPS.
+func (c ACMEConfig) ListenAndServe(ctx context.Context, L *zap.Logger, acm *autocert.Manager, lc pubd.ListenConfig, sc pubd.ServeConfig, addr string, srv pubd.Server) error {
+	ls, err := lc.Listen(addr)
+	if err != nil {
+		return err
+	}
+	services, err := c.Services(L, acm, lc)
+	if err != nil {
+		for _, l := range ls {
+			l.Close()
+		}
+		return err
+	}
+	return sc.ServeServices(ctx, append(services, pubd.Service{Listeners: ls, Server: srv}))
+}
+
+// If acm is non-nil and there's an HTTPAddr, returns a service listening there, answering HTTP-01
+// challenges and redirecting anything else to HTTPS.
+func (c ACMEConfig) Services(L *zap.Logger, acm *autocert.Manager, lc pubd.ListenConfig) ([]pubd.Service, error) {
+	if acm == nil || c.HTTPAddr == "" {
+		return nil, nil
+	}
+	lc.TLS = nil
+	ls, err := lc.Listen(c.HTTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("--tls.acme.http-addr: %w", err)
+	}
+	return []pubd.Service{{
+		Listeners: ls,
+		Server: pubd.ServerFunc(func(ctx context.Context, l net.Listener) error {
+			L.Info("Answering ACME challenges", zap.Stringer("addr", l.Addr()))
+			return httppub.Serve(ctx, l, acm.HTTPHandler(nil))
+		}),
+	}}, nil
+}
@@ -0,0 +1,360 @@
+package cliutil
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/testutil"
+)
+
+func TestACMEConfigManager(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		acm, err := ACMEConfig{}.Manager()
+		require.NoError(t, err)
+		assert.Nil(t, acm)
+	})
+	t.Run("HTTP Addr Without Domains", func(t *testing.T) {
+		_, err := ACMEConfig{HTTPAddr: ":80"}.Manager()
+		assert.EqualError(t, err, "--tls.acme.http-addr requires --tls.acme.domains")
+	})
+	t.Run("Bad CA File", func(t *testing.T) {
+		_, err := ACMEConfig{Domains: []string{"example.com"}, CAFile: "/nonexistent"}.Manager()
+		assert.Error(t, err)
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		acm, err := ACMEConfig{
+			Domains:   []string{"example.com"},
+			Directory: "https://localhost:14000/dir",
+			Email:     "admin@example.com",
+			CacheDir:  "/var/cache/pubd",
+		}.Manager()
+		require.NoError(t, err)
+		assert.Equal(t, "https://localhost:14000/dir", acm.Client.DirectoryURL)
+		assert.Equal(t, "admin@example.com", acm.Email)
+		assert.NoError(t, acm.HostPolicy(context.Background(), "example.com"))
+		assert.Error(t, acm.HostPolicy(context.Background(), "example.org"))
+	})
+	t.Run("With Cert File", func(t *testing.T) {
+		cfg := TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ACME: ACMEConfig{Domains: []string{"example.com"}}}
+		acm, err := cfg.ACME.Manager()
+		require.NoError(t, err)
+		_, _, err = cfg.ListenConfig(context.Background(), zap.NewNop(), acm)
+		assert.EqualError(t, err, "--tls.acme.domains can't be used with --tls.cert-file or --tls.key-file")
+	})
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	acm, err := ACMEConfig{Domains: []string{"example.com"}, CacheDir: tmp}.Manager()
+	require.NoError(t, err)
+	h := acm.HTTPHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("fallback"))
+	}))
+
+	// Tokens are stored in the cache while a challenge is in progress.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "tok+http-01"), []byte("tok.thumbprint"), 0600))
+
+	testdata := map[string]struct {
+		Status int
+		Body   string
+	}{
+		"http://example.com/.well-known/acme-challenge/tok":   {http.StatusOK, "tok.thumbprint"},
+		"http://example.com/.well-known/acme-challenge/nope":  {http.StatusNotFound, ""},
+		"http://example.org/.well-known/acme-challenge/tok":   {http.StatusForbidden, ""},
+		"http://example.com/index.html":                       {http.StatusOK, "fallback"},
+		"http://example.com/.well-known/acme-challenge-other": {http.StatusOK, "fallback"},
+	}
+	for url, tdata := range testdata {
+		t.Run(url, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+			assert.Equal(t, tdata.Status, rw.Code)
+			if tdata.Body != "" {
+				assert.Equal(t, tdata.Body, rw.Body.String())
+			}
+		})
+	}
+}
+
+// A minimal in-process ACME (RFC 8555) server, which validates HTTP-01 challenges by fetching
+// them from httpAddr, and issues certificates signed by ca. Request signatures aren't checked.
+type fakeACME struct {
+	srv      *httptest.Server
+	ca       *testutil.Cert
+	httpAddr string
+
+	mu     sync.Mutex
+	domain string
+	token  string
+	status string // Of the order; its authorization is valid once it's "ready".
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T, httpAddr string) *fakeACME {
+	ca, err := testutil.NewCert("fake acme ca", nil)
+	require.NoError(t, err)
+	a := &fakeACME{ca: ca, httpAddr: httpAddr}
+	a.srv = httptest.NewTLSServer(http.HandlerFunc(a.handle))
+	return a
+}
+
+func (a *fakeACME) Close() { a.srv.Close() }
+
+// Returns the server's own certificate, as PEM.
+func (a *fakeACME) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.srv.Certificate().Raw})
+}
+
+func (a *fakeACME) handle(rw http.ResponseWriter, req *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rw.Header().Set("Replay-Nonce", "nonce")
+
+	// Requests are JWS objects; all we need is their payload.
+	var payload []byte
+	if req.Method == http.MethodPost {
+		var jws struct{ Payload string }
+		if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	url := a.srv.URL
+	switch req.URL.Path {
+	case "/dir":
+		a.reply(rw, http.StatusOK, map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+		})
+	case "/nonce":
+	case "/account":
+		rw.Header().Set("Location", url+"/account/1")
+		a.reply(rw, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		var order struct{ Identifiers []struct{ Value string } }
+		if err := json.Unmarshal(payload, &order); err != nil || len(order.Identifiers) != 1 {
+			http.Error(rw, "expected one identifier", http.StatusBadRequest)
+			return
+		}
+		a.domain, a.token, a.status = order.Identifiers[0].Value, "tok3n", "pending"
+		rw.Header().Set("Location", url+"/order/1")
+		a.reply(rw, http.StatusCreated, a.order())
+	case "/order/1":
+		a.reply(rw, http.StatusOK, a.order())
+	case "/authz/1":
+		a.reply(rw, http.StatusOK, a.authz())
+	case "/challenge/1":
+		// Validate it right away, like a real CA eventually would.
+		if err := a.validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		a.status = "ready"
+		a.reply(rw, http.StatusOK, a.authz()["challenges"].([]map[string]string)[0])
+	case "/finalize/1":
+		if err := a.issue(payload); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		a.status = "valid"
+		a.reply(rw, http.StatusOK, a.order())
+	case "/cert/1":
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: a.cert})
+		rw.Write(a.ca.CertPEM)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (a *fakeACME) reply(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (a *fakeACME) order() map[string]interface{} {
+	order := map[string]interface{}{
+		"status":         a.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": a.domain}},
+		"authorizations": []string{a.srv.URL + "/authz/1"},
+		"finalize":       a.srv.URL + "/finalize/1",
+	}
+	if a.status == "valid" {
+		order["certificate"] = a.srv.URL + "/cert/1"
+	}
+	return order
+}
+
+func (a *fakeACME) authz() map[string]interface{} {
+	status := "pending"
+	if a.status != "pending" {
+		status = "valid"
+	}
+	return map[string]interface{}{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": a.domain},
+		"challenges": []map[string]string{{
+			"type":   "http-01",
+			"url":    a.srv.URL + "/challenge/1",
+			"token":  a.token,
+			"status": status,
+		}},
+	}
+}
+
+// Fetches the HTTP-01 challenge response, as if from the domain.
+func (a *fakeACME) validate() error {
+	req, err := http.NewRequest("GET", "http://"+a.httpAddr+"/.well-known/acme-challenge/"+a.token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = a.domain
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), a.token+".") {
+		return fmt.Errorf("bad challenge response: %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// Signs the CSR in a finalize request.
+func (a *fakeACME) issue(payload []byte) error {
+	if a.status != "ready" {
+		return fmt.Errorf("order is %s", a.status)
+	}
+	var finalize struct{ CSR string }
+	if err := json.Unmarshal(payload, &finalize); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	names := csr.DNSNames
+	if len(names) == 0 {
+		names = []string{csr.Subject.CommonName}
+	}
+	if len(names) != 1 || names[0] != a.domain {
+		return fmt.Errorf("unauthorized names: %v", names)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	a.cert, err = x509.CreateCertificate(rand.Reader, tmpl, a.ca.Cert, csr.PublicKey, a.ca.Key)
+	return err
+}
+
+// Returns an address nothing is listening on, probably.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// Obtains a certificate from a fake ACME server, answering its HTTP-01 challenge.
+func TestACMEServer(t *testing.T) {
+	const domain = "pubd.test"
+	httpAddr := freeAddr(t)
+	server := newFakeACME(t, httpAddr)
+	defer server.Close()
+
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	caFile := filepath.Join(tmp, "acme-ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, server.CertPEM(), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cfg := ACMEConfig{
+		Domains:   []string{domain},
+		Directory: server.srv.URL + "/dir",
+		CacheDir:  filepath.Join(tmp, "cache"),
+		CAFile:    caFile,
+		HTTPAddr:  httpAddr,
+	}
+	acm, err := cfg.Manager()
+	require.NoError(t, err)
+	lc, _, err := TLSConfig{ACME: cfg}.ListenConfig(ctx, zap.NewNop(), acm)
+	require.NoError(t, err)
+
+	// Serve HTTP-01 challenges, and wait for the listener to come up.
+	errC := make(chan error, 1)
+	go func() {
+		errC <- cfg.ListenAndServe(ctx, zap.NewNop(), acm, lc, pubd.ServeConfig{}, "tls/127.0.0.1:0",
+			pubd.ServerFunc(func(ctx context.Context, l net.Listener) error {
+				<-ctx.Done()
+				return nil
+			}))
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", httpAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cert, err := acm.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	require.NoError(t, err)
+	assert.Equal(t, []string{domain}, cert.Leaf.DNSNames)
+	assert.NoError(t, cert.Leaf.CheckSignatureFrom(server.ca.Cert))
+
+	// The certificate is cached on disk, and can be used without the ACME server.
+	cfg.Directory = "https://127.0.0.1:1/dir"
+	acm2, err := cfg.Manager()
+	require.NoError(t, err)
+	cert2, err := acm2.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	require.NoError(t, err)
+	assert.Equal(t, cert.Leaf.Raw, cert2.Leaf.Raw)
+
+	cancel()
+	assert.NoError(t, <-errC)
+}
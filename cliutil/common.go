@@ -1,34 +1,285 @@
 package cliutil
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/spf13/pflag"
+	"go.uber.org/zap"
 
 	"github.com/liclac/pubd"
 )
 
+// Name of per-directory config files; see FileSystemConfig.DirConfig.
+const DirConfigName = ".pubd.toml"
+
 // Standard flags for constructing an http.FileSystem.
 type FileSystemConfig struct {
-	Path    string   `toml:"path"` // Normally given as os.Args[1].
-	Exclude []string `toml:"exclude"`
+	Path     string   `toml:"path"`     // Normally given as os.Args[1].
+	Layers   []string `toml:"layers"`   // Directories layered below Path, in order of precedence.
+	Include  []string `toml:"include"`  // If set, only matching files are served.
+	Exclude  []string `toml:"exclude"`  // Takes precedence over Include.
+	Symlinks string   `toml:"symlinks"` // One of: follow, deny, within-root.
+
+	// Let archives (zip, tar, tar.gz) be browsed as directories, eg. "/bundle.zip/".
+	Archives bool `toml:"archives"`
+
+	// Largest compressed file in a zip archive that may be seeked in, and largest tar.gz archive,
+	// in bytes; they're decompressed into a temporary file. 0 means pubd.DefaultMaxArchiveSpool.
+	ArchivesMaxSpool int64 `toml:"archives-max-spool"`
+
+	// Only serve world-readable files, like ~/public_html.
+	PublicOnly bool `toml:"public-only"`
+
+	// Names of .gitignore-style files to read from each directory, eg. ".pubdignore".
+	IgnoreFiles []string `toml:"ignore-files"`
+
+	// Read restricted settings (readme, exclude, headers) from a .pubd.toml in each directory,
+	// which apply to it and everything below it; see pubd.DirConfig.
+	DirConfig bool `toml:"dir-config"`
+
+	// Serve a git revision ("REV[:SUBDIR]") from the repository at Path, instead of Path itself.
+	Git        string   `toml:"git"`
+	GitRefresh Duration `toml:"git-refresh"` // Re-resolve Git this often; also done on reload.
+
+	// Cache stat() and directory listings for this long; see pubd.CachingFileSystem.
+	CacheTTL Duration `toml:"cache-ttl"`
+
+	// Serve these under virtual paths, instead of serving Path itself; see MountConfig.
+	Mounts []MountConfig `toml:"mount"`
+
+	// Serve users' directories as /~user/, instead of serving Path itself.
+	UserDirs UserDirsConfig `toml:"userdir"`
+}
+
+// A [[mount]] table, serving a directory under a virtual path. Each mount has its own settings;
+// the top-level ones apply on top of them, to the whole tree. Relative paths are relative to
+// the top-level path.
+type MountConfig struct {
+	At string `toml:"at"` // Virtual path, eg. "/docs".
+	FileSystemConfig
 }
 
 // Defaults for FileSystemConfig.
 func FileSystemDefaults() FileSystemConfig {
 	pwd, _ := os.Getwd()
-	return FileSystemConfig{Path: pwd}
+	return FileSystemConfig{Path: pwd, Symlinks: string(pubd.SymlinksFollow), UserDirs: UserDirsDefaults()}
 }
 
 func (c *FileSystemConfig) Flags(f *pflag.FlagSet) {
+	f.StringSliceVarP(&c.Layers, "layers", "L", c.Layers, "layer another directory below path; files in path take precedence")
+	f.StringSliceVarP(&c.Include, "include", "i", c.Include, "only include matching filenames/.gitignore patterns")
 	f.StringSliceVarP(&c.Exclude, "exclude", "x", c.Exclude, "filenames/.gitignore patterns to exclude")
+	f.StringSliceVar(&c.IgnoreFiles, "ignore-files", c.IgnoreFiles, "read exclusions from files with this name in each directory, eg. .gitignore")
+	f.BoolVar(&c.DirConfig, "dir-config", c.DirConfig, "read readme, exclude and headers settings from a "+DirConfigName+" in each directory")
+	f.BoolVar(&c.Archives, "archives", c.Archives, "browse into archives (zip, tar, tar.gz) with a trailing slash, eg. /bundle.zip/")
+	f.Int64Var(&c.ArchivesMaxSpool, "archives-max-spool", c.ArchivesMaxSpool, "largest file in an archive that may be decompressed into a temporary file, in bytes (default 1GiB)")
+	f.BoolVar(&c.PublicOnly, "public-only", c.PublicOnly, "only serve world-readable files and directories, like ~/public_html")
+	f.StringVar(&c.Symlinks, "symlinks", c.Symlinks, "symlink policy: follow, deny or within-root")
+	f.StringVar(&c.Git, "git", c.Git, "serve a revision (REV[:SUBDIR]) of the git repository at path")
+	f.Var(&c.GitRefresh, "git-refresh", "re-resolve the --git revision this often (always done on SIGHUP)")
+	f.Var(&c.CacheTTL, "cache-ttl", "cache file info and directory listings this long (changes are noticed sooner on Linux)")
+	c.UserDirs.Flags(f)
+
+	// Old names, from before flags were named after their config keys.
+	deprecatedAlias(f, "layer", "layers")
+	deprecatedAlias(f, "ignore-file", "ignore-files")
 }
 
-func (c FileSystemConfig) Build(fs billy.Filesystem) (billy.Filesystem, error) {
-	fs, err := fs.Chroot(c.Path)
+// Builds a filesystem from the configuration. Background tasks, such as refreshing a git
+// revision, run until ctx expires.
+func (c FileSystemConfig) Build(ctx context.Context, L *zap.Logger, hostFS billy.Filesystem) (billy.Filesystem, error) {
+	symlinks, err := pubd.ParseSymlinkPolicy(c.Symlinks)
+	if err != nil {
+		return nil, fmt.Errorf("--symlinks: %w", err)
+	}
+	fs, err := c.buildRoot(ctx, L, hostFS)
 	if err != nil {
 		return nil, err
 	}
-	return pubd.FileSystemExclude(fs, c.Exclude), nil
+	if len(c.Layers) > 0 {
+		layers := []billy.Filesystem{fs}
+		for _, layer := range c.Layers {
+			layerFS, err := hostFS.Chroot(layer)
+			if err != nil {
+				return nil, fmt.Errorf("--layers: %s: %w", layer, err)
+			}
+			layers = append(layers, layerFS)
+		}
+		fs = pubd.FileSystemUnion(layers...)
+	}
+	if c.CacheTTL.Duration > 0 {
+		fs = c.buildCache(ctx, L.Named("cache"), fs, hostFS)
+	}
+	filtered := len(c.Include) > 0 || len(c.Exclude) > 0 || len(c.IgnoreFiles) > 0 || c.PublicOnly || c.DirConfig
+	unfiltered := fs
+	if filtered {
+		// Filter the paths symlinks resolve to as well as the links themselves, below, so a
+		// link can't be used to reach a file that's been excluded.
+		filter, _ := c.filter(L, fs)
+		fs = pubd.FileSystemFilter(fs, filter)
+	}
+	if filtered && symlinks == pubd.SymlinksFollow {
+		fs = pubd.FileSystemResolveSymlinks(fs)
+	} else {
+		fs = pubd.FileSystemSymlinks(fs, symlinks)
+	}
+	if c.Archives {
+		// This needs to go after the symlink resolver, which would clean off trailing slashes.
+		fs = c.buildArchives(ctx, fs, symlinks)
+		if filtered {
+			unfiltered = c.buildArchives(ctx, unfiltered, symlinks)
+		}
+	}
+	if !filtered {
+		return fs, nil
+	}
+	// The filter above hides ignore and config files, so this one reads them from below it.
+	filter, dcs := c.filter(L, unfiltered)
+	fs = pubd.FileSystemFilter(fs, filter)
+	if dcs != nil {
+		fs = pubd.FileSystemDirConfigs(fs, dcs)
+	}
+	return fs, nil
+}
+
+// Makes archives in fs browsable, until ctx expires.
+func (c FileSystemConfig) buildArchives(ctx context.Context, fs billy.Filesystem, symlinks pubd.SymlinkPolicy) billy.Filesystem {
+	fs = pubd.FileSystemArchives(fs, symlinks, c.ArchivesMaxSpool)
+	go func(afs io.Closer) {
+		<-ctx.Done()
+		afs.Close()
+	}(fs.(io.Closer))
+	return fs
+}
+
+// Returns a filter for Include, Exclude, IgnoreFiles, PublicOnly and DirConfig, and if the
+// latter is set, the DirConfigs it reads. fs should be the unfiltered filesystem.
+func (c FileSystemConfig) filter(L *zap.Logger, fs billy.Filesystem) (pubd.Filter, *pubd.DirConfigs) {
+	// Exclusions take precedence; a file is served if it's included, and not excluded.
+	filters := []pubd.Filter{
+		pubd.IncludeFilter(c.Include),
+		pubd.ExcludeFilter(c.Exclude),
+		pubd.IgnoreFileFilter(L.Named("ignore"), fs, c.IgnoreFiles),
+	}
+	if c.PublicOnly {
+		filters = append(filters, pubd.PublicFilter(fs))
+	}
+	var dcs *pubd.DirConfigs
+	if c.DirConfig {
+		dcs = pubd.NewDirConfigs(fs, DirConfigName)
+		filters = append(filters, dcs.Filter())
+	}
+	return pubd.AllFilters(filters...), dcs
+}
+
+// Lets Configure() find an embedded FileSystemConfig.
+func (c *FileSystemConfig) fileSystemConfig() *FileSystemConfig { return c }
+
+// Returns the filesystem for Path: a directory, an archive, a git repository, mounts, or
+// users' directories.
+func (c FileSystemConfig) buildRoot(ctx context.Context, L *zap.Logger, hostFS billy.Filesystem) (billy.Filesystem, error) {
+	if len(c.Mounts) > 0 {
+		return c.buildMounts(ctx, L, hostFS)
+	}
+	if c.UserDirs.Dir != "" {
+		return pubd.FileSystemUserDirs(c.UserDirs.open(ctx, L.Named("userdir"), hostFS)), nil
+	}
+	if c.Git != "" {
+		return c.buildGit(ctx, L, hostFS)
+	}
+	if info, err := hostFS.Stat(c.Path); err == nil && info.Mode().IsRegular() && pubd.IsArchive(c.Path) {
+		return c.buildArchive(ctx, hostFS)
+	}
+	return hostFS.Chroot(c.Path)
+}
+
+func (c FileSystemConfig) buildGit(ctx context.Context, L *zap.Logger, fs billy.Filesystem) (billy.Filesystem, error) {
+	rev, subdir := c.Git, ""
+	if idx := strings.Index(rev, ":"); idx > -1 {
+		rev, subdir = rev[:idx], rev[idx+1:]
+	}
+	repo, err := pubd.OpenGitRepository(fs, c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("--git: %s: %w", c.Path, err)
+	}
+	gitFS, err := pubd.NewGitFileSystem(repo, rev)
+	if err != nil {
+		return nil, fmt.Errorf("--git: %w", err)
+	}
+	go gitFS.Watch(ctx, L.Named("git"), c.GitRefresh.Duration)
+	if subdir == "" {
+		return gitFS, nil
+	}
+	return gitFS.Chroot(subdir)
+}
+
+// Serves the contents of an archive as the root, if Path points to one.
+func (c FileSystemConfig) buildArchive(ctx context.Context, fs billy.Filesystem) (billy.Filesystem, error) {
+	afs, err := pubd.OpenArchive(fs, c.Path, c.ArchivesMaxSpool)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		afs.Close()
+	}()
+	return afs, nil
+}
+
+// Wraps fs in a cache, invalidated by inotify where possible. Stats are logged on shutdown.
+func (c FileSystemConfig) buildCache(ctx context.Context, L *zap.Logger, fs, hostFS billy.Filesystem) billy.Filesystem {
+	cfs := pubd.NewCachingFileSystem(fs, c.CacheTTL.Duration)
+
+	// Only plain directories on the host can be watched; not git repositories, archives, etc.
+	if info, err := hostFS.Stat(c.Path); err == nil && info.IsDir() && c.Git == "" &&
+		len(c.Mounts) == 0 && c.UserDirs.Dir == "" {
+		for _, root := range append([]string{c.Path}, c.Layers...) {
+			w, err := pubd.NewWatcher(ctx, L, nil, hostFS.Join(hostFS.Root(), root), nil, 0)
+			if err != nil {
+				L.Warn("Couldn't watch for changes; relying on --cache-ttl", zap.Error(err))
+				break
+			}
+			cfs.Watch(w)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		hits, misses := cfs.Stats()
+		L.Info("Cache statistics", zap.Uint64("hits", hits), zap.Uint64("misses", misses))
+	}()
+	return cfs
+}
+
+// Builds each [[mount]], and serves them under their virtual paths.
+func (c FileSystemConfig) buildMounts(ctx context.Context, L *zap.Logger, hostFS billy.Filesystem) (billy.Filesystem, error) {
+	mounts := make(map[string]billy.Filesystem, len(c.Mounts))
+	for _, m := range c.Mounts {
+		if m.At == "" {
+			return nil, fmt.Errorf("mount: 'at' is required")
+		}
+		at := path.Clean("/" + m.At)
+		if _, ok := mounts[at]; ok {
+			return nil, fmt.Errorf("mount %s: mounted more than once", at)
+		}
+		if m.Path == "" {
+			return nil, fmt.Errorf("mount %s: 'path' is required", at)
+		}
+		if !filepath.IsAbs(m.Path) {
+			m.Path = filepath.Join(c.Path, m.Path)
+		}
+		fs, err := m.Build(ctx, L.With(zap.String("mount", at)), hostFS)
+		if err != nil {
+			return nil, fmt.Errorf("mount %s: %w", at, err)
+		}
+		mounts[at] = fs
+	}
+	return pubd.FileSystemMounts(mounts), nil
 }
@@ -0,0 +1,226 @@
+package cliutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+)
+
+const mountsTOML = `
+path = "/srv"
+exclude = ["*.bak"]
+
+[[mount]]
+at = "/docs"
+path = "docs"
+exclude = ["drafts/"]
+
+[[mount]]
+at = "/releases"
+path = "/var/releases"
+`
+
+func TestFileSystemMounts(t *testing.T) {
+	var cfg FileSystemConfig
+	_, err := toml.Decode(mountsTOML, &cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []MountConfig{
+		{At: "/docs", FileSystemConfig: FileSystemConfig{Path: "docs", Exclude: []string{"drafts/"}}},
+		{At: "/releases", FileSystemConfig: FileSystemConfig{Path: "/var/releases"}},
+	}, cfg.Mounts)
+
+	hostFS := memfs.New()
+	for name, content := range map[string]string{
+		"/srv/docs/index.html":        "docs",
+		"/srv/docs/index.html.bak":    "backup",
+		"/srv/docs/drafts/draft.html": "draft",
+		"/srv/secret.txt":             "secret",
+		"/var/releases/v1.0.tar.gz":   "v1.0",
+	} {
+		require.NoError(t, util.WriteFile(hostFS, name, []byte(content), 0644))
+	}
+	fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+	require.NoError(t, err)
+
+	names := func(dirname string) []string {
+		infos, err := fs.ReadDir(dirname)
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"docs", "releases"}, names("/"))
+	assert.Equal(t, []string{"index.html"}, names("/docs"))
+	assert.Equal(t, []string{"v1.0.tar.gz"}, names("/releases"))
+
+	f, err := fs.Open("/docs/index.html")
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "docs", string(data))
+
+	_, err = fs.Open("/secret.txt")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+}
+
+func TestFileSystemMountsDirConfig(t *testing.T) {
+	var cfg FileSystemConfig
+	_, err := toml.Decode(`
+path = "/srv"
+exclude = ["*.bak"]
+
+[[mount]]
+at = "/docs"
+path = "docs"
+dir-config = true
+`, &cfg)
+	require.NoError(t, err)
+
+	hostFS := memfs.New()
+	for name, content := range map[string]string{
+		"/srv/docs/.pubd.toml":         "readme = [\"intro.md\"]\n[headers]\nCache-Control = \"no-cache\"\n",
+		"/srv/docs/sub/.pubd.toml":     "[headers]\nX-Sub = \"yes\"\n",
+		"/srv/docs/sub/index.html":     "index",
+		"/srv/docs/sub/index.html.bak": "backup",
+		"/srv/other/index.html":        "other",
+	} {
+		require.NoError(t, util.WriteFile(hostFS, name, []byte(content), 0644))
+	}
+	fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+	require.NoError(t, err)
+
+	dcfg, err := pubd.DirConfigOf(fs, "/docs/sub")
+	require.NoError(t, err)
+	assert.Equal(t, pubd.DirConfig{
+		READMEs: []string{"intro.md"},
+		Headers: map[string]string{"Cache-Control": "no-cache", "X-Sub": "yes"},
+	}, dcfg)
+
+	// Chrooting into the mount keeps them.
+	sub, err := fs.Chroot("/docs")
+	require.NoError(t, err)
+	dcfg, err = pubd.DirConfigOf(sub, "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"intro.md"}, dcfg.READMEs)
+
+	// Outside of the mount, there are none.
+	dcfg, err = pubd.DirConfigOf(fs, "/")
+	require.NoError(t, err)
+	assert.Equal(t, pubd.DirConfig{}, dcfg)
+}
+
+func TestFileSystemMountsErrors(t *testing.T) {
+	testdata := map[string]string{
+		`[[mount]]
+		path = "docs"`: "mount: 'at' is required",
+		`[[mount]]
+		at = "/docs"`: "mount /docs: 'path' is required",
+		`[[mount]]
+		at = "/docs"
+		path = "/docs"
+		[[mount]]
+		at = "docs/"
+		path = "/docs"`: "mount /docs: mounted more than once",
+	}
+	for in, msg := range testdata {
+		t.Run(msg, func(t *testing.T) {
+			cfg := FileSystemConfig{Path: "/"}
+			_, err := toml.Decode(in, &cfg)
+			require.NoError(t, err)
+			hostFS := memfs.New()
+			require.NoError(t, hostFS.MkdirAll("/docs", 0755))
+			_, err = cfg.Build(context.Background(), zap.NewNop(), hostFS)
+			assert.EqualError(t, err, msg)
+		})
+	}
+}
+
+func TestFileSystemSymlinkFilters(t *testing.T) {
+	hostFS := memfs.New()
+	require.NoError(t, hostFS.MkdirAll("/srv/priv", 0755))
+	require.NoError(t, hostFS.MkdirAll("/srv/pub", 0755))
+	for name, mode := range map[string]os.FileMode{
+		"/srv/readme.txt":    0644,
+		"/srv/secret.key":    0644,
+		"/srv/priv/note.txt": 0600,
+	} {
+		require.NoError(t, util.WriteFile(hostFS, name, []byte(name), mode))
+	}
+	require.NoError(t, hostFS.Symlink("../readme.txt", "/srv/pub/readme"))
+	require.NoError(t, hostFS.Symlink("../secret.key", "/srv/pub/key"))
+	require.NoError(t, hostFS.Symlink("../priv/note.txt", "/srv/pub/note"))
+
+	// Links are filtered by the paths they lead to, whether or not they're kept inside the root.
+	for _, policy := range []string{"follow", "within-root"} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := FileSystemDefaults()
+			cfg.Path = "/srv"
+			cfg.Symlinks = policy
+			cfg.Exclude = []string{"*.key"}
+			cfg.PublicOnly = true
+			fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+			require.NoError(t, err)
+
+			_, err = fs.Stat("/pub/readme")
+			assert.NoError(t, err)
+			for _, name := range []string{"/pub/key", "/pub/note"} {
+				t.Run(name, func(t *testing.T) {
+					_, err := fs.Open(name)
+					assert.True(t, os.IsNotExist(err), "%v", err)
+				})
+			}
+		})
+	}
+}
+
+func TestFileSystemConfigFiles(t *testing.T) {
+	hostFS := memfs.New()
+	for name, content := range map[string]string{
+		"/srv/.pubd.toml":     "readme = [\"index.html\"]\nexclude = [\"*.bak\"]\n",
+		"/srv/.pubdignore":    "secret.txt\n",
+		"/srv/index.html":     "index",
+		"/srv/index.html.bak": "backup",
+		"/srv/secret.txt":     "secret",
+	} {
+		require.NoError(t, util.WriteFile(hostFS, name, []byte(content), 0644))
+	}
+	require.NoError(t, hostFS.Symlink("index.html", "/srv/copy.bak"))
+
+	// The files themselves are hidden, but still read, whichever way symlinks are handled.
+	for _, policy := range []string{"follow", "deny", "within-root"} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := FileSystemDefaults()
+			cfg.Path = "/srv"
+			cfg.Symlinks = policy
+			cfg.DirConfig = true
+			cfg.IgnoreFiles = []string{".pubdignore"}
+			fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+			require.NoError(t, err)
+
+			infos, err := fs.ReadDir("/")
+			require.NoError(t, err)
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			assert.Equal(t, []string{"index.html"}, names)
+
+			dcfg, err := pubd.DirConfigOf(fs, "/")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"index.html"}, dcfg.READMEs)
+		})
+	}
+}
@@ -1,15 +1,53 @@
 package cliutil
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/spf13/pflag"
+
+	"github.com/liclac/pubd"
 )
 
+// Prefix for environment variables overriding flags; see EnvName().
+const EnvPrefix = "PUBD_"
+
+// Returned by Configure() if --print-config was given, after printing the configuration.
+var ErrConfigPrinted = errors.New("configuration printed")
+
+// Implemented by configs with sections that can't be described with struct tags, eg. ones
+// for protocols registered at runtime. Called with the contents of the -C/--config file, after
+// it's been unmarshalled into the config itself, and before flags are parsed. Returns the
+// keys that are still unknown after decoding what it can.
+type ConfigFileDecoder interface {
+	DecodeConfigFile(data []byte, undecoded []toml.Key) ([]toml.Key, error)
+}
+
+// The other half of ConfigFileDecoder, for --print-config.
+type ConfigFileEncoder interface {
+	EncodeConfigFile(w io.Writer) error
+}
+
+// Returns the environment variable for a flag, eg. PUBD_TLS_CERT_FILE for --tls.cert-file.
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flag))
+}
+
+// Populates out from, in order of increasing precedence: its existing values (defaults),
+// a -C/--config file (or $PUBD_CONFIG), PUBD_* environment variables, and flags.
+//
+// Unknown keys in the config file are an error. If --print-config is given, the resulting
+// configuration is printed as TOML, and ErrConfigPrinted is returned.
+//
+// If out embeds a FileSystemConfig with DirConfig enabled, the served directory's .pubd.toml
+// is checked too; it's read by the filesystem, and can only hold a pubd.DirConfig.
 func Configure(
 	out interface{}, posArg *string,
 	registerFlags func(*pflag.FlagSet), usage string,
@@ -22,13 +60,9 @@ func Configure(
 	// Solution: Start by parsing a substitute FlagSet with only that flag, and no error handling.
 	flagSet.ParseErrorsWhitelist.UnknownFlags = true
 	flagSet.Usage = func() {}
-	cfgFile := flagSet.StringP("config", "C", "", "load a config file")
+	cfgFile := flagSet.StringP("config", "C", os.Getenv(EnvName("config")), "load a config file")
 	if flagSet.Parse(args) == nil && *cfgFile != "" {
-		data, err := ioutil.ReadFile(*cfgFile)
-		if err != nil {
-			return fmt.Errorf("-C/--config: %w", err)
-		}
-		if err := toml.Unmarshal(data, out); err != nil {
+		if err := decodeConfigFile(*cfgFile, out); err != nil {
 			return fmt.Errorf("-C/--config: %w", err)
 		}
 	}
@@ -38,8 +72,13 @@ func Configure(
 	flagSet.Usage = func() {
 		fmt.Fprintln(os.Stderr, usage)
 		fmt.Fprintln(os.Stderr, flagSet.FlagUsagesWrapped(80))
+		fmt.Fprintln(os.Stderr, "Flags can also be set from the environment, eg. --tls.cert-file as "+EnvName("tls.cert-file")+".")
 	}
+	printConfig := flagSet.Bool("print-config", false, "print the effective configuration as TOML, and exit")
 	registerFlags(flagSet)
+	if err := applyEnv(flagSet); err != nil {
+		return err
+	}
 	if err := flagSet.Parse(args); err != nil {
 		return err
 	}
@@ -55,5 +94,183 @@ func Configure(
 		return fmt.Errorf("too many arguments")
 	}
 
+	// Check the served directory's .pubd.toml up front, so mistakes in it are reported with line
+	// numbers; while serving, it and those below it are re-read as they change.
+	if c, ok := out.(interface{ fileSystemConfig() *FileSystemConfig }); ok && c.fileSystemConfig().DirConfig {
+		if err := checkDirConfig(c.fileSystemConfig().Path); err != nil {
+			return err
+		}
+	}
+
+	if *printConfig {
+		if err := encodeConfig(os.Stdout, out); err != nil {
+			return err
+		}
+		return ErrConfigPrinted
+	}
 	return nil
 }
+
+func decodeConfigFile(filename string, out interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	md, err := toml.Decode(string(data), out)
+	if err != nil {
+		return err
+	}
+	undecoded := md.Undecoded()
+	if d, ok := out.(ConfigFileDecoder); ok {
+		if undecoded, err = d.DecodeConfigFile(data, undecoded); err != nil {
+			return err
+		}
+	}
+	return unknownKeysError(filename, data, undecoded)
+}
+
+// Checks a directory's DirConfigName file, if it has one.
+func checkDirConfig(dir string) error {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	filename := filepath.Join(dir, DirConfigName)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	md, err := toml.Decode(string(data), &pubd.DirConfig{})
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if err := unknownKeysError(filename, data, md.Undecoded()); err != nil {
+		return fmt.Errorf("%w; only readme, exclude and headers can be set here", err)
+	}
+	if _, err := pubd.ParseDirConfig(data); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// Returns an error listing unknown keys, and the lines they're on; nil if there are none.
+// Keys in unknown tables aren't listed separately.
+func unknownKeysError(filename string, data []byte, keys []toml.Key) error {
+	unknown := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		unknown[key.String()] = true
+	}
+	lines := keyLines(data)
+	type unknownKey struct {
+		key  string
+		line int
+	}
+	var found []unknownKey
+	for _, key := range keys {
+		isChild := false
+		for i := 1; i < len(key); i++ {
+			isChild = isChild || unknown[key[:i].String()]
+		}
+		if !isChild {
+			found = append(found, unknownKey{key.String(), keyLine(lines, key)})
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].line < found[j].line })
+	msgs := make([]string, len(found))
+	for i, k := range found {
+		msgs[i] = fmt.Sprintf("%s:%d: unknown key '%s'", filename, k.line, k.key)
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// Returns the line a key is defined on, or failing that, its closest parent; 0 if unknown.
+func keyLine(lines map[string]int, key toml.Key) int {
+	for i := len(key); i > 0; i-- {
+		if line, ok := lines[key[:i].String()]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// Roughly maps keys in a TOML document to the lines they're first defined on. Good enough for
+// error messages, as long as nobody puts "[" or "=" at the start of a multi-line string.
+func keyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	var table string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			name := strings.TrimLeft(line, "[")
+			if idx := strings.Index(name, "]"); idx > -1 {
+				name = name[:idx]
+			}
+			table = normalizeKey(name)
+			if _, ok := lines[table]; !ok {
+				lines[table] = i + 1
+			}
+		} else if idx := strings.Index(line, "="); idx > 0 && !strings.HasPrefix(line, "#") {
+			key := normalizeKey(line[:idx])
+			if table != "" {
+				key = table + "." + key
+			}
+			if _, ok := lines[key]; !ok {
+				lines[key] = i + 1
+			}
+		}
+	}
+	return lines
+}
+
+// Normalises a (possibly dotted and quoted) key, eg. ` a . "b" ` -> `a.b`.
+func normalizeKey(s string) string {
+	parts := strings.Split(s, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Sets flags from PUBD_* environment variables, without marking them as changed, so flags
+// given on the command line still replace list values rather than appending to them.
+func applyEnv(flagSet *pflag.FlagSet) error {
+	var err error
+	flagSet.VisitAll(func(f *pflag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if sv, isSlice := f.Value.(pflag.SliceValue); isSlice {
+			var values []string
+			if value != "" {
+				values = strings.Split(value, ",")
+			}
+			err = sv.Replace(values)
+		} else {
+			err = f.Value.Set(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", EnvName(f.Name), err)
+		}
+	})
+	return err
+}
+
+// Registers a hidden alias for a flag, which sets the same value, and tells users to switch.
+// Its environment variable works too, eg. PUBD_LAYER for --layer.
+func deprecatedAlias(f *pflag.FlagSet, alias, name string) {
+	flag := f.Lookup(name)
+	f.Var(flag.Value, alias, flag.Usage)
+	f.MarkDeprecated(alias, "use --"+name+" instead")
+}
+
+func encodeConfig(w io.Writer, out interface{}) error {
+	if e, ok := out.(ConfigFileEncoder); ok {
+		return e.EncodeConfigFile(w)
+	}
+	return toml.NewEncoder(w).Encode(out)
+}
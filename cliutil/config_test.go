@@ -0,0 +1,243 @@
+package cliutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Name  string          `toml:"name"`
+	Tags  []string        `toml:"tags"`
+	Inner testInnerConfig `toml:"inner"`
+}
+
+type testInnerConfig struct {
+	Level int `toml:"level"`
+}
+
+func (cfg *testConfig) parse(args ...string) error {
+	return Configure(cfg, nil, func(f *pflag.FlagSet) {
+		f.StringVar(&cfg.Name, "name", cfg.Name, "")
+		f.StringSliceVar(&cfg.Tags, "tag", cfg.Tags, "")
+		f.IntVar(&cfg.Inner.Level, "inner.level", cfg.Inner.Level, "")
+	}, "", append([]string{"test"}, args...))
+}
+
+func writeConfigFile(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "pubd-*.toml")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "PUBD_ADDR", EnvName("addr"))
+	assert.Equal(t, "PUBD_TLS_CERT_FILE", EnvName("tls.cert-file"))
+	assert.Equal(t, "PUBD_TLS_ACME_HTTP_ADDR", EnvName("tls.acme.http-addr"))
+}
+
+// Returns the dotted TOML keys of a config struct's fields, eg. "tls.acme.domain".
+func tomlKeys(typ reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			keys = append(keys, tomlKeys(field.Type, prefix)...)
+			continue
+		}
+		key := prefix + field.Tag.Get("toml")
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration{}) {
+			keys = append(keys, tomlKeys(field.Type, key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Flags are named after config keys, so users only have to learn one name for each setting.
+func TestFlagsMatchKeys(t *testing.T) {
+	type flagger interface{ Flags(*pflag.FlagSet) }
+	testdata := map[string]struct {
+		cfg    flagger
+		prefix string // The key commands put it under.
+	}{
+		"FileSystemConfig": {&FileSystemConfig{}, ""},
+		"TLSConfig":        {&TLSConfig{}, "tls."},
+		"ProxyConfig":      {&ProxyConfig{}, "proxy."},
+		"ShutdownConfig":   {&ShutdownConfig{}, ""},
+		"LogConfig":        {&LogConfig{}, ""},
+	}
+	for name, tt := range testdata {
+		cfg := tt.cfg
+		t.Run(name, func(t *testing.T) {
+			keys := map[string]bool{}
+			for _, key := range tomlKeys(reflect.TypeOf(cfg).Elem(), tt.prefix) {
+				keys[key] = true
+			}
+			f := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			cfg.Flags(f)
+			f.VisitAll(func(flag *pflag.Flag) {
+				if flag.Deprecated == "" {
+					assert.True(t, keys[flag.Name], "--%s has no matching config key", flag.Name)
+				}
+			})
+		})
+	}
+}
+
+func TestConfigurePrecedence(t *testing.T) {
+	filename := writeConfigFile(t, "name = \"file\"\ntags = [\"file\"]\n\n[inner]\nlevel = 1\n")
+	defer os.Remove(filename)
+
+	testdata := map[string]struct {
+		Env  map[string]string
+		Args []string
+		Out  testConfig
+	}{
+		"Defaults": {
+			Out: testConfig{Name: "default"},
+		},
+		"File": {
+			Args: []string{"-C", filename},
+			Out:  testConfig{Name: "file", Tags: []string{"file"}, Inner: testInnerConfig{1}},
+		},
+		"File From Env": {
+			Env: map[string]string{"PUBD_CONFIG": filename},
+			Out: testConfig{Name: "file", Tags: []string{"file"}, Inner: testInnerConfig{1}},
+		},
+		"Env": {
+			Env:  map[string]string{"PUBD_NAME": "env", "PUBD_TAG": "a,b", "PUBD_INNER_LEVEL": "2"},
+			Args: []string{"-C", filename},
+			Out:  testConfig{Name: "env", Tags: []string{"a", "b"}, Inner: testInnerConfig{2}},
+		},
+		"Env, Empty List": {
+			Env:  map[string]string{"PUBD_TAG": ""},
+			Args: []string{"-C", filename},
+			Out:  testConfig{Name: "file", Tags: nil, Inner: testInnerConfig{1}},
+		},
+		"Flags": {
+			Env:  map[string]string{"PUBD_NAME": "env", "PUBD_TAG": "a,b"},
+			Args: []string{"-C", filename, "--name=flag", "--tag=c", "--tag=d"},
+			Out:  testConfig{Name: "flag", Tags: []string{"c", "d"}, Inner: testInnerConfig{1}},
+		},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tdata.Env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			cfg := testConfig{Name: "default"}
+			require.NoError(t, cfg.parse(tdata.Args...))
+			assert.Equal(t, tdata.Out.Name, cfg.Name)
+			assert.Equal(t, tdata.Out.Tags, cfg.Tags)
+			assert.Equal(t, tdata.Out.Inner.Level, cfg.Inner.Level)
+		})
+	}
+
+	t.Run("Invalid Env", func(t *testing.T) {
+		os.Setenv("PUBD_INNER_LEVEL", "high")
+		defer os.Unsetenv("PUBD_INNER_LEVEL")
+		var cfg testConfig
+		err := cfg.parse()
+		require.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "PUBD_INNER_LEVEL: "), err.Error())
+	})
+}
+
+func TestConfigureUnknownKeys(t *testing.T) {
+	filename := writeConfigFile(t, strings.Join([]string{
+		`name = "x"`,
+		`nmae = "typo"`,
+		``,
+		`[inner]`,
+		`  level = 1`,
+		`  "levle" = 2`,
+		``,
+		`[outer]`,
+		`level = 3`,
+		`more = 4`,
+	}, "\n"))
+	defer os.Remove(filename)
+
+	var cfg testConfig
+	err := cfg.parse("-C", filename)
+	assert.EqualError(t, err, "-C/--config: "+
+		filename+":2: unknown key 'nmae'; "+
+		filename+":6: unknown key 'inner.levle'; "+
+		filename+":8: unknown key 'outer'")
+}
+
+func TestConfigureDirConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, DirConfigName)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("readme = [\"README\"]\naddr = \"0.0.0.0:80\"\n"), 0644))
+
+	parse := func(args ...string) error {
+		cfg := struct{ FileSystemConfig }{FileSystemDefaults()}
+		return Configure(&cfg, &cfg.Path, cfg.FileSystemConfig.Flags, "", append([]string{"test"}, args...))
+	}
+	assert.NoError(t, parse(dir))
+	assert.EqualError(t, parse("--dir-config", dir),
+		filename+":2: unknown key 'addr'; only readme, exclude and headers can be set here")
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("[headers]\nSet-Cookie = \"a=b\"\n"), 0644))
+	assert.EqualError(t, parse("--dir-config", dir), filename+": headers: Set-Cookie can't be set here; "+
+		"only Cache-Control, Content-Language, Expires, Link and X-* can")
+
+	require.NoError(t, os.Remove(filename))
+	assert.NoError(t, parse("--dir-config", dir))
+}
+
+func TestConfigurePrintConfig(t *testing.T) {
+	stdout, err := ioutil.TempFile("", "pubd-")
+	require.NoError(t, err)
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	defer func(f *os.File) { os.Stdout = f }(os.Stdout)
+	os.Stdout = stdout
+
+	cfg := testConfig{Name: "default"}
+	assert.Equal(t, ErrConfigPrinted, cfg.parse("--print-config", "--tag=a", "--inner.level=2"))
+
+	data, err := ioutil.ReadFile(stdout.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "name = \"default\"\ntags = [\"a\"]\n\n[inner]\n  level = 2\n", string(data))
+
+	// It should round-trip.
+	filename := writeConfigFile(t, string(data))
+	defer os.Remove(filename)
+	var cfg2 testConfig
+	require.NoError(t, cfg2.parse("-C", filename))
+	assert.Equal(t, cfg, cfg2)
+}
+
+func TestKeyLines(t *testing.T) {
+	lines := keyLines([]byte(strings.Join([]string{
+		`# comment = no`,
+		`a = 1`,
+		`b.c = 2`,
+		`[t]`,
+		`x = "="`,
+		`[[arr]] # comment`,
+		`y = 3`,
+		`[ "q" . r ]`,
+		`'z' = 4`,
+	}, "\n")))
+	assert.Equal(t, map[string]int{
+		"a": 2, "b.c": 3, "t": 4, "t.x": 5, "arr": 6, "arr.y": 7, "q.r": 8, "q.r.z": 9,
+	}, lines)
+}
@@ -0,0 +1,35 @@
+package cliutil
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var _ pflag.Value = (*Duration)(nil)
+
+// A time.Duration which can be used in both flags and config files, as eg. "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// pflag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// pflag.Value
+func (d *Duration) Type() string { return "duration" }
@@ -0,0 +1,34 @@
+package cliutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuration(t *testing.T) {
+	t.Run("Flag", func(t *testing.T) {
+		var d Duration
+		f := pflag.NewFlagSet("", 0)
+		f.Var(&d, "d", "")
+		require.NoError(t, f.Parse([]string{"--d=1m30s"}))
+		assert.Equal(t, 90*time.Second, d.Duration)
+	})
+
+	t.Run("TOML", func(t *testing.T) {
+		var out struct {
+			D Duration `toml:"d"`
+		}
+		require.NoError(t, toml.Unmarshal([]byte(`d = "5s"`), &out))
+		assert.Equal(t, 5*time.Second, out.D.Duration)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		var d Duration
+		assert.Error(t, d.Set("5 parsecs"))
+	})
+}
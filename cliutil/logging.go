@@ -1,6 +1,7 @@
 package cliutil
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/spf13/pflag"
@@ -14,13 +15,15 @@ import (
 // it will enable debug logging while also disabling info logging.
 // This is done by implementing zapcore.LevelEnabler on LogConfig itself.
 type LogConfig struct {
-	Quiet   int `toml:"quiet"`   // Disable info/warn/error logging.
-	Verbose int `toml:"verbose"` // Enable debug logging.
+	Quiet   int    `toml:"quiet"`    // Disable info/warn/error logging.
+	Verbose int    `toml:"verbose"`  // Enable debug logging.
+	File    string `toml:"log-file"` // Log to a file instead of stderr, eg. in inetd mode.
 }
 
 func (cfg *LogConfig) Flags(f *pflag.FlagSet) {
 	f.CountVarP(&cfg.Quiet, "quiet", "q", "disable info/warn/error logging")
 	f.CountVarP(&cfg.Verbose, "verbose", "v", "enable debug logging")
+	f.StringVar(&cfg.File, "log-file", cfg.File, "log to a file instead of stderr (required for inetd/)")
 }
 
 // zapcore.LevelEnabler
@@ -32,7 +35,7 @@ func (cfg LogConfig) Enabled(lvl zapcore.Level) bool {
 	return int(lvl) >= cfg.Quiet // Info(0) >= Quiet=1
 }
 
-func (cfg LogConfig) Logger() *zap.Logger {
+func (cfg LogConfig) Logger() (*zap.Logger, error) {
 	encCfg := zapcore.EncoderConfig{
 		MessageKey:     "msg",
 		LevelKey:       "lvl",
@@ -46,6 +49,14 @@ func (cfg LogConfig) Logger() *zap.Logger {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 		EncodeName:     zapcore.FullNameEncoder,
 	}
+	out := zapcore.Lock(os.Stderr)
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("--log-file: %w", err)
+		}
+		out, encCfg.EncodeLevel = zapcore.Lock(f), zapcore.CapitalLevelEncoder
+	}
 	enc := zapcore.NewConsoleEncoder(encCfg)
-	return zap.New(zapcore.NewCore(enc, os.Stderr, cfg))
+	return zap.New(zapcore.NewCore(enc, out, cfg)), nil
 }
@@ -0,0 +1,36 @@
+package cliutil
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	"github.com/liclac/pubd"
+)
+
+// Standard flags for accepting PROXY protocol headers, with a proxy/ listen address.
+type ProxyConfig struct {
+	Trusted []string `toml:"trusted"` // CIDRs or IPs of proxies allowed to send PROXY headers, or "unix".
+}
+
+func (c *ProxyConfig) Flags(f *pflag.FlagSet) {
+	f.StringSliceVar(&c.Trusted, "proxy.trusted", c.Trusted, "accept PROXY headers from these CIDRs or IPs, or 'unix' for unix sockets, for proxy/ addresses")
+}
+
+// Adds the trusted proxies to listener options.
+func (c ProxyConfig) Apply(lc *pubd.ListenConfig) error {
+	var cidrs []string
+	for _, s := range c.Trusted {
+		if s == "unix" {
+			lc.ProxyTrustUnix = true
+		} else {
+			cidrs = append(cidrs, s)
+		}
+	}
+	trusted, err := pubd.ParseCIDRs(cidrs)
+	if err != nil {
+		return fmt.Errorf("--proxy.trusted: %w", err)
+	}
+	lc.ProxyTrusted = trusted
+	return nil
+}
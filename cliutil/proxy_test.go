@@ -0,0 +1,25 @@
+package cliutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/pubd"
+)
+
+func TestProxyConfig(t *testing.T) {
+	var lc pubd.ListenConfig
+	require.NoError(t, ProxyConfig{Trusted: []string{"10.0.0.0/8"}}.Apply(&lc))
+	assert.Len(t, lc.ProxyTrusted, 1)
+	assert.False(t, lc.ProxyTrustUnix)
+
+	lc = pubd.ListenConfig{}
+	require.NoError(t, ProxyConfig{Trusted: []string{"unix"}}.Apply(&lc))
+	assert.Empty(t, lc.ProxyTrusted)
+	assert.True(t, lc.ProxyTrustUnix)
+
+	err := ProxyConfig{Trusted: []string{"unix-ish"}}.Apply(&lc)
+	assert.EqualError(t, err, "--proxy.trusted: invalid IP: 'unix-ish'")
+}
@@ -0,0 +1,50 @@
+package cliutil
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/pubd/proto/httppub"
+	"github.com/liclac/pubd/proto/sftppub"
+	"github.com/liclac/pubd/proto/sshpub"
+)
+
+// Returns a handler serving fs from a subdirectory, with directory listings and an access log.
+func HTTPHandler(L *zap.Logger, fs billy.Filesystem, prefix string, index httppub.IndexConfig) http.Handler {
+	return httppub.WithPrefix(prefix,
+		httppub.WithAccessLog(L.Named("access"),
+			httppub.Handler(L.Named("req"), fs, httppub.SimpleIndex(index)),
+		))
+}
+
+// Loads an SSH host key from hostFS. flag is the setting's name, for errors.
+func LoadHostKey(hostFS billy.Filesystem, filename, flag string) (ssh.Signer, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("%s is required, and can be generated with: `ssh-keygen -t ed25519`", flag)
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't absolutise path to '%s': %w", flag, filename, err)
+	}
+	return sshpub.LoadPrivateKey(hostFS, path)
+}
+
+// Returns an SSH server for fs, offering SFTP if enabled.
+func SSHServer(L *zap.Logger, fs billy.Filesystem, hostKey ssh.Signer, sftp bool) sshpub.Server {
+	var subSFTP sshpub.Subsystem
+	if sftp {
+		subSFTP = sftppub.New(fs)
+	}
+
+	// Subsystems should be explicitly set to nil when disabled; an unset subsystem logs a warning.
+	srv := sshpub.New(L, hostKey)
+	srv.Subsystems = map[string]sshpub.Subsystem{
+		"sftp": subSFTP,
+	}
+	return srv
+}
@@ -0,0 +1,30 @@
+package cliutil
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+)
+
+// Standard flags for shutting down gracefully.
+type ShutdownConfig struct {
+	// Wait this long for connections to finish when shutting down, before closing them.
+	DrainTimeout Duration `toml:"drain-timeout"`
+}
+
+// Defaults for ShutdownConfig.
+func ShutdownDefaults() ShutdownConfig {
+	return ShutdownConfig{DrainTimeout: Duration{30 * time.Second}}
+}
+
+func (c *ShutdownConfig) Flags(f *pflag.FlagSet) {
+	f.Var(&c.DrainTimeout, "drain-timeout", "wait this long for connections to finish when shutting down, 0 = forever (signal again to quit now)")
+}
+
+// Returns options for pubd.Serve(), logging shutdown progress to L.
+func (c ShutdownConfig) ServeConfig(L *zap.Logger) pubd.ServeConfig {
+	return pubd.ServeConfig{DrainTimeout: c.DrainTimeout.Duration, L: L}
+}
@@ -0,0 +1,99 @@
+package cliutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/liclac/pubd"
+)
+
+// Standard flags for serving over TLS, with a tls/ listen address.
+type TLSConfig struct {
+	CertFile string `toml:"cert-file"` // PEM-encoded certificate, followed by any intermediates.
+	KeyFile  string `toml:"key-file"`  // PEM-encoded private key.
+
+	// Client certificate verification (mTLS).
+	ClientCAFile string   `toml:"client-ca-file"` // PEM-encoded CA bundle; enables client certificates.
+	ClientAuth   string   `toml:"client-auth"`    // "require" (default) or "optional".
+	ClientAllow  []string `toml:"client-allow"`   // Allowed subject CN/SAN patterns; default: any.
+
+	ACME ACMEConfig `toml:"acme"` // Obtain certificates automatically, instead of using CertFile/KeyFile.
+}
+
+func (c *TLSConfig) Flags(f *pflag.FlagSet) {
+	f.StringVar(&c.CertFile, "tls.cert-file", c.CertFile, "TLS certificate file, for tls/ addresses (reloaded on change or SIGHUP)")
+	f.StringVar(&c.KeyFile, "tls.key-file", c.KeyFile, "TLS private key file, for tls/ addresses")
+	f.StringVar(&c.ClientCAFile, "tls.client-ca-file", c.ClientCAFile, "require client certificates signed by a CA in this file")
+	f.StringVar(&c.ClientAuth, "tls.client-auth", c.ClientAuth, "client certificate verification: require, optional")
+	f.StringSliceVar(&c.ClientAllow, "tls.client-allow", c.ClientAllow, "only allow client certificates whose subject CN or SANs match a pattern")
+	c.ACME.Flags(f)
+}
+
+// Returns listener options with the configured certificate, which is reloaded when it changes,
+// until ctx expires; or, if acm is non-nil (see ACMEConfig.Manager()), with certificates from
+// ACME. Returns the zero value if no certificate is configured.
+//
+// The certificate's loader is also returned, if there is one, to Check() on reload.
+func (c TLSConfig) ListenConfig(ctx context.Context, L *zap.Logger, acm *autocert.Manager) (pubd.ListenConfig, *pubd.CertificateLoader, error) {
+	var cfg *tls.Config
+	var loader *pubd.CertificateLoader
+	switch {
+	case acm != nil:
+		if c.CertFile != "" || c.KeyFile != "" {
+			return pubd.ListenConfig{}, nil, errors.New("--tls.acme.domains can't be used with --tls.cert-file or --tls.key-file")
+		}
+		cfg = acm.TLSConfig()
+	case c.CertFile == "" && c.KeyFile == "":
+		if c.ClientCAFile != "" {
+			return pubd.ListenConfig{}, nil, errors.New("--tls.client-ca-file requires --tls.cert-file and --tls.key-file")
+		}
+		return pubd.ListenConfig{}, nil, nil
+	case c.CertFile == "" || c.KeyFile == "":
+		return pubd.ListenConfig{}, nil, errors.New("--tls.cert-file and --tls.key-file must be used together")
+	default:
+		var err error
+		if loader, err = pubd.NewCertificateLoader(c.CertFile, c.KeyFile); err != nil {
+			return pubd.ListenConfig{}, nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg = loader.Config()
+	}
+	if err := c.applyClientAuth(cfg); err != nil {
+		return pubd.ListenConfig{}, nil, err
+	}
+	if loader != nil {
+		go loader.Watch(ctx, L.Named("tls"))
+	}
+	return pubd.ListenConfig{TLS: cfg}, loader, nil
+}
+
+func (c TLSConfig) applyClientAuth(cfg *tls.Config) error {
+	if c.ClientCAFile == "" {
+		if c.ClientAuth != "" || len(c.ClientAllow) > 0 {
+			return errors.New("--tls.client-auth and --tls.client-allow require --tls.client-ca-file")
+		}
+		return nil
+	}
+	var ca pubd.ClientAuth
+	switch c.ClientAuth {
+	case "", "require":
+	case "optional":
+		ca.Optional = true
+	default:
+		return fmt.Errorf("--tls.client-auth: unknown mode '%s', expected 'require' or 'optional'", c.ClientAuth)
+	}
+	pool, err := pubd.LoadCertPool(c.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	ca.CAs, ca.Allow = pool, c.ClientAllow
+	if err := ca.Apply(cfg); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package cliutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+)
+
+// Replaceable for testing.
+var lookupUser = user.Lookup
+
+// Serves users' directories as "/~user/", like Apache's mod_userdir, instead of Path.
+type UserDirsConfig struct {
+	Dir        string `toml:"dir"`         // Directory in each home to serve, eg. "public_html".
+	MinUID     int    `toml:"min-uid"`     // Refuse users with lower UIDs, eg. system accounts.
+	ConfigFile string `toml:"config-file"` // Per-user config file in Dir, eg. ".pubd.toml".
+}
+
+// Defaults for UserDirsConfig.
+func UserDirsDefaults() UserDirsConfig {
+	return UserDirsConfig{MinUID: 1000}
+}
+
+func (c *UserDirsConfig) Flags(f *pflag.FlagSet) {
+	f.StringVar(&c.Dir, "userdir.dir", c.Dir, "serve this directory in each user's home as /~user/, eg. public_html")
+	f.IntVar(&c.MinUID, "userdir.min-uid", c.MinUID, "refuse users with UIDs below this, eg. system accounts")
+	f.StringVar(&c.ConfigFile, "userdir.config-file", c.ConfigFile, "let users override settings in this file in their directory, eg. .pubd.toml")
+
+	deprecatedAlias(f, "userdir", "userdir.dir")
+	deprecatedAlias(f, "userdir-min-uid", "userdir.min-uid")
+	deprecatedAlias(f, "userdir-config", "userdir.config-file")
+}
+
+// Settings users may override for their own directories, in UserDirsConfig.ConfigFile.
+// Anything that could expose files outside of their directories is deliberately left out.
+type userDirOverrides struct {
+	Include     []string `toml:"include"`
+	Exclude     []string `toml:"exclude"`
+	IgnoreFiles []string `toml:"ignore-files"`
+	Symlinks    string   `toml:"symlinks"`
+	Archives    bool     `toml:"archives"`
+	PublicOnly  bool     `toml:"public-only"`
+}
+
+// Returns a function opening users' directories. Users that don't exist, are below MinUID,
+// or whose directories are missing, unreadable or misconfigured all look like they don't exist.
+func (c UserDirsConfig) open(ctx context.Context, L *zap.Logger, hostFS billy.Filesystem) pubd.UserDirFunc {
+	return func(username string) (billy.Filesystem, error) {
+		L := L.With(zap.String("user", username))
+		u, err := lookupUser(username)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		if uid, err := strconv.Atoi(u.Uid); err != nil || uid < c.MinUID {
+			L.Debug("Refusing system user", zap.String("uid", u.Uid))
+			return nil, os.ErrNotExist
+		}
+		dir := filepath.Join(u.HomeDir, c.Dir)
+		if info, err := lstatNoSymlinks(hostFS, u.HomeDir, c.Dir); err != nil || !info.IsDir() {
+			if err != nil && !os.IsNotExist(err) {
+				L.Warn("Refusing user directory", zap.Error(err))
+			}
+			return nil, os.ErrNotExist
+		}
+		if _, err := hostFS.ReadDir(dir); err != nil {
+			L.Warn("User directory isn't readable", zap.String("path", dir), zap.Error(err))
+			return nil, os.ErrNotExist
+		}
+
+		// Users' symlinks may not lead outside their directories; anything readable by the
+		// daemon, including other users' private files, could otherwise be exposed. The same
+		// goes for the directory itself, which is why it mustn't be a symlink, see above.
+		cfg := FileSystemConfig{Path: dir, Symlinks: string(pubd.SymlinksWithinRoot)}
+		if c.ConfigFile != "" {
+			if err := c.readOverrides(hostFS, &cfg); err != nil {
+				L.Warn("Invalid user config file", zap.Error(err))
+				return nil, os.ErrNotExist
+			}
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		fs, err := cfg.Build(ctx, L, hostFS)
+		if err != nil {
+			cancel()
+			L.Warn("Couldn't open user directory", zap.Error(err))
+			return nil, os.ErrNotExist
+		}
+		return userDirFS{fs, cancel}, nil
+	}
+}
+
+// A user's filesystem; closing it stops anything started by Build(), eg. closes archives.
+type userDirFS struct {
+	billy.Filesystem
+	cancel context.CancelFunc
+}
+
+func (fs userDirFS) Close() error {
+	fs.cancel()
+	return nil
+}
+
+func (fs userDirFS) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
+
+// Lstat()s each component of rel below base, and returns the last one's info. A symlink in any
+// of them is an error, so users can't point their directories or config files at anything else
+// the daemon can read. base itself may be a symlink.
+func lstatNoSymlinks(hostFS billy.Filesystem, base, rel string) (os.FileInfo, error) {
+	info, err := hostFS.Stat(base)
+	for _, seg := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if err != nil {
+			return nil, err
+		}
+		if seg == "." {
+			continue
+		}
+		base = filepath.Join(base, seg)
+		if info, err = hostFS.Lstat(base); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s: is a symlink", base)
+		}
+	}
+	return info, err
+}
+
+// Applies the user's config file (if any) to cfg. The file itself is never served.
+func (c UserDirsConfig) readOverrides(hostFS billy.Filesystem, cfg *FileSystemConfig) error {
+	cfg.Exclude = []string{"/" + c.ConfigFile}
+
+	filename := filepath.Join(cfg.Path, c.ConfigFile)
+	info, err := lstatNoSymlinks(hostFS, cfg.Path, c.ConfigFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", filename)
+	}
+	f, err := hostFS.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var o userDirOverrides
+	md, err := toml.Decode(string(data), &o)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("%s: not allowed: %s", filename, strings.Join(keys, ", "))
+	}
+	cfg.Include = o.Include
+	cfg.Exclude = append(cfg.Exclude, o.Exclude...)
+	cfg.IgnoreFiles = o.IgnoreFiles
+	if o.Symlinks != "" {
+		policy, err := pubd.ParseSymlinkPolicy(o.Symlinks)
+		if err != nil {
+			return fmt.Errorf("%s: symlinks: %w", filename, err)
+		} else if policy == pubd.SymlinksFollow {
+			return fmt.Errorf("%s: symlinks: not allowed: %s", filename, policy)
+		}
+		cfg.Symlinks = string(policy)
+	}
+	cfg.Archives = o.Archives
+	cfg.PublicOnly = o.PublicOnly
+	return nil
+}
@@ -0,0 +1,109 @@
+package cliutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUserDirs(t *testing.T) {
+	users := map[string]*user.User{
+		"root":  {Username: "root", Uid: "0", HomeDir: "/root"},
+		"alice": {Username: "alice", Uid: "1000", HomeDir: "/home/alice"},
+		"bob":   {Username: "bob", Uid: "1001", HomeDir: "/home/bob"},
+		"carol": {Username: "carol", Uid: "1002", HomeDir: "/home/carol"},
+		"dave":  {Username: "dave", Uid: "1003", HomeDir: "/home/dave"},
+	}
+	defer func(fn func(string) (*user.User, error)) { lookupUser = fn }(lookupUser)
+	lookupUser = func(username string) (*user.User, error) {
+		if u, ok := users[username]; ok {
+			return u, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+
+	// bob has no public_html; carol and dave have invalid config files.
+	hostFS := memfs.New()
+	for name, content := range map[string]string{
+		"/root/public_html/index.html":   "root",
+		"/home/alice/public_html/a.html": "alice",
+		"/home/alice/public_html/a.bak":  "backup",
+		"/home/alice/public_html/.pubd.toml": `exclude = ["*.bak"]
+symlinks = "deny"`,
+		"/home/alice/secret.txt":             "secret",
+		"/home/carol/public_html/.pubd.toml": `layers = ["/etc"]`,
+		"/home/dave/public_html/.pubd.toml":  `symlinks = "follow"`,
+		"/home/dave/public_html/index.html":  "dave",
+		"/home/carol/public_html/index.html": "carol",
+	} {
+		require.NoError(t, util.WriteFile(hostFS, name, []byte(content), 0644))
+	}
+
+	cfg := FileSystemDefaults()
+	cfg.UserDirs.Dir = "public_html"
+	cfg.UserDirs.ConfigFile = ".pubd.toml"
+	fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+	require.NoError(t, err)
+
+	infos, err := fs.ReadDir("/~alice")
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.Equal(t, []string{"a.html"}, names)
+
+	for _, name := range []string{
+		"/~alice/.pubd.toml", "/~alice/../secret.txt", "/~root/index.html",
+		"/~bob", "/~carol/index.html", "/~dave/index.html", "/~nobody",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := fs.Stat(name)
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+	}
+}
+
+func TestUserDirsSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	defer func(fn func(string) (*user.User, error)) { lookupUser = fn }(lookupUser)
+	lookupUser = func(username string) (*user.User, error) {
+		return &user.User{Username: username, Uid: "1000", HomeDir: "/home/" + username}, nil
+	}
+
+	// erin's public_html is a symlink to alice's home; frank's config file is one to hers.
+	hostFS := osfs.New(root)
+	require.NoError(t, util.WriteFile(hostFS, "/home/alice/secret.txt", []byte(`include = ["*"]`), 0644))
+	require.NoError(t, util.WriteFile(hostFS, "/home/alice/public_html/index.html", []byte("alice"), 0644))
+	require.NoError(t, hostFS.MkdirAll("/home/erin", 0755))
+	require.NoError(t, hostFS.Symlink(filepath.Join(root, "home/alice"), "/home/erin/public_html"))
+	require.NoError(t, util.WriteFile(hostFS, "/home/frank/public_html/index.html", []byte("frank"), 0644))
+	require.NoError(t, hostFS.Symlink(filepath.Join(root, "home/alice/secret.txt"), "/home/frank/public_html/.pubd.toml"))
+
+	cfg := FileSystemDefaults()
+	cfg.UserDirs.Dir = "public_html"
+	cfg.UserDirs.ConfigFile = ".pubd.toml"
+	fs, err := cfg.Build(context.Background(), zap.NewNop(), hostFS)
+	require.NoError(t, err)
+
+	_, err = fs.Stat("/~alice/index.html")
+	assert.NoError(t, err)
+	for _, name := range []string{"/~erin/secret.txt", "/~frank/index.html"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := fs.Stat(name)
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+	}
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/liclac/pubd"
 	"github.com/liclac/pubd/cliutil"
@@ -21,40 +24,60 @@ import (
 const Usage = `usage: pubd-http [path]`
 
 type Config struct {
-	Addr   string `toml:"addr"`
-	Prefix string `toml:"prefix"`
+	Addr   string              `toml:"addr"`
+	Prefix string              `toml:"prefix"`
+	TLS    cliutil.TLSConfig   `toml:"tls"`
+	Proxy  cliutil.ProxyConfig `toml:"proxy"`
 	httppub.IndexConfig
 	cliutil.FileSystemConfig
+	cliutil.ShutdownConfig
 	cliutil.LogConfig
 }
 
 func Parse(fs billy.Filesystem, args []string) (Config, error) {
-	cfg := Config{Addr: "localhost:8888", FileSystemConfig: cliutil.FileSystemDefaults()}
+	cfg := Config{
+		Addr:             "localhost:8888",
+		FileSystemConfig: cliutil.FileSystemDefaults(),
+		ShutdownConfig:   cliutil.ShutdownDefaults(),
+	}
 	return cfg, cliutil.Configure(&cfg, &cfg.Path, func(f *pflag.FlagSet) {
 		f.StringVarP(&cfg.Addr, "addr", "a", cfg.Addr, "listen address")
 		f.StringVarP(&cfg.Prefix, "prefix", "P", cfg.Prefix, "serve from a subdirectory")
 		f.StringSliceVarP(&cfg.IndexConfig.READMEs, "readme", "R", cfg.READMEs, "include README(s) at the bottom of directory listings")
+		cfg.TLS.Flags(f)
+		cfg.Proxy.Flags(f)
 		cfg.FileSystemConfig.Flags(f)
+		cfg.ShutdownConfig.Flags(f)
 		cfg.LogConfig.Flags(f)
 	}, Usage, args)
 }
 
-func (cfg *Config) Filesystem(fs billy.Filesystem) (billy.Filesystem, error) {
-	return cfg.FileSystemConfig.Build(fs)
+// Settings which can't be changed by reloading the config file.
+func (cfg Config) restartOnly() []interface{} {
+	return []interface{}{cfg.Addr, cfg.TLS, cfg.Proxy, cfg.ShutdownConfig, cfg.LogConfig}
 }
 
-func (cfg *Config) Handler(L *zap.Logger, fs billy.Filesystem) http.Handler {
-	return httppub.WithPrefix(cfg.Prefix,
-		httppub.WithAccessLog(L.Named("access"),
-			httppub.Handler(L.Named("req"), fs, httppub.SimpleIndex(cfg.IndexConfig)),
-		))
+func (cfg *Config) Filesystem(ctx context.Context, L *zap.Logger, fs billy.Filesystem) (billy.Filesystem, error) {
+	return cfg.FileSystemConfig.Build(ctx, L, fs)
+}
+
+func (cfg *Config) Handler(L *zap.Logger, fs billy.Filesystem, acm *autocert.Manager) http.Handler {
+	h := cliutil.HTTPHandler(L, fs, cfg.Prefix, cfg.IndexConfig)
+	if acm != nil {
+		h = acm.HTTPHandler(h) // Answer HTTP-01 challenges, regardless of the prefix.
+	}
+	return h
 }
 
 func (cfg *Config) Server(L *zap.Logger, h http.Handler) pubd.Server {
 	L = L.Named("server")
 	return pubd.ServerFunc(func(ctx context.Context, l net.Listener) error {
 		if ce := L.Check(zapcore.InfoLevel, "Running"); ce != nil {
-			addr := fmt.Sprintf("http://%s%s/", l.Addr(), httppub.CleanPrefix(cfg.Prefix))
+			scheme := "http"
+			if cfg.TLS.CertFile != "" || len(cfg.TLS.ACME.Domains) > 0 {
+				scheme = "https"
+			}
+			addr := fmt.Sprintf("%s://%s%s/", scheme, l.Addr(), httppub.CleanPrefix(cfg.Prefix))
 			ce.Write(zap.String("addr", addr))
 		}
 		return httppub.Serve(ctx, l, h)
@@ -63,16 +86,62 @@ func (cfg *Config) Server(L *zap.Logger, h http.Handler) pubd.Server {
 
 func Main(hostFS billy.Filesystem, args []string) error {
 	cfg, err := Parse(hostFS, args)
+	if errors.Is(err, cliutil.ErrConfigPrinted) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	L, err := cfg.Logger()
+	if err != nil {
+		return err
+	}
+	L = L.Named("http")
+	ctx := pubd.WithUpgradeHandler(pubd.WithSignalHandler(context.Background()), L)
+	acm, err := cfg.TLS.ACME.Manager()
 	if err != nil {
 		return err
 	}
-	fs, err := cfg.Filesystem(hostFS)
+	lc, certs, err := cfg.TLS.ListenConfig(ctx, L, acm)
 	if err != nil {
 		return err
 	}
-	L := cfg.Logger().Named("http")
-	ctx := pubd.WithSignalHandler(context.Background())
-	return pubd.ListenAndServe(ctx, cfg.Addr, cfg.Server(L, cfg.Handler(L, fs)))
+	if err := cfg.Proxy.Apply(&lc); err != nil {
+		return err
+	}
+
+	// Re-read the config file and certificate on SIGHUP, and swap in a new filesystem and handler.
+	// The old ones are closed once their last request has finished.
+	var h *httppub.SwapHandler
+	if err := pubd.WatchReload(ctx, L.Named("reload"), func(ctx context.Context, done context.CancelFunc) error {
+		next := cfg
+		if h != nil {
+			if certs != nil {
+				certs.Check(L.Named("tls"))
+			}
+			var err error
+			if next, err = Parse(hostFS, args); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(cfg.restartOnly(), next.restartOnly()) {
+				L.Warn("Changes to listen, TLS, proxy, shutdown and log settings require a restart")
+			}
+		}
+		fs, err := next.Filesystem(ctx, L, hostFS)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			h = httppub.NewSwapHandler(next.Handler(L, fs, acm), done)
+		} else {
+			h.Swap(next.Handler(L, fs, acm), done)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	defer h.Close()
+	srv := cfg.Server(L, h)
+	return cfg.TLS.ACME.ListenAndServe(ctx, L.Named("acme"), acm, lc, cfg.ServeConfig(L), cfg.Addr, srv)
 }
 
 func main() {
@@ -4,6 +4,7 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
@@ -29,6 +30,7 @@ func TestParse(t *testing.T) {
 	// These lines are getting too long.
 	type FSC = cliutil.FileSystemConfig
 	type IXC = httppub.IndexConfig
+	type UDC = cliutil.UserDirsConfig
 
 	testdata := map[string]Config{
 		"0":                       {},
@@ -43,6 +45,48 @@ func TestParse(t *testing.T) {
 		"0 -x .git -x tmp":               {FileSystemConfig: FSC{Exclude: []string{".git", "tmp"}}},
 		"0 --exclude=.git --exclude=tmp": {FileSystemConfig: FSC{Exclude: []string{".git", "tmp"}}},
 
+		"0 -L static":                       {FileSystemConfig: FSC{Layers: []string{"static"}}},
+		"0 --layers=static --layers=vendor": {FileSystemConfig: FSC{Layers: []string{"static", "vendor"}}},
+		"0 --layer=static --layer=vendor":   {FileSystemConfig: FSC{Layers: []string{"static", "vendor"}}},
+
+		"0 -i public/** -i *.pdf":               {FileSystemConfig: FSC{Include: []string{"public/**", "*.pdf"}}},
+		"0 --include=public/** --exclude=*.tmp": {FileSystemConfig: FSC{Include: []string{"public/**"}, Exclude: []string{"*.tmp"}}},
+
+		"0 --ignore-files=.gitignore --ignore-files=.pubdignore": {FileSystemConfig: FSC{IgnoreFiles: []string{".gitignore", ".pubdignore"}}},
+		"0 --ignore-file=.gitignore --ignore-file=.pubdignore":   {FileSystemConfig: FSC{IgnoreFiles: []string{".gitignore", ".pubdignore"}}},
+
+		"0 --archives": {FileSystemConfig: FSC{Archives: true}},
+
+		"0 --public-only": {FileSystemConfig: FSC{PublicOnly: true}},
+
+		"0 --git=v1.2.0:docs":             {FileSystemConfig: FSC{Git: "v1.2.0:docs"}},
+		"0 --git=master --git-refresh=1m": {FileSystemConfig: FSC{Git: "master", GitRefresh: cliutil.Duration{Duration: time.Minute}}},
+
+		"0 --userdir.dir public_html":                          {FileSystemConfig: FSC{UserDirs: UDC{Dir: "public_html"}}},
+		"0 --userdir.dir=www --userdir.min-uid=500":            {FileSystemConfig: FSC{UserDirs: UDC{Dir: "www", MinUID: 500}}},
+		"0 --userdir.dir=www --userdir.config-file=.pubd.toml": {FileSystemConfig: FSC{UserDirs: UDC{Dir: "www", ConfigFile: ".pubd.toml"}}},
+		"0 --userdir public_html":                              {FileSystemConfig: FSC{UserDirs: UDC{Dir: "public_html"}}},
+		"0 --userdir=www --userdir-min-uid=500":                {FileSystemConfig: FSC{UserDirs: UDC{Dir: "www", MinUID: 500}}},
+		"0 --userdir=www --userdir-config=.pubd.toml":          {FileSystemConfig: FSC{UserDirs: UDC{Dir: "www", ConfigFile: ".pubd.toml"}}},
+
+		"0 -a tls/:8443 --tls.cert-file=c.pem --tls.key-file=k.pem":                    {Addr: "tls/:8443", TLS: cliutil.TLSConfig{CertFile: "c.pem", KeyFile: "k.pem"}},
+		"0 --tls.client-ca-file=ca.pem --tls.client-auth=optional":                     {TLS: cliutil.TLSConfig{ClientCAFile: "ca.pem", ClientAuth: "optional"}},
+		"0 --tls.client-allow=*.ops --tls.client-allow=alice":                          {TLS: cliutil.TLSConfig{ClientAllow: []string{"*.ops", "alice"}}},
+		"0 -a tls/:443 --tls.acme.domains=a.com,b.com --tls.acme.email=me@a.com":       {Addr: "tls/:443", TLS: cliutil.TLSConfig{ACME: cliutil.ACMEConfig{Domains: []string{"a.com", "b.com"}, Email: "me@a.com"}}},
+		"0 --tls.acme.domain=a.com --tls.acme.domain=b.com":                            {TLS: cliutil.TLSConfig{ACME: cliutil.ACMEConfig{Domains: []string{"a.com", "b.com"}}}},
+		"0 --tls.acme.directory=https://localhost:14000/dir --tls.acme.ca-file=ca.pem": {TLS: cliutil.TLSConfig{ACME: cliutil.ACMEConfig{Directory: "https://localhost:14000/dir", CAFile: "ca.pem"}}},
+		"0 --tls.acme.cache-dir=/var/cache/pubd --tls.acme.http-addr=:80":              {TLS: cliutil.TLSConfig{ACME: cliutil.ACMEConfig{CacheDir: "/var/cache/pubd", HTTPAddr: ":80"}}},
+		"0 -a proxy/:8080 --proxy.trusted=10.0.0.0/8,127.0.0.1":                        {Addr: "proxy/:8080", Proxy: cliutil.ProxyConfig{Trusted: []string{"10.0.0.0/8", "127.0.0.1"}}},
+		"0 -a fd/3,4":                          {Addr: "fd/3,4"},
+		"0 -a inetd/ --log-file=/var/log/pubd": {Addr: "inetd/", LogConfig: cliutil.LogConfig{File: "/var/log/pubd"}},
+
+		"0 --cache-ttl=5s": {FileSystemConfig: FSC{CacheTTL: cliutil.Duration{Duration: 5 * time.Second}}},
+
+		"0 --drain-timeout=5m": {ShutdownConfig: cliutil.ShutdownConfig{DrainTimeout: cliutil.Duration{Duration: 5 * time.Minute}}},
+
+		"0 --symlinks=deny":        {FileSystemConfig: FSC{Symlinks: "deny"}},
+		"0 --symlinks within-root": {FileSystemConfig: FSC{Symlinks: "within-root"}},
+
 		"0 -R RM.txt":                      {IndexConfig: IXC{READMEs: []string{"RM.txt"}}},
 		"0 --readme RM.txt":                {IndexConfig: IXC{READMEs: []string{"RM.txt"}}},
 		"0 -R RM.txt -R RM.md":             {IndexConfig: IXC{READMEs: []string{"RM.txt", "RM.md"}}},
@@ -55,6 +99,15 @@ func TestParse(t *testing.T) {
 		if out.FileSystemConfig.Path == "" {
 			out.FileSystemConfig.Path = cliutil.FileSystemDefaults().Path
 		}
+		if out.FileSystemConfig.Symlinks == "" {
+			out.FileSystemConfig.Symlinks = cliutil.FileSystemDefaults().Symlinks
+		}
+		if out.FileSystemConfig.UserDirs.MinUID == 0 {
+			out.FileSystemConfig.UserDirs.MinUID = cliutil.UserDirsDefaults().MinUID
+		}
+		if out.ShutdownConfig.DrainTimeout.Duration == 0 {
+			out.ShutdownConfig.DrainTimeout = cliutil.ShutdownDefaults().DrainTimeout
+		}
 		t.Run(in, func(t *testing.T) {
 			cfg, err := Parse(memfs.New(), strings.Split(in, " "))
 			require.NoError(t, err)
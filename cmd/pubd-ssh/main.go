@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
+	"reflect"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/osfs"
@@ -16,7 +16,6 @@ import (
 
 	"github.com/liclac/pubd"
 	"github.com/liclac/pubd/cliutil"
-	"github.com/liclac/pubd/proto/sftppub"
 	"github.com/liclac/pubd/proto/sshpub"
 )
 
@@ -29,69 +28,120 @@ type ServerConfig struct {
 }
 
 type Config struct {
-	Addr        string `toml:"addr"`
-	HostKeyFile string `toml:"host-key-file"` // Path to host private key.
+	Addr        string              `toml:"addr"`
+	HostKeyFile string              `toml:"host-key-file"` // Path to host private key.
+	TLS         cliutil.TLSConfig   `toml:"tls"`
+	Proxy       cliutil.ProxyConfig `toml:"proxy"`
 	ServerConfig
 	cliutil.FileSystemConfig
+	cliutil.ShutdownConfig
 	cliutil.LogConfig
 }
 
 func Parse(fs billy.Filesystem, args []string) (Config, error) {
-	cfg := Config{Addr: "localhost:2222", FileSystemConfig: cliutil.FileSystemDefaults()}
+	cfg := Config{
+		Addr:             "localhost:2222",
+		FileSystemConfig: cliutil.FileSystemDefaults(),
+		ShutdownConfig:   cliutil.ShutdownDefaults(),
+	}
 	return cfg, cliutil.Configure(&cfg, &cfg.Path, func(f *pflag.FlagSet) {
 		f.StringVarP(&cfg.Addr, "addr", "a", cfg.Addr, "listen address")
 		f.BoolVarP(&cfg.SFTP.Enable, "sftp.enable", "F", cfg.SFTP.Enable, "enable SFTP access")
 		f.StringVarP(&cfg.HostKeyFile, "host-key-file", "K", cfg.HostKeyFile, "path to host private key file")
+		cfg.TLS.Flags(f)
+		cfg.Proxy.Flags(f)
 		cfg.FileSystemConfig.Flags(f)
+		cfg.ShutdownConfig.Flags(f)
 		cfg.LogConfig.Flags(f)
 	}, Usage, args)
 }
 
-func Server(L *zap.Logger, fs billy.Filesystem, hostKey ssh.Signer, cfg ServerConfig) pubd.Server {
-	var subSFTP sshpub.Subsystem
-	if cfg.SFTP.Enable {
-		subSFTP = sftppub.New(fs)
-	}
+// Settings which can't be changed by reloading the config file.
+func (cfg Config) restartOnly() []interface{} {
+	return []interface{}{cfg.Addr, cfg.TLS, cfg.Proxy, cfg.ShutdownConfig, cfg.LogConfig}
+}
 
-	// Subsystems should be explicitly set to nil when disabled; an unset subsystem logs a warning.
-	srv := sshpub.New(L, hostKey)
-	srv.Subsystems = map[string]sshpub.Subsystem{
-		"sftp": subSFTP,
+// Checks the configuration, and loads the host key.
+func (cfg Config) HostKey(hostFS billy.Filesystem) (ssh.Signer, error) {
+	if !cfg.SFTP.Enable {
+		return nil, errors.New("no transports enabled; try -F/--sftp.enable")
 	}
-	return pubd.ServerFunc(func(ctx context.Context, l net.Listener) error {
-		L.Info("Running", zap.Stringer("addr", l.Addr()))
-		return srv.Serve(ctx, l)
-	})
+	return cliutil.LoadHostKey(hostFS, cfg.HostKeyFile, "-K/--host-key-file")
+}
+
+func Server(L *zap.Logger, fs billy.Filesystem, hostKey ssh.Signer, cfg ServerConfig) sshpub.Server {
+	return cliutil.SSHServer(L, fs, hostKey, cfg.SFTP.Enable)
 }
 
 func Main(hostFS billy.Filesystem, args []string) error {
 	cfg, err := Parse(hostFS, args)
-	if err != nil {
+	if errors.Is(err, cliutil.ErrConfigPrinted) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	if !cfg.SFTP.Enable {
-		return errors.New("no transports enabled; try -F/--sftp.enable")
+	hostKey, err := cfg.HostKey(hostFS)
+	if err != nil {
+		return err
 	}
 
-	if cfg.HostKeyFile == "" {
-		return errors.New("-K/--host-key-file is required, and can be generated with: `ssh-keygen -t ed25519`")
+	L, err := cfg.Logger()
+	if err != nil {
+		return err
 	}
-	hostKeyPath, err := filepath.Abs(cfg.HostKeyFile)
+	L = L.Named("ssh")
+	ctx := pubd.WithUpgradeHandler(pubd.WithSignalHandler(context.Background()), L)
+	acm, err := cfg.TLS.ACME.Manager()
 	if err != nil {
-		return fmt.Errorf("-K/--host-key-file: couldn't absolutise path to '%s': %w", cfg.HostKeyFile, err)
+		return err
 	}
-	hostKey, err := sshpub.LoadPrivateKey(hostFS, hostKeyPath)
+	lc, certs, err := cfg.TLS.ListenConfig(ctx, L, acm)
 	if err != nil {
 		return err
 	}
+	if err := cfg.Proxy.Apply(&lc); err != nil {
+		return err
+	}
 
-	fs, err := cfg.Build(hostFS) // TODO: This is a weird function name.
-	if err != nil {
+	// Re-read the config file and certificate on SIGHUP, and swap in a new filesystem, host key
+	// and subsystems. The old ones are closed once their last connection has.
+	var srv *sshpub.SwapServer
+	if err := pubd.WatchReload(ctx, L.Named("reload"), func(ctx context.Context, done context.CancelFunc) error {
+		next, nextHostKey := cfg, hostKey
+		if srv != nil {
+			if certs != nil {
+				certs.Check(L.Named("tls"))
+			}
+			var err error
+			if next, err = Parse(hostFS, args); err != nil {
+				return err
+			}
+			if nextHostKey, err = next.HostKey(hostFS); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(cfg.restartOnly(), next.restartOnly()) {
+				L.Warn("Changes to listen, TLS, proxy, shutdown and log settings require a restart")
+			}
+		}
+		fs, err := next.Build(ctx, L, hostFS) // TODO: This is a weird function name.
+		if err != nil {
+			return err
+		}
+		if srv == nil {
+			srv = sshpub.NewSwapServer(Server(L, fs, nextHostKey, next.ServerConfig), done)
+		} else {
+			srv.Swap(Server(L, fs, nextHostKey, next.ServerConfig), done)
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
-	L := cfg.Logger().Named("ssh")
-	ctx := pubd.WithSignalHandler(context.Background())
-	return pubd.ListenAndServe(ctx, cfg.Addr, Server(L, fs, hostKey, cfg.ServerConfig))
+	defer srv.Close()
+	return cfg.TLS.ACME.ListenAndServe(ctx, L.Named("acme"), acm, lc, cfg.ServeConfig(L), cfg.Addr,
+		pubd.ServerFunc(func(ctx context.Context, l net.Listener) error {
+			L.Info("Running", zap.Stringer("addr", l.Addr()))
+			return srv.Serve(ctx, l)
+		}))
 }
 
 func main() {
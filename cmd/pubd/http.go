@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/cliutil"
+	"github.com/liclac/pubd/proto/httppub"
+)
+
+func init() {
+	pubd.RegisterProtocol("http", func() pubd.ServiceConfig { return &HTTPConfig{} })
+}
+
+// The [http] section.
+type HTTPConfig struct {
+	Addrs  []string `toml:"addr"`
+	Prefix string   `toml:"prefix"`
+	httppub.IndexConfig
+}
+
+func (c *HTTPConfig) Flags(f *pflag.FlagSet) {
+	f.StringSliceVar(&c.Addrs, "http.addr", c.Addrs, "serve HTTP on this address (repeatable)")
+	f.StringVar(&c.Prefix, "http.prefix", c.Prefix, "serve HTTP from a subdirectory")
+	f.StringSliceVar(&c.READMEs, "http.readme", c.READMEs, "include README(s) at the bottom of directory listings")
+}
+
+func (c *HTTPConfig) ListenAddrs() []string { return c.Addrs }
+
+func (c *HTTPConfig) Server(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, done func()) (pubd.SwappableServer, error) {
+	h := cliutil.HTTPHandler(L, fs, c.Prefix, c.IndexConfig)
+	return &httpServer{L: L, h: h, done: done, sh: httppub.NewSwapHandler(h, done)}, nil
+}
+
+type httpServer struct {
+	L    *zap.Logger
+	h    http.Handler
+	done func()
+	sh   *httppub.SwapHandler
+}
+
+func (s *httpServer) Serve(ctx context.Context, l net.Listener) error {
+	s.L.Info("Running", zap.Stringer("addr", l.Addr()))
+	return httppub.Serve(ctx, l, s.sh)
+}
+
+func (s *httpServer) Swap(next pubd.SwappableServer) {
+	n := next.(*httpServer)
+	s.sh.Swap(n.h, n.done)
+}
+
+func (s *httpServer) Close() { s.sh.Close() }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/cliutil"
+)
+
+const Usage = `usage: pubd [-C pubd.toml] [path]`
+
+type Config struct {
+	TLS   cliutil.TLSConfig   `toml:"tls"`
+	Proxy cliutil.ProxyConfig `toml:"proxy"`
+	cliutil.FileSystemConfig
+	cliutil.ShutdownConfig
+	cliutil.LogConfig
+
+	// Services by protocol name, from sections of the config file, eg. [http]; see pubd.Protocol.
+	Services map[string]pubd.ServiceConfig `toml:"-"`
+}
+
+func Parse(fs billy.Filesystem, args []string) (Config, error) {
+	cfg := Config{
+		FileSystemConfig: cliutil.FileSystemDefaults(),
+		ShutdownConfig:   cliutil.ShutdownDefaults(),
+		Services:         make(map[string]pubd.ServiceConfig),
+	}
+	return cfg, cliutil.Configure(&cfg, &cfg.Path, func(f *pflag.FlagSet) {
+		cfg.TLS.Flags(f)
+		cfg.Proxy.Flags(f)
+		cfg.FileSystemConfig.Flags(f)
+		cfg.ShutdownConfig.Flags(f)
+		cfg.LogConfig.Flags(f)
+		for _, name := range pubd.Protocols() {
+			if flagger, ok := cfg.service(name).(interface{ Flags(*pflag.FlagSet) }); ok {
+				flagger.Flags(f)
+			}
+		}
+	}, Usage, args)
+}
+
+// Returns the configuration for a protocol's service, creating a default one if needed.
+func (cfg *Config) service(name string) pubd.ServiceConfig {
+	if svc, ok := cfg.Services[name]; ok {
+		return svc
+	}
+	p, _ := pubd.LookupProtocol(name)
+	svc := p()
+	cfg.Services[name] = svc
+	return svc
+}
+
+// cliutil.ConfigFileDecoder; decodes sections named after registered protocols into services.
+func (cfg *Config) DecodeConfigFile(data []byte, undecoded []toml.Key) ([]toml.Key, error) {
+	var sections map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &sections)
+	if err != nil {
+		return nil, err
+	}
+	for name, section := range sections {
+		if _, ok := pubd.LookupProtocol(name); !ok {
+			continue
+		}
+		if err := md.PrimitiveDecode(section, cfg.service(name)); err != nil {
+			return nil, fmt.Errorf("[%s]: %w", name, err)
+		}
+	}
+
+	// Keys in protocol sections are only unknown if they weren't decoded into the service either.
+	stillUndecoded := make(map[string]bool)
+	for _, key := range md.Undecoded() {
+		stillUndecoded[key.String()] = true
+	}
+	var unknown []toml.Key
+	for _, key := range undecoded {
+		if _, ok := pubd.LookupProtocol(key[0]); ok && (len(key) == 1 || !stillUndecoded[key.String()]) {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	return unknown, nil
+}
+
+// cliutil.ConfigFileEncoder; adds sections for enabled services.
+func (cfg *Config) EncodeConfigFile(w io.Writer) error {
+	if err := toml.NewEncoder(w).Encode(cfg); err != nil {
+		return err
+	}
+	for _, name := range cfg.enabled() {
+		fmt.Fprintln(w)
+		if err := toml.NewEncoder(w).Encode(map[string]interface{}{name: cfg.Services[name]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the names of services with any listen addresses, in alphabetical order.
+func (cfg Config) enabled() []string {
+	var names []string
+	for _, name := range pubd.Protocols() {
+		if svc, ok := cfg.Services[name]; ok && len(svc.ListenAddrs()) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Listens on an address; TLS is only used for tls/ addresses, so services can mix and match.
+func listen(lc pubd.ListenConfig, addr string) ([]net.Listener, error) {
+	if network, _ := pubd.SplitAddr(addr); network != "tls" {
+		lc.TLS = nil
+	}
+	return lc.Listen(addr)
+}
+
+// Settings which can't be changed by reloading the config file.
+func (cfg Config) restartOnly() []interface{} {
+	addrs := make(map[string][]string)
+	for _, name := range cfg.enabled() {
+		addrs[name] = cfg.Services[name].ListenAddrs()
+	}
+	return []interface{}{addrs, cfg.TLS, cfg.Proxy, cfg.ShutdownConfig, cfg.LogConfig}
+}
+
+// Returns a func which calls done once it's been called n times, eg. once each of n services
+// is done with a filesystem.
+func doneAfter(n int, done func()) func() {
+	var mu sync.Mutex
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if n--; n == 0 {
+			done()
+		}
+	}
+}
+
+// Builds the named services' servers, serving fs. If any fails, those already built are closed,
+// so their generation's done func isn't left waiting on them.
+func (cfg Config) servers(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, names []string, release func()) (map[string]pubd.SwappableServer, error) {
+	servers := make(map[string]pubd.SwappableServer, len(names))
+	for _, name := range names {
+		srv, err := cfg.service(name).Server(ctx, L.Named(name), hostFS, fs, release)
+		if err != nil {
+			for _, srv := range servers {
+				srv.Close()
+			}
+			return nil, fmt.Errorf("[%s]: %w", name, err)
+		}
+		servers[name] = srv
+	}
+	return servers, nil
+}
+
+func closeServices(services []pubd.Service) {
+	for _, svc := range services {
+		for _, l := range svc.Listeners {
+			l.Close()
+		}
+	}
+}
+
+func Main(hostFS billy.Filesystem, args []string) error {
+	cfg, err := Parse(hostFS, args)
+	if errors.Is(err, cliutil.ErrConfigPrinted) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	names := cfg.enabled()
+	if len(names) == 0 {
+		return fmt.Errorf("no services configured; add a section for one of: %s, or try eg. --http.addr",
+			strings.Join(pubd.Protocols(), ", "))
+	}
+
+	L, err := cfg.Logger()
+	if err != nil {
+		return err
+	}
+	ctx := pubd.WithUpgradeHandler(pubd.WithSignalHandler(context.Background()), L)
+	acm, err := cfg.TLS.ACME.Manager()
+	if err != nil {
+		return err
+	}
+	lc, certs, err := cfg.TLS.ListenConfig(ctx, L, acm)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Proxy.Apply(&lc); err != nil {
+		return err
+	}
+
+	// Re-read the config file and certificate on SIGHUP, and swap a new filesystem into each
+	// service. The old one is closed once every service's last request or connection has finished.
+	var servers map[string]pubd.SwappableServer
+	if err := pubd.WatchReload(ctx, L.Named("reload"), func(ctx context.Context, done context.CancelFunc) error {
+		next := cfg
+		if servers != nil {
+			if certs != nil {
+				certs.Check(L.Named("tls"))
+			}
+			var err error
+			if next, err = Parse(hostFS, args); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(cfg.restartOnly(), next.restartOnly()) {
+				L.Warn("Changes to listen, TLS, proxy, shutdown and log settings require a restart")
+			}
+		}
+		fs, err := next.Build(ctx, L, hostFS)
+		if err != nil {
+			return err
+		}
+		nextServers, err := next.servers(ctx, L, hostFS, fs, names, doneAfter(len(names), done))
+		if err != nil {
+			return err
+		}
+		if servers == nil {
+			servers = nextServers
+			return nil
+		}
+		for name, srv := range servers {
+			srv.Swap(nextServers[name])
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	defer func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+
+	services, err := cfg.TLS.ACME.Services(L.Named("acme"), acm, lc)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		for _, addr := range cfg.Services[name].ListenAddrs() {
+			ls, err := listen(lc, addr)
+			if err != nil {
+				closeServices(services)
+				return fmt.Errorf("[%s]: %w", name, err)
+			}
+			services = append(services, pubd.Service{Listeners: ls, Server: servers[name]})
+		}
+	}
+	return cfg.ServeConfig(L).ServeServices(ctx, services)
+}
+
+func main() {
+	if err := Main(osfs.New("/"), os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
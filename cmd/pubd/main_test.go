@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/proto/httppub"
+)
+
+func TestParse(t *testing.T) {
+	f, err := ioutil.TempFile("", "pubd-*.toml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+path = "/srv/www"
+
+[http]
+addr = ["localhost:8888", "tls/:8443"]
+readme = ["README.md"]
+
+[ssh]
+addr = ["localhost:2222"]
+host-key-file = "/etc/pubd/host_key"
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	testdata := map[string]struct {
+		HTTP    HTTPConfig
+		SSH     SSHConfig
+		Enabled []string
+	}{
+		"0": {},
+		"0 --http.addr=localhost:8888": {
+			HTTP:    HTTPConfig{Addrs: []string{"localhost:8888"}},
+			Enabled: []string{"http"},
+		},
+		"0 --ssh.addr=:2222 --ssh.host-key-file=key --ssh.sftp.enable=false": {
+			SSH:     SSHConfig{Addrs: []string{":2222"}, HostKeyFile: "key"},
+			Enabled: []string{"ssh"},
+		},
+		"0 -C " + f.Name(): {
+			HTTP: HTTPConfig{
+				Addrs:       []string{"localhost:8888", "tls/:8443"},
+				IndexConfig: httppub.IndexConfig{READMEs: []string{"README.md"}},
+			},
+			SSH:     SSHConfig{Addrs: []string{"localhost:2222"}, HostKeyFile: "/etc/pubd/host_key"},
+			Enabled: []string{"http", "ssh"},
+		},
+		"0 -C " + f.Name() + " --http.addr=:80 --http.prefix=/pub": {
+			HTTP: HTTPConfig{
+				Addrs:       []string{":80"},
+				Prefix:      "/pub",
+				IndexConfig: httppub.IndexConfig{READMEs: []string{"README.md"}},
+			},
+			SSH:     SSHConfig{Addrs: []string{"localhost:2222"}, HostKeyFile: "/etc/pubd/host_key"},
+			Enabled: []string{"http", "ssh"},
+		},
+	}
+	for in, out := range testdata {
+		if !strings.Contains(in, "--ssh.sftp.enable=false") {
+			out.SSH.SFTP.Enable = true
+		}
+		t.Run(in, func(t *testing.T) {
+			cfg, err := Parse(memfs.New(), strings.Split(in, " "))
+			require.NoError(t, err)
+			assert.Equal(t, &out.HTTP, cfg.Services["http"])
+			assert.Equal(t, &out.SSH, cfg.Services["ssh"])
+			assert.Equal(t, out.Enabled, cfg.enabled())
+			if strings.Contains(in, "-C") {
+				assert.Equal(t, "/srv/www", cfg.Path)
+			}
+		})
+	}
+
+	t.Run("Invalid Section", func(t *testing.T) {
+		bad, err := ioutil.TempFile("", "pubd-*.toml")
+		require.NoError(t, err)
+		defer os.Remove(bad.Name())
+		_, err = bad.WriteString("[http]\naddr = \"localhost:8888\"\n")
+		require.NoError(t, err)
+		require.NoError(t, bad.Close())
+
+		_, err = Parse(memfs.New(), []string{"0", "-C", bad.Name()})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "-C/--config: [http]: ")
+	})
+}
+
+func TestParseUnknownKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "pubd-*.toml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("[http]\naddr = [\"localhost:8888\"]\nadr = [\"typo\"]\n\n[notaprotocol]\naddr = [\"localhost:1234\"]\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = Parse(memfs.New(), []string{"0", "-C", f.Name()})
+	assert.EqualError(t, err, "-C/--config: "+
+		f.Name()+":3: unknown key 'http.adr'; "+
+		f.Name()+":5: unknown key 'notaprotocol'")
+}
+
+func TestMainNoServices(t *testing.T) {
+	err := Main(memfs.New(), []string{"0"})
+	assert.EqualError(t, err, "no services configured; add a section for one of: http, ssh, or try eg. --http.addr")
+}
+
+func TestHTTPServerSwap(t *testing.T) {
+	get := func(srv pubd.SwappableServer) string {
+		rw := httptest.NewRecorder()
+		srv.(*httpServer).sh.ServeHTTP(rw, httptest.NewRequest("GET", "/file.txt", nil))
+		return rw.Body.String()
+	}
+	var done []string
+	newServer := func(name string) pubd.SwappableServer {
+		fs := memfs.New()
+		require.NoError(t, util.WriteFile(fs, "/file.txt", []byte(name), 0644))
+		srv, err := (&HTTPConfig{}).Server(context.Background(), zap.NewNop(), memfs.New(), fs,
+			func() { done = append(done, name) })
+		require.NoError(t, err)
+		return srv
+	}
+
+	srv := newServer("old")
+	assert.Equal(t, "old", get(srv))
+	srv.Swap(newServer("new"))
+	assert.Equal(t, "new", get(srv))
+	assert.Equal(t, []string{"old"}, done)
+	srv.Close()
+	assert.Equal(t, []string{"old", "new"}, done)
+}
+
+func TestDoneAfter(t *testing.T) {
+	calls := 0
+	release := doneAfter(2, func() { calls++ })
+	release()
+	assert.Equal(t, 0, calls)
+	release()
+	assert.Equal(t, 1, calls)
+}
+
+// A service whose servers fail to build if err is set.
+type testService struct {
+	err    error
+	closed *[]string
+	name   string
+}
+
+func (s testService) ListenAddrs() []string { return []string{"127.0.0.1:0"} }
+
+func (s testService) Server(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, done func()) (pubd.SwappableServer, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return testServer{s}, nil
+}
+
+type testServer struct{ testService }
+
+func (testServer) Serve(ctx context.Context, l net.Listener) error { return nil }
+func (testServer) Swap(next pubd.SwappableServer)                  {}
+func (s testServer) Close()                                        { *s.closed = append(*s.closed, s.name) }
+
+func TestServersFail(t *testing.T) {
+	var closed []string
+	cfg := Config{Services: map[string]pubd.ServiceConfig{
+		"a": testService{closed: &closed, name: "a"},
+		"b": testService{closed: &closed, name: "b"},
+		"c": testService{err: errors.New("nope")},
+	}}
+	_, err := cfg.servers(context.Background(), zap.NewNop(), memfs.New(), memfs.New(), []string{"a", "b", "c"}, func() {})
+	assert.EqualError(t, err, "[c]: nope")
+	sort.Strings(closed)
+	assert.Equal(t, []string{"a", "b"}, closed)
+}
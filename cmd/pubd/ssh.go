@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
+	"github.com/liclac/pubd/cliutil"
+	"github.com/liclac/pubd/proto/sshpub"
+)
+
+func init() {
+	pubd.RegisterProtocol("ssh", func() pubd.ServiceConfig {
+		c := &SSHConfig{}
+		c.SFTP.Enable = true
+		return c
+	})
+}
+
+// The [ssh] section.
+type SSHConfig struct {
+	Addrs       []string `toml:"addr"`
+	HostKeyFile string   `toml:"host-key-file"` // Path to host private key.
+	SFTP        struct {
+		Enable bool `toml:"enable"`
+	} `toml:"sftp"`
+}
+
+func (c *SSHConfig) Flags(f *pflag.FlagSet) {
+	f.StringSliceVar(&c.Addrs, "ssh.addr", c.Addrs, "serve SSH on this address (repeatable)")
+	f.StringVar(&c.HostKeyFile, "ssh.host-key-file", c.HostKeyFile, "path to SSH host private key file")
+	f.BoolVar(&c.SFTP.Enable, "ssh.sftp.enable", c.SFTP.Enable, "enable SFTP access")
+}
+
+func (c *SSHConfig) ListenAddrs() []string { return c.Addrs }
+
+func (c *SSHConfig) Server(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, done func()) (pubd.SwappableServer, error) {
+	if !c.SFTP.Enable {
+		return nil, errors.New("no transports enabled; try --ssh.sftp.enable")
+	}
+	hostKey, err := cliutil.LoadHostKey(hostFS, c.HostKeyFile, "--ssh.host-key-file")
+	if err != nil {
+		return nil, err
+	}
+	srv := cliutil.SSHServer(L, fs, hostKey, c.SFTP.Enable)
+	return &sshServer{L: L, srv: srv, done: done, ss: sshpub.NewSwapServer(srv, done)}, nil
+}
+
+type sshServer struct {
+	L    *zap.Logger
+	srv  sshpub.Server
+	done func()
+	ss   *sshpub.SwapServer
+}
+
+func (s *sshServer) Serve(ctx context.Context, l net.Listener) error {
+	s.L.Info("Running", zap.Stringer("addr", l.Addr()))
+	return s.ss.Serve(ctx, l)
+}
+
+func (s *sshServer) Swap(next pubd.SwappableServer) {
+	n := next.(*sshServer)
+	s.ss.Swap(n.srv, n.done)
+}
+
+func (s *sshServer) Close() { s.ss.Close() }
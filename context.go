@@ -7,18 +7,50 @@ import (
 	"syscall"
 )
 
-// Returns a context which is cancelled upon receiving SIGINT or SIGTERM.
-func WithSignalHandler(ctx context.Context) context.Context {
-	ctx, cancel := context.WithCancel(ctx)
+// Returns a context which is cancelled upon receiving SIGINT or SIGTERM. Another signal
+// after that cuts Serve()'s drain period short. Signals are no longer handled once the parent
+// context is cancelled.
+func WithSignalHandler(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	forceC := make(chan struct{})
+	ctx = context.WithValue(ctx, forceKey{}, (<-chan struct{})(forceC))
 	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		defer signal.Stop(sigC)
 		select {
-		case <-ctx.Done():
+		case <-parent.Done():
+			return
 		case <-sigC:
 			cancel()
 		}
+		select {
+		case <-parent.Done():
+		case <-sigC:
+			close(forceC)
+		}
 	}()
 	return ctx
 }
+
+type forceKey struct{}
+
+// Returns a channel which is closed when the user wants us to stop draining and quit now,
+// or nil if there's no WithSignalHandler() to tell us.
+func forceFrom(ctx context.Context) <-chan struct{} {
+	forceC, _ := ctx.Value(forceKey{}).(<-chan struct{})
+	return forceC
+}
+
+type identityKey struct{}
+
+// Attaches a verified client identity to a context.
+func WithIdentity(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// Returns the client identity attached to a context, or "" if there isn't one.
+func IdentityFrom(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
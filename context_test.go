@@ -0,0 +1,58 @@
+package pubd
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSignalHandler(t *testing.T) {
+	signal := func() {
+		proc, err := os.FindProcess(os.Getpid())
+		require.NoError(t, err)
+		require.NoError(t, proc.Signal(syscall.SIGTERM))
+	}
+	isClosed := func(c <-chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	t.Run("Parent Cancelled", func(t *testing.T) {
+		// The first signal.Notify() starts a goroutine of its own, which sticks around.
+		parent, cancel := context.WithCancel(context.Background())
+		WithSignalHandler(parent)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+
+		goroutines := runtime.NumGoroutine()
+		parent, cancel = context.WithCancel(context.Background())
+		ctx := WithSignalHandler(parent)
+		cancel()
+		assert.True(t, isClosed(ctx.Done()))
+
+		// The handler goroutine exits, rather than waiting for a signal forever.
+		for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	})
+
+	t.Run("Signals", func(t *testing.T) {
+		ctx := WithSignalHandler(context.Background())
+		signal()
+		assert.True(t, isClosed(ctx.Done()))
+		assert.False(t, isClosed(forceFrom(ctx)))
+		signal()
+		assert.True(t, isClosed(forceFrom(ctx)))
+	})
+}
@@ -0,0 +1,275 @@
+package pubd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// Settings from a per-directory config file, eg. ".pubd.toml", which apply to its directory and
+// everything below it. These are handed to whoever owns a directory, so anything that could
+// reach outside of it, like listen addresses or paths, doesn't belong here.
+type DirConfig struct {
+	// README files to include in directory listings; replaces any set further up.
+	READMEs []string `toml:"readme"`
+
+	// .gitignore patterns, relative to the config file's directory; added to any set further up.
+	// Applied by the filesystem itself, so they're left out of DirConfigOf()'s result.
+	Exclude []string `toml:"exclude"`
+
+	// Extra HTTP response headers for successful responses; merged with, and taking precedence
+	// over, any set further up. Only some headers are allowed, see ParseDirConfig().
+	Headers map[string]string `toml:"headers"`
+}
+
+// Headers a directory's owner may set; the rest could affect the whole origin (eg. Set-Cookie,
+// Strict-Transport-Security), or how files are interpreted (eg. Content-Type). Also allowed
+// are custom ones starting with "X-".
+var allowedDirConfigHeaders = map[string]bool{
+	"Cache-Control":    true,
+	"Content-Language": true,
+	"Expires":          true,
+	"Link":             true,
+}
+
+// Parses a per-directory config file. Unknown keys, and headers that aren't allowed, are errors.
+func ParseDirConfig(data []byte) (DirConfig, error) {
+	var cfg DirConfig
+	md, err := toml.Decode(string(data), &cfg)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			names[i] = key.String()
+		}
+		return DirConfig{}, fmt.Errorf("unknown key '%s'", strings.Join(names, "', '"))
+	}
+	for name := range cfg.Headers {
+		if !isHeaderName(name) {
+			return DirConfig{}, fmt.Errorf("headers: invalid header name: %q", name)
+		}
+		canon := textproto.CanonicalMIMEHeaderKey(name)
+		if !allowedDirConfigHeaders[canon] && !strings.HasPrefix(canon, "X-") {
+			return DirConfig{}, fmt.Errorf("headers: %s can't be set here; "+
+				"only Cache-Control, Content-Language, Expires, Link and X-* can", name)
+		}
+	}
+	return cfg, nil
+}
+
+// Returns whether s is a valid HTTP header name, ie. a non-empty RFC 7230 token.
+func isHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Cached config file from a single directory.
+type dirConfigEntry struct {
+	ignoreDir // For change detection; patterns are the config's exclusions.
+	cfg       DirConfig
+	err       error
+}
+
+// Reads, parses and caches per-directory config files; see FileSystemDirConfigs().
+// Like IgnoreFileFilter(), files are checked for changes at most every couple of seconds.
+type DirConfigs struct {
+	fs   billy.Filesystem
+	name string
+
+	mu   sync.Mutex
+	dirs map[string]*dirConfigEntry
+}
+
+// Returns a reader for config files with the given name (eg. ".pubd.toml") in fs, which should
+// be the unfiltered filesystem, or the config files themselves may be hidden.
+func NewDirConfigs(fs billy.Filesystem, name string) *DirConfigs {
+	return &DirConfigs{fs: fs, name: name, dirs: make(map[string]*dirConfigEntry)}
+}
+
+// Returns the merged settings for a directory, from the root down. An invalid config file in
+// the directory or any parent of it is an error.
+func (dcs *DirConfigs) Lookup(dir string) (DirConfig, error) {
+	segments := strings.Split(strings.Trim(path.Clean("/"+dir), "/"), "/")
+	if segments[0] == "" {
+		segments = nil
+	}
+	var out DirConfig
+	for i := 0; i <= len(segments); i++ {
+		e := dcs.entry(segments[:i])
+		if e.err != nil {
+			return DirConfig{}, e.err
+		}
+		out = out.merge(e.cfg)
+	}
+	return out, nil
+}
+
+// Returns cfg with next's settings applied on top, as if next were from a subdirectory.
+func (cfg DirConfig) merge(next DirConfig) DirConfig {
+	if next.READMEs != nil {
+		cfg.READMEs = next.READMEs
+	}
+	if len(next.Headers) > 0 {
+		headers := make(map[string]string, len(cfg.Headers)+len(next.Headers))
+		for k, v := range cfg.Headers {
+			headers[k] = v
+		}
+		for k, v := range next.Headers {
+			headers[k] = v
+		}
+		cfg.Headers = headers
+	}
+	cfg.Exclude = nil
+	return cfg
+}
+
+// Returns a filter which hides the config files themselves, and files they exclude. Everything
+// below a directory with an invalid config file is hidden, rather than risk serving files it
+// meant to exclude.
+func (dcs *DirConfigs) Filter() Filter {
+	return func(filename string, mode os.FileMode) bool {
+		segments := strings.Split(strings.Trim(path.Clean("/"+filename), "/"), "/")
+		if segments[0] == "" {
+			return true // The root directory is always allowed.
+		}
+		if segments[len(segments)-1] == dcs.name {
+			return false
+		}
+		var patterns []gitignore.Pattern
+		for i := 0; i < len(segments); i++ {
+			e := dcs.entry(segments[:i])
+			if e.err != nil {
+				return false
+			}
+			patterns = append(patterns, e.patterns...)
+		}
+		if len(patterns) == 0 {
+			return true
+		}
+		return !gitignore.NewMatcher(patterns).Match(segments, mode.IsDir())
+	}
+}
+
+// Returns the (possibly cached) config file for a directory.
+func (dcs *DirConfigs) entry(domain []string) *dirConfigEntry {
+	dir := "/" + path.Join(domain...)
+	filename := path.Join(dir, dcs.name)
+	now := time.Now()
+
+	dcs.mu.Lock()
+	defer dcs.mu.Unlock()
+
+	e := dcs.dirs[dir]
+	if e != nil && now.Sub(e.checkedAt) < ignoreFileTTL {
+		return e
+	}
+
+	stamps := []os.FileInfo{nil}
+	if info, err := dcs.fs.Stat(filename); err == nil && !info.IsDir() {
+		stamps[0] = info
+	}
+	if e != nil && !e.changed(stamps) {
+		e.checkedAt = now
+		return e
+	}
+
+	e = &dirConfigEntry{ignoreDir: ignoreDir{checkedAt: now, stamps: stamps}}
+	if stamps[0] != nil {
+		e.cfg, e.err = dcs.read(filename)
+		if e.err != nil {
+			e.err = fmt.Errorf("%s: %w", filename, e.err)
+		}
+
+		// The domain slice is shared with the caller, make sure patterns get their own copy.
+		domain = append([]string(nil), domain...)
+		for _, expr := range e.cfg.Exclude {
+			e.patterns = append(e.patterns, gitignore.ParsePattern(expr, domain))
+		}
+	}
+	dcs.dirs[dir] = e
+	return e
+}
+
+func (dcs *DirConfigs) read(filename string) (DirConfig, error) {
+	f, err := dcs.fs.Open(filename)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	return ParseDirConfig(data)
+}
+
+// Implemented by filesystems which carry per-directory configs along, ie. those returned by
+// FileSystemDirConfigs(), and wrappers around them, such as mounts; see DirConfigOf().
+type DirConfigFileSystem interface {
+	// Returns the merged settings for a directory.
+	DirConfig(dir string) (DirConfig, error)
+}
+
+// Filesystem wrapper which carries per-directory config files along; see DirConfigOf().
+type dirConfigFileSystem struct {
+	billy.Filesystem
+	dcs *DirConfigs
+	dir string // Where it's chrooted to, relative to dcs' root.
+}
+
+// Attaches per-directory configs to a filesystem, which should already be filtered through
+// dcs.Filter(). If fs carries configs of its own, eg. from a mount, dcs' take precedence.
+func FileSystemDirConfigs(fs billy.Filesystem, dcs *DirConfigs) billy.Filesystem {
+	return dirConfigFileSystem{fs, dcs, "/"}
+}
+
+func (fs dirConfigFileSystem) DirConfig(dir string) (DirConfig, error) {
+	inner, err := DirConfigOf(fs.Filesystem, dir)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	cfg, err := fs.dcs.Lookup(path.Join(fs.dir, dir))
+	if err != nil {
+		return DirConfig{}, err
+	}
+	return inner.merge(cfg), nil
+}
+
+func (fs dirConfigFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	inner, err := fs.Filesystem.Chroot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return dirConfigFileSystem{inner, fs.dcs, path.Join(fs.dir, dir)}, nil
+}
+
+func (fs dirConfigFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
+
+// Returns the merged settings for a directory in a filesystem which carries per-directory
+// configs along (see DirConfigFileSystem); for other filesystems, there are none.
+func DirConfigOf(fs billy.Filesystem, dir string) (DirConfig, error) {
+	if dfs, ok := fs.(DirConfigFileSystem); ok {
+		return dfs.DirConfig(dir)
+	}
+	return DirConfig{}, nil
+}
@@ -0,0 +1,135 @@
+package pubd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDirConfig(t *testing.T) {
+	testdata := map[string]struct {
+		In  string
+		Out DirConfig
+		Err string
+	}{
+		"Empty": {},
+		"Valid": {
+			In: "readme = [\"README\"]\nexclude = [\"*.tmp\"]\n\n[headers]\nCache-Control = \"no-cache\"\n",
+			Out: DirConfig{
+				READMEs: []string{"README"},
+				Exclude: []string{"*.tmp"},
+				Headers: map[string]string{"Cache-Control": "no-cache"},
+			},
+		},
+		"Unknown Keys": {
+			In:  "addr = \"0.0.0.0:80\"\npath = \"/\"\n",
+			Err: "unknown key 'addr', 'path'",
+		},
+		"Invalid Header": {
+			In:  "[headers]\n\"X-Evil\\r\\nSet-Cookie\" = \"1\"\n",
+			Err: "headers: invalid header name: \"X-Evil\\r\\nSet-Cookie\"",
+		},
+		"Forbidden Header": {
+			In:  "[headers]\ncontent-type = \"text/html\"\n",
+			Err: "headers: content-type can't be set here; only Cache-Control, Content-Language, Expires, Link and X-* can",
+		},
+		"Custom Header": {
+			In:  "[headers]\nx-robots-tag = \"noindex\"\n",
+			Out: DirConfig{Headers: map[string]string{"x-robots-tag": "noindex"}},
+		},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := ParseDirConfig([]byte(tdata.In))
+			if tdata.Err != "" {
+				assert.EqualError(t, err, tdata.Err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tdata.Out, cfg)
+			}
+		})
+	}
+}
+
+func TestFileSystemDirConfigs(t *testing.T) {
+	inner := memfs.New()
+	for filename, data := range map[string]string{
+		".pubd.toml":            "readme = [\"README\"]\nexclude = [\"*.tmp\"]\n[headers]\nX-A = \"root\"\nX-B = \"root\"\n",
+		"a.txt":                 "",
+		"a.tmp":                 "",
+		"sub/.pubd.toml":        "exclude = [\"/drafts\"]\n[headers]\nX-B = \"sub\"\n",
+		"sub/b.tmp":             "",
+		"sub/drafts/c.txt":      "",
+		"sub/deeper/drafts.txt": "",
+		"broken/.pubd.toml":     "addr = \"0.0.0.0:80\"\n",
+		"broken/secret.txt":     "",
+	} {
+		require.NoError(t, util.WriteFile(inner, filename, []byte(data), 0644))
+	}
+	dcs := NewDirConfigs(inner, ".pubd.toml")
+	fs := FileSystemDirConfigs(FileSystemFilter(inner, dcs.Filter()), dcs)
+
+	t.Run("Filter", func(t *testing.T) {
+		for filename, visible := range map[string]bool{
+			"/":                      true,
+			"/.pubd.toml":            false,
+			"/a.txt":                 true,
+			"/a.tmp":                 false,
+			"/sub":                   true,
+			"/sub/.pubd.toml":        false,
+			"/sub/b.tmp":             false,
+			"/sub/drafts":            false,
+			"/sub/drafts/c.txt":      false,
+			"/sub/deeper/drafts.txt": true,
+			"/broken":                true,
+			"/broken/secret.txt":     false,
+		} {
+			_, err := fs.Stat(filename)
+			if visible {
+				assert.NoError(t, err, filename)
+			} else {
+				assert.True(t, os.IsNotExist(err), "%s: %v", filename, err)
+			}
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		cfg, err := DirConfigOf(fs, "/")
+		require.NoError(t, err)
+		assert.Equal(t, DirConfig{
+			READMEs: []string{"README"},
+			Headers: map[string]string{"X-A": "root", "X-B": "root"},
+		}, cfg)
+
+		cfg, err = DirConfigOf(fs, "/sub/deeper")
+		require.NoError(t, err)
+		assert.Equal(t, DirConfig{
+			READMEs: []string{"README"},
+			Headers: map[string]string{"X-A": "root", "X-B": "sub"},
+		}, cfg)
+
+		_, err = DirConfigOf(fs, "/broken")
+		assert.EqualError(t, err, "/broken/.pubd.toml: unknown key 'addr'")
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		defer func(ttl time.Duration) { ignoreFileTTL = ttl }(ignoreFileTTL)
+		ignoreFileTTL = 0
+		require.NoError(t, util.WriteFile(inner, "broken/.pubd.toml", []byte("exclude = [\"*.pdf\"]\n"), 0644))
+		_, err := fs.Stat("/broken/secret.txt")
+		assert.NoError(t, err)
+		_, err = DirConfigOf(fs, "/broken")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Other Filesystems", func(t *testing.T) {
+		cfg, err := DirConfigOf(inner, "/")
+		assert.NoError(t, err)
+		assert.Equal(t, DirConfig{}, cfg)
+	})
+}
@@ -0,0 +1,89 @@
+package pubd
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Connections accepted from listeners opened by Listen(), so Serve() can count and close them
+// if they outstay their welcome when shutting down. Connections are tracked below any tls/ or
+// proxy/ wrappers, so servers still see those as usual.
+var conns struct {
+	sync.Mutex
+	open map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func trackConn(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn}
+	conns.Lock()
+	defer conns.Unlock()
+	if conns.open == nil {
+		conns.open = make(map[*trackedConn]struct{})
+	}
+	conns.open[c] = struct{}{}
+	return c
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		conns.Lock()
+		delete(conns.open, c)
+		conns.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Keep zero-copy sendfile() and half-closes working for the underlying connection.
+func (c *trackedConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Returns the number of open connections.
+func countConns() int {
+	conns.Lock()
+	defer conns.Unlock()
+	return len(conns.open)
+}
+
+// Closes all open connections, and returns how many there were.
+func closeConns() int {
+	conns.Lock()
+	open := make([]*trackedConn, 0, len(conns.open))
+	for c := range conns.open {
+		open = append(open, c)
+	}
+	conns.Unlock()
+	for _, c := range open {
+		c.Close()
+	}
+	return len(open)
+}
+
+// Tracks connections from a listener that isn't a trackedListener, eg. inetd/.
+type drainListener struct {
+	net.Listener
+}
+
+func (l drainListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return trackConn(conn), nil
+}
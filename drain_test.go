@@ -0,0 +1,140 @@
+package pubd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Accepts connections, and keeps them open until the client hangs up, regardless of ctx.
+func stubbornServer(acceptC chan<- struct{}) Server {
+	return ServerFunc(func(ctx context.Context, l net.Listener) error {
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return nil
+			}
+			acceptC <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	})
+}
+
+func TestServeDrain(t *testing.T) {
+	// Starts a stubborn server with a connection to it, then cancels ctx, and returns a channel
+	// for Serve()'s return value and one for the connection being closed.
+	serve := func(t *testing.T, ctx context.Context, sc ServeConfig) (net.Conn, <-chan error) {
+		ctx, cancel := context.WithCancel(ctx)
+		ls, err := Listen("127.0.0.1:0")
+		require.NoError(t, err)
+
+		acceptC := make(chan struct{}, 1)
+		errC := make(chan error, 1)
+		go func() { errC <- sc.Serve(ctx, ls, stubbornServer(acceptC)) }()
+		conn, err := net.Dial("tcp", ls[0].Addr().String())
+		require.NoError(t, err)
+		<-acceptC
+		cancel()
+		return conn, errC
+	}
+	connClosed := func(t *testing.T, conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	logged := func(logs *observer.ObservedLogs) map[string]int64 {
+		out := make(map[string]int64)
+		for _, entry := range logs.AllUntimed() {
+			out[entry.Message] = entry.ContextMap()["conns"].(int64)
+		}
+		return out
+	}
+
+	t.Run("Graceful", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		conn, errC := serve(t, context.Background(), ServeConfig{DrainTimeout: time.Minute, L: zap.New(core)})
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+		assert.NoError(t, <-errC)
+		assert.Equal(t, map[string]int64{"Draining connections": 1}, logged(logs))
+		assert.Equal(t, 0, countConns())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		conn, errC := serve(t, context.Background(), ServeConfig{DrainTimeout: 50 * time.Millisecond, L: zap.New(core)})
+		defer conn.Close()
+		assert.NoError(t, <-errC)
+		connClosed(t, conn)
+		assert.Equal(t, map[string]int64{
+			"Draining connections":                 1,
+			"Drain timed out, closing connections": 1,
+		}, logged(logs))
+		assert.Equal(t, 0, countConns())
+	})
+
+	t.Run("Forced", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		forceC := make(chan struct{})
+		ctx := context.WithValue(context.Background(), forceKey{}, (<-chan struct{})(forceC))
+		conn, errC := serve(t, ctx, ServeConfig{L: zap.New(core)})
+		defer conn.Close()
+
+		select {
+		case err := <-errC:
+			t.Fatalf("shouldn't return before being forced: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(forceC)
+		assert.NoError(t, <-errC)
+		connClosed(t, conn)
+		assert.Equal(t, map[string]int64{
+			"Draining connections":                 1,
+			"Shutdown forced, closing connections": 1,
+		}, logged(logs))
+	})
+}
+
+func TestTrackedConn(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l[0].Close()
+
+	client, err := net.Dial("tcp", l[0].Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l[0].Accept()
+	require.NoError(t, err)
+	assert.Equal(t, 1, countConns())
+
+	// Don't hide the underlying connection's sendfile() and half-close support.
+	_, ok := conn.(io.ReaderFrom)
+	assert.True(t, ok, "should be an io.ReaderFrom")
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 0, countConns())
+	assert.Error(t, conn.Close(), "closing twice should still error")
+}
@@ -2,8 +2,11 @@ package pubd
 
 import (
 	"os"
+	"path"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
@@ -14,13 +17,33 @@ func SortFileInfos(infos []os.FileInfo) {
 	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
 }
 
+// A filter is called with a path relative to the root of the filesystem, and the file's mode
+// (from Stat(), or Lstat() for Lstat() and Readlink()); it should return whether the file is
+// allowed. For files that don't exist yet, eg. for Create(), mode is the one it'd be created
+// with. Filters that only care about paths can use mode.IsDir().
+type Filter func(path string, mode os.FileMode) bool
+
+// Combines several filters into one, which only allows files allowed by all of them.
+func AllFilters(filters ...Filter) Filter {
+	return func(path string, mode os.FileMode) bool {
+		for _, filter := range filters {
+			if !filter(path, mode) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Filesystem wrapper which checks all paths against a filter. Join() and Root() are
+// the only methods passed straight through, as they don't touch any files.
 type filteredFileSystem struct {
 	billy.Filesystem
-	filter func(string, bool) bool
+	filter Filter
 }
 
 // Returns a filesystem which includes only files for which `filter` returns true.
-func FileSystemFilter(fs billy.Filesystem, filter func(string, bool) bool) billy.Filesystem {
+func FileSystemFilter(fs billy.Filesystem, filter Filter) billy.Filesystem {
 	return filteredFileSystem{fs, filter}
 }
 
@@ -29,7 +52,21 @@ func FileSystemExclude(fs billy.Filesystem, exprs []string) billy.Filesystem {
 	if len(exprs) == 0 {
 		return fs
 	}
+	return FileSystemFilter(fs, ExcludeFilter(exprs))
+}
+
+// Returns a filesystem which includes only files matching the given .gitignore expressions.
+// Use FileSystemFilter(fs, AllFilters(IncludeFilter(...), ExcludeFilter(...))) to combine
+// it with exclusions, in which case exclusions take precedence.
+func FileSystemInclude(fs billy.Filesystem, exprs []string) billy.Filesystem {
+	if len(exprs) == 0 {
+		return fs
+	}
+	return FileSystemFilter(fs, IncludeFilter(exprs))
+}
 
+// Parses .gitignore expressions into a matcher.
+func parsePatterns(exprs []string) gitignore.Matcher {
 	// The second argument here is the "domain" of the pattern, eg. the root directory under which
 	// it applies, as a slice of path segments ("/srv/www" -> ["srv", "www"]). In this case, we're
 	// working with a "chrooted" vfs, and only one set of patterns, so it's always "/" -> [] = nil.
@@ -37,53 +74,172 @@ func FileSystemExclude(fs billy.Filesystem, exprs []string) billy.Filesystem {
 	for i, expr := range exprs {
 		patterns[i] = gitignore.ParsePattern(expr, nil)
 	}
-	ignored := gitignore.NewMatcher(patterns)
+	return gitignore.NewMatcher(patterns)
+}
+
+// Returns a filter which rejects files matching the given .gitignore expressions.
+// With no expressions, everything is allowed.
+func ExcludeFilter(exprs []string) Filter {
+	ignored := parsePatterns(exprs)
+	return func(path string, mode os.FileMode) bool {
+		return !ignored.Match(strings.Split(strings.Trim(path, "/"), "/"), mode.IsDir())
+	}
+}
 
-	return FileSystemFilter(fs, func(path string, isDir bool) bool {
-		return !ignored.Match(strings.Split(strings.Trim(path, "/"), "/"), isDir)
-	})
+// Returns a filter which only allows files matching the given .gitignore expressions.
+// With no expressions, everything is allowed.
+//
+// Directories are also allowed if they could contain an included file, eg. "docs/**/*.pdf"
+// allows "/docs" and "/docs/a", but not "/src". Patterns without a slash, like "*.pdf",
+// can match at any depth, and thus allow all directories.
+func IncludeFilter(exprs []string) Filter {
+	if len(exprs) == 0 {
+		return func(string, os.FileMode) bool { return true }
+	}
+	included := parsePatterns(exprs)
+	return func(path string, mode os.FileMode) bool {
+		isDir := mode.IsDir()
+		segments := strings.Split(strings.Trim(path, "/"), "/")
+		if segments[0] == "" {
+			return true // The root directory is always allowed.
+		}
+		if included.Match(segments, isDir) {
+			return true
+		}
+		if isDir {
+			for _, expr := range exprs {
+				if includeMayMatchBelow(expr, segments) {
+					return true
+				}
+			}
+		}
+		return false
+	}
 }
 
-// Silly optimisations: try to evaluate the filter only once, and avoid hitting the disk
-// to stat() upfront if if wouldn't be allowed anyhow.
-func (fs filteredFileSystem) isAllowed(filename string) (bool, error) {
-	if fs.filter(filename, false) {
-		info, err := fs.Filesystem.Stat(filename)
-		return info != nil && (!info.IsDir() || fs.filter(filename, true)), err
-	} else if fs.filter(filename, true) {
-		info, err := fs.Filesystem.Stat(filename)
-		return info != nil && info.IsDir(), err
-	} else {
-		return false, nil
+// Returns whether an include pattern could match something below the given directory.
+func includeMayMatchBelow(expr string, dir []string) bool {
+	expr = strings.TrimRight(expr, "/")
+	if expr == "" || strings.HasPrefix(expr, "!") || strings.HasPrefix(expr, "#") {
+		return false
 	}
+	if !strings.Contains(expr, "/") {
+		return true // No slash = matches at any depth.
+	}
+	pattern := strings.Split(strings.TrimLeft(expr, "/"), "/")
+	for i, seg := range dir {
+		if i >= len(pattern)-1 {
+			return false // The last segment of the pattern must match a file below dir.
+		}
+		if pattern[i] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[i], seg); !ok {
+			return false
+		}
+	}
+	return true
 }
 
-func (fs filteredFileSystem) Open(filename string) (billy.File, error) {
-	isAllowed, err := fs.isAllowed(filename)
+// Stats a file and runs it through the filter. stat is either Stat or Lstat.
+// Returns ErrNotExist for disallowed files.
+func (fs filteredFileSystem) check(stat func(string) (os.FileInfo, error), filename string) error {
+	info, err := stat(filename)
 	if err != nil {
+		return err
+	} else if !fs.filter(filename, info.Mode()) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Like check(), but for paths which may not exist yet, eg. the target of Create().
+// Existing files are checked as usual, new ones are checked with the mode they'd be given.
+func (fs filteredFileSystem) checkNew(filename string, mode os.FileMode) error {
+	if err := fs.check(fs.Filesystem.Lstat, filename); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if !fs.filter(filename, mode) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (fs filteredFileSystem) Create(filename string) (billy.File, error) {
+	if err := fs.checkNew(filename, 0666); err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Create(filename)
+}
+
+func (fs filteredFileSystem) Open(filename string) (billy.File, error) {
+	if err := fs.check(fs.Filesystem.Stat, filename); err != nil {
 		return nil, err
-	} else if !isAllowed {
-		return nil, os.ErrNotExist
 	}
 	return fs.Filesystem.Open(filename)
 }
 
 func (fs filteredFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
-	isAllowed, err := fs.isAllowed(filename)
-	if err != nil {
+	if flag&os.O_CREATE != 0 {
+		if err := fs.checkNew(filename, perm); err != nil {
+			return nil, err
+		}
+	} else if err := fs.check(fs.Filesystem.Stat, filename); err != nil {
 		return nil, err
-	} else if !isAllowed {
-		return nil, os.ErrNotExist
 	}
 	return fs.Filesystem.OpenFile(filename, flag, perm)
 }
 
-func (fs filteredFileSystem) ReadDir(filename string) ([]os.FileInfo, error) {
-	isAllowed, err := fs.isAllowed(filename)
+func (fs filteredFileSystem) Stat(filename string) (os.FileInfo, error) {
+	if err := fs.check(fs.Filesystem.Stat, filename); err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Stat(filename)
+}
+
+func (fs filteredFileSystem) Rename(oldpath, newpath string) error {
+	if err := fs.check(fs.Filesystem.Lstat, oldpath); err != nil {
+		return err
+	}
+	info, err := fs.Filesystem.Lstat(oldpath)
 	if err != nil {
+		return err
+	}
+	if err := fs.checkNew(newpath, info.Mode()); err != nil {
+		return err
+	}
+	return fs.Filesystem.Rename(oldpath, newpath)
+}
+
+func (fs filteredFileSystem) Remove(filename string) error {
+	if err := fs.check(fs.Filesystem.Lstat, filename); err != nil {
+		return err
+	}
+	return fs.Filesystem.Remove(filename)
+}
+
+// TempFile picks its own filename, so we can only check it after the fact.
+func (fs filteredFileSystem) TempFile(dir, prefix string) (billy.File, error) {
+	if dir != "" {
+		if err := fs.check(fs.Filesystem.Stat, dir); err != nil {
+			return nil, err
+		}
+	}
+	f, err := fs.Filesystem.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.filter(f.Name(), 0600) {
+		f.Close()
+		fs.Filesystem.Remove(f.Name())
+		return nil, os.ErrPermission
+	}
+	return f, nil
+}
+
+func (fs filteredFileSystem) ReadDir(filename string) ([]os.FileInfo, error) {
+	if err := fs.check(fs.Filesystem.Stat, filename); err != nil {
 		return nil, err
-	} else if !isAllowed {
-		return nil, os.ErrNotExist
 	}
 	realInfos, err := fs.Filesystem.ReadDir(filename)
 	if err != nil {
@@ -91,9 +247,130 @@ func (fs filteredFileSystem) ReadDir(filename string) ([]os.FileInfo, error) {
 	}
 	filteredInfos := make([]os.FileInfo, 0, len(realInfos))
 	for _, info := range realInfos {
-		if fs.filter(info.Name(), info.IsDir()) {
+		if fs.filter(path.Join(filename, info.Name()), info.Mode()) {
 			filteredInfos = append(filteredInfos, info)
 		}
 	}
 	return filteredInfos, nil
 }
+
+func (fs filteredFileSystem) MkdirAll(filename string, perm os.FileMode) error {
+	if err := fs.checkNew(filename, os.ModeDir|perm); err != nil {
+		return err
+	}
+	return fs.Filesystem.MkdirAll(filename, perm)
+}
+
+func (fs filteredFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	if err := fs.check(fs.Filesystem.Lstat, filename); err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Lstat(filename)
+}
+
+func (fs filteredFileSystem) Symlink(target, link string) error {
+	if err := fs.checkNew(link, os.ModeSymlink|0777); err != nil {
+		return err
+	}
+	return fs.Filesystem.Symlink(target, link)
+}
+
+func (fs filteredFileSystem) Readlink(link string) (string, error) {
+	if err := fs.check(fs.Filesystem.Lstat, link); err != nil {
+		return "", err
+	}
+	return fs.Filesystem.Readlink(link)
+}
+
+// The chrooted filesystem is filtered as well, with paths relative to the original root.
+func (fs filteredFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	if err := fs.check(fs.Filesystem.Stat, dir); err != nil {
+		return nil, err
+	}
+	inner, err := fs.Filesystem.Chroot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return FileSystemFilter(inner, func(filename string, mode os.FileMode) bool {
+		return fs.filter(path.Join(dir, filename), mode)
+	}), nil
+}
+
+func (fs filteredFileSystem) DirConfig(dir string) (DirConfig, error) {
+	return DirConfigOf(fs.Filesystem, dir)
+}
+
+func (fs filteredFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
+
+// Returns a filter which only allows files that are readable by everyone, and directories that
+// are also executable by everyone, like ~/public_html with a classic httpd. All parents of a
+// file (including the root) must also be executable by everyone, else they can't be traversed.
+// Symlinks themselves are always allowed; their targets are checked when followed.
+//
+// fs is used to stat() parent directories, and should be the unfiltered filesystem. Like ignore
+// files, their modes are cached for a couple of seconds; a directory listing would otherwise
+// stat every parent again for each file in it.
+func PublicFilter(fs billy.Filesystem) Filter {
+	pf := &publicFilter{fs: fs, dirs: make(map[string]*publicDir)}
+	return pf.filter
+}
+
+type publicFilter struct {
+	fs billy.Filesystem
+
+	mu   sync.Mutex
+	dirs map[string]*publicDir
+}
+
+// Cached result for a directory: whether it and all its parents are executable by everyone.
+type publicDir struct {
+	checkedAt time.Time
+	ok        bool
+}
+
+func (pf *publicFilter) filter(filename string, mode os.FileMode) bool {
+	if mode&os.ModeSymlink == 0 && !isPublic(mode) {
+		return false
+	}
+	if filename = path.Clean("/" + filename); filename == "/" {
+		return true
+	}
+	return pf.traversable(path.Dir(filename), time.Now())
+}
+
+// Returns whether dir and all its parents are executable by everyone.
+func (pf *publicFilter) traversable(dir string, now time.Time) bool {
+	pf.mu.Lock()
+	d := pf.dirs[dir]
+	pf.mu.Unlock()
+	if d != nil && now.Sub(d.checkedAt) < ignoreFileTTL {
+		return d.ok
+	}
+
+	info, err := pf.fs.Stat(dir)
+	ok := err == nil && info.Mode().Perm()&0001 != 0
+	if ok && dir != "/" {
+		ok = pf.traversable(path.Dir(dir), now)
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	// Throw out stale entries, so the cache doesn't grow with every directory ever seen.
+	for name, d := range pf.dirs {
+		if now.Sub(d.checkedAt) >= ignoreFileTTL {
+			delete(pf.dirs, name)
+		}
+	}
+	pf.dirs[dir] = &publicDir{checkedAt: now, ok: ok}
+	return ok
+}
+
+// Returns whether a file is readable by others, and for directories, also executable.
+func isPublic(mode os.FileMode) bool {
+	if mode.IsDir() {
+		return mode.Perm()&0005 == 0005
+	}
+	return mode.Perm()&0004 == 0004
+}
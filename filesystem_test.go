@@ -3,10 +3,14 @@ package pubd
 import (
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-billy/v5/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -73,13 +77,36 @@ func TestFileSystemExclude(t *testing.T) {
 			"/subdir/about.html": false,
 		},
 	}
-	openers := map[string]func(billy.Basic, string) (billy.File, error){
-		"Open": func(fs billy.Basic, name string) (billy.File, error) {
+	openers := map[string]func(billy.Filesystem, string) (billy.File, error){
+		"Open": func(fs billy.Filesystem, name string) (billy.File, error) {
 			return fs.Open(name)
 		},
-		"OpenFile": func(fs billy.Basic, name string) (billy.File, error) {
+		"OpenFile": func(fs billy.Filesystem, name string) (billy.File, error) {
 			return fs.OpenFile(name, os.O_RDONLY, 0000)
 		},
+		"Stat": func(fs billy.Filesystem, name string) (billy.File, error) {
+			if _, err := fs.Stat(name); err != nil {
+				return nil, err
+			}
+			return fs.Open(name)
+		},
+		"Lstat": func(fs billy.Filesystem, name string) (billy.File, error) {
+			if _, err := fs.Lstat(name); err != nil {
+				return nil, err
+			}
+			return fs.Open(name)
+		},
+		"Chroot": func(fs billy.Filesystem, name string) (billy.File, error) {
+			dir, base := path.Split(name)
+			if dir == "" {
+				dir = "/"
+			}
+			cfs, err := fs.Chroot(dir)
+			if err != nil {
+				return nil, err
+			}
+			return cfs.Open(base)
+		},
 	}
 	for pattern, pathdata := range testdata {
 		t.Run(`"`+pattern+`"`, func(t *testing.T) {
@@ -111,3 +138,323 @@ func TestFileSystemExclude(t *testing.T) {
 		})
 	}
 }
+
+func TestFileSystemExcludeReadDir(t *testing.T) {
+	testdata := map[string]map[string][]string{
+		".*": {
+			"/":       {"about.html", "index.html", "subdir"},
+			"/subdir": {"about.html", "index.html"},
+		},
+		"index.html": {
+			"/":       {".git", "about.html", "subdir"},
+			"/subdir": {"about.html"},
+		},
+		"subdir": {
+			"/": {".git", "about.html", "index.html"},
+		},
+		"subdir/*.html": {
+			"/":       {".git", "about.html", "index.html", "subdir"},
+			"/subdir": {},
+		},
+		"/subdir/about.html": {
+			"/":       {".git", "about.html", "index.html", "subdir"},
+			"/subdir": {"index.html"},
+		},
+	}
+	for pattern, dirdata := range testdata {
+		t.Run(`"`+pattern+`"`, func(t *testing.T) {
+			baseFS := memfs.New()
+			require.NoError(t, baseFS.MkdirAll(".git", 0000))
+			for _, name := range []string{"/index.html", "/about.html", "/subdir/index.html", "/subdir/about.html"} {
+				require.NoError(t, util.WriteFile(baseFS, name, []byte(name), 0000))
+			}
+			fs := FileSystemExclude(baseFS, []string{pattern})
+
+			for dir, names := range dirdata {
+				t.Run(`"`+dir+`"`, func(t *testing.T) {
+					infos, err := fs.ReadDir(dir)
+					require.NoError(t, err)
+					SortFileInfos(infos)
+					actual := make([]string, len(infos))
+					for i, info := range infos {
+						actual[i] = info.Name()
+					}
+					assert.Equal(t, names, actual)
+				})
+			}
+		})
+	}
+}
+
+func TestFileSystemExcludeSymlink(t *testing.T) {
+	baseFS := memfs.New()
+	require.NoError(t, util.WriteFile(baseFS, "/secret.txt", []byte("secret"), 0000))
+	require.NoError(t, baseFS.Symlink("/secret.txt", "/link.txt"))
+	require.NoError(t, baseFS.Symlink("/secret.txt", "/secret.lnk"))
+	fs := FileSystemExclude(baseFS, []string{"secret.*"})
+
+	t.Run("Lstat", func(t *testing.T) {
+		_, err := fs.Lstat("/secret.lnk")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		info, err := fs.Lstat("/link.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "link.txt", info.Name())
+	})
+	t.Run("Readlink", func(t *testing.T) {
+		_, err := fs.Readlink("/secret.lnk")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		target, err := fs.Readlink("/link.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "/secret.txt", target)
+	})
+	t.Run("Symlink", func(t *testing.T) {
+		assert.True(t, os.IsNotExist(fs.Symlink("/link.txt", "/secret.new")), "should return ErrNotExist")
+		assert.NoError(t, fs.Symlink("/secret.txt", "/link.new"))
+	})
+}
+
+func TestFileSystemExcludeWrite(t *testing.T) {
+	mkFS := func(t *testing.T) (billy.Filesystem, billy.Filesystem) {
+		baseFS := memfs.New()
+		require.NoError(t, util.WriteFile(baseFS, "/secret.txt", []byte("secret"), 0666))
+		require.NoError(t, util.WriteFile(baseFS, "/public.txt", []byte("public"), 0666))
+		return baseFS, FileSystemExclude(baseFS, []string{"secret*"})
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		baseFS, fs := mkFS(t)
+		_, err := fs.Create("/secret.txt")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		_, err = fs.Create("/secret2.txt")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		_, err = baseFS.Stat("/secret2.txt")
+		assert.True(t, os.IsNotExist(err), "should not have been created")
+		f, err := fs.Create("/public2.txt")
+		require.NoError(t, err)
+		assert.NoError(t, f.Close())
+	})
+	t.Run("OpenFile", func(t *testing.T) {
+		_, fs := mkFS(t)
+		_, err := fs.OpenFile("/secret2.txt", os.O_CREATE|os.O_WRONLY, 0666)
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		f, err := fs.OpenFile("/public2.txt", os.O_CREATE|os.O_WRONLY, 0666)
+		require.NoError(t, err)
+		assert.NoError(t, f.Close())
+	})
+	t.Run("Remove", func(t *testing.T) {
+		baseFS, fs := mkFS(t)
+		assert.True(t, os.IsNotExist(fs.Remove("/secret.txt")), "should return ErrNotExist")
+		_, err := baseFS.Stat("/secret.txt")
+		assert.NoError(t, err, "should not have been removed")
+		assert.NoError(t, fs.Remove("/public.txt"))
+	})
+	t.Run("Rename", func(t *testing.T) {
+		_, fs := mkFS(t)
+		assert.True(t, os.IsNotExist(fs.Rename("/secret.txt", "/public2.txt")), "should return ErrNotExist")
+		assert.True(t, os.IsNotExist(fs.Rename("/public.txt", "/secret2.txt")), "should return ErrNotExist")
+		assert.NoError(t, fs.Rename("/public.txt", "/public2.txt"))
+	})
+	t.Run("MkdirAll", func(t *testing.T) {
+		_, fs := mkFS(t)
+		assert.True(t, os.IsNotExist(fs.MkdirAll("/secrets", 0777)), "should return ErrNotExist")
+		assert.NoError(t, fs.MkdirAll("/public", 0777))
+	})
+	t.Run("TempFile", func(t *testing.T) {
+		_, fs := mkFS(t)
+		_, err := fs.TempFile("/", "secret")
+		assert.True(t, os.IsPermission(err), "should return ErrPermission")
+		f, err := fs.TempFile("/", "public")
+		require.NoError(t, err)
+		assert.NoError(t, f.Close())
+	})
+}
+
+func TestFileSystemInclude(t *testing.T) {
+	testdata := map[string]map[string]bool{
+		"public/**": {
+			"/index.html":            false,
+			"/doc.pdf":               false,
+			"/public/index.html":     true,
+			"/public/sub/about.html": true,
+			"/private/doc.pdf":       false,
+		},
+		"*.pdf": {
+			"/index.html":            false,
+			"/doc.pdf":               true,
+			"/public/index.html":     false,
+			"/public/sub/about.html": false,
+			"/private/doc.pdf":       true,
+		},
+		"/public/sub": {
+			"/index.html":            false,
+			"/doc.pdf":               false,
+			"/public/index.html":     false,
+			"/public/sub/about.html": true,
+			"/private/doc.pdf":       false,
+		},
+	}
+	for pattern, pathdata := range testdata {
+		t.Run(`"`+pattern+`"`, func(t *testing.T) {
+			baseFS := memfs.New()
+			for path := range pathdata {
+				require.NoError(t, util.WriteFile(baseFS, path, []byte(path), 0000))
+			}
+			fs := FileSystemInclude(baseFS, []string{pattern})
+			for path, allowed := range pathdata {
+				t.Run(`"`+path+`"`, func(t *testing.T) {
+					f, err := fs.Open(path)
+					if !allowed {
+						assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+					} else {
+						require.NoError(t, err)
+						data, err := ioutil.ReadAll(f)
+						require.NoError(t, err)
+						assert.Equal(t, path, string(data))
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestIncludeFilterDirs(t *testing.T) {
+	testdata := map[string]map[string]bool{
+		"public/**":     {"/": true, "/public": true, "/public/sub": true, "/private": false},
+		"*.pdf":         {"/": true, "/public": true, "/public/sub": true, "/private": true},
+		"docs/*/*.pdf":  {"/": true, "/docs": true, "/docs/a": true, "/docs/a/b": false, "/src": false},
+		"/docs/**/*.md": {"/": true, "/docs": true, "/docs/a": true, "/docs/a/b": true, "/src": false},
+		"!docs/**":      {"/": true, "/docs": false, "/src": false},
+	}
+	for pattern, dirdata := range testdata {
+		t.Run(`"`+pattern+`"`, func(t *testing.T) {
+			filter := IncludeFilter([]string{pattern})
+			for dir, allowed := range dirdata {
+				assert.Equal(t, allowed, filter(dir, os.ModeDir), dir)
+			}
+		})
+	}
+}
+
+func TestFileSystemIncludeExclude(t *testing.T) {
+	baseFS := memfs.New()
+	for _, path := range []string{"/index.html", "/public/index.html", "/public/draft.html"} {
+		require.NoError(t, util.WriteFile(baseFS, path, []byte(path), 0000))
+	}
+	fs := FileSystemFilter(baseFS, AllFilters(
+		IncludeFilter([]string{"public/**"}),
+		ExcludeFilter([]string{"draft.*"}),
+	))
+
+	infos, err := fs.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "public", infos[0].Name())
+
+	infos, err = fs.ReadDir("/public")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "index.html", infos[0].Name())
+
+	_, err = fs.Stat("/public/draft.html")
+	assert.True(t, os.IsNotExist(err), "exclusions should take precedence")
+}
+
+func TestPublicFilter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	modes := []struct {
+		Path string
+		Mode os.FileMode
+	}{
+		{"/", 0755},
+		{"/public.txt", 0644},
+		{"/private.txt", 0600},
+		{"/dir", 0755},
+		{"/dir/public.txt", 0644},
+		{"/noread", 0711},
+		{"/noread/public.txt", 0644},
+		{"/noexec", 0744},
+		{"/noexec/public.txt", 0644},
+	}
+	for _, m := range modes {
+		p := filepath.Join(tmp, m.Path)
+		if filepath.Ext(p) == "" {
+			require.NoError(t, os.MkdirAll(p, 0755))
+		} else {
+			require.NoError(t, ioutil.WriteFile(p, []byte(m.Path), 0644))
+		}
+	}
+	for i := len(modes) - 1; i >= 0; i-- {
+		require.NoError(t, os.Chmod(filepath.Join(tmp, modes[i].Path), modes[i].Mode))
+	}
+	defer os.Chmod(filepath.Join(tmp, "noexec"), 0755)
+
+	baseFS, err := osfs.New("/").Chroot(tmp)
+	require.NoError(t, err)
+	fs := FileSystemFilter(baseFS, PublicFilter(baseFS))
+
+	testdata := map[string]bool{
+		"/public.txt":        true,
+		"/private.txt":       false,
+		"/dir":               true,
+		"/dir/public.txt":    true,
+		"/noread":            false,
+		"/noread/public.txt": true,
+		"/noexec":            false,
+	}
+	for path, allowed := range testdata {
+		t.Run(path, func(t *testing.T) {
+			_, err := fs.Stat(path)
+			if allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+			}
+		})
+	}
+
+	t.Run("Traversal", func(t *testing.T) {
+		filter := PublicFilter(baseFS)
+		assert.False(t, filter("/noexec/public.txt", 0644))
+		assert.True(t, filter("/dir/public.txt", 0644))
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		infos, err := fs.ReadDir("/")
+		require.NoError(t, err)
+		SortFileInfos(infos)
+		names := make([]string, len(infos))
+		for i, info := range infos {
+			names[i] = info.Name()
+		}
+		assert.Equal(t, []string{"dir", "public.txt"}, names)
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		countFS := &statCountingFS{Filesystem: baseFS, stats: map[string]int{}}
+		filter := PublicFilter(countFS)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			assert.True(t, filter("/dir/"+name, 0644))
+		}
+		assert.Equal(t, map[string]int{"/": 1, "/dir": 1}, countFS.stats)
+
+		defer func(ttl time.Duration) { ignoreFileTTL = ttl }(ignoreFileTTL)
+		ignoreFileTTL = 0
+		require.NoError(t, os.Chmod(filepath.Join(tmp, "dir"), 0744))
+		defer os.Chmod(filepath.Join(tmp, "dir"), 0755)
+		assert.False(t, filter("/dir/a.txt", 0644))
+	})
+}
+
+// Counts calls to Stat(), by filename.
+type statCountingFS struct {
+	billy.Filesystem
+	stats map[string]int
+}
+
+func (fs *statCountingFS) Stat(filename string) (os.FileInfo, error) {
+	fs.stats[filename]++
+	return fs.Filesystem.Stat(filename)
+}
@@ -0,0 +1,307 @@
+package pubd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"go.uber.org/zap"
+)
+
+var _ billy.Filesystem = &GitFileSystem{}
+
+// A read-only filesystem serving the tree of a git revision. The revision is resolved when
+// the filesystem is created, and again whenever Refresh() is called; branches can thus be
+// made to track new commits by calling Refresh() periodically, eg. using Watch().
+//
+// All files have the commit time as their modification time.
+type GitFileSystem struct {
+	readOnlyFS
+	repo *git.Repository
+	rev  string
+
+	// Repositories aren't safe for concurrent use, so this also guards all object access.
+	mu     sync.Mutex
+	commit *object.Commit
+	tree   *object.Tree
+}
+
+// Opens a git repository at path in fs, which may be a bare repository or a working copy
+// (with a .git directory, the contents of which are used, not the working copy).
+func OpenGitRepository(fs billy.Filesystem, path string) (*git.Repository, error) {
+	dotGit := fs.Join(path, git.GitDirName)
+	if info, err := fs.Stat(dotGit); err == nil && info.IsDir() {
+		path = dotGit
+	}
+	dotGitFS, err := fs.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(filesystem.NewStorage(dotGitFS, cache.NewObjectLRUDefault()), nil)
+}
+
+// Returns a filesystem serving the tree of rev (a branch, tag, commit, etc) in repo.
+func NewGitFileSystem(repo *git.Repository, rev string) (*GitFileSystem, error) {
+	fs := &GitFileSystem{repo: repo, rev: rev}
+	if _, err := fs.Refresh(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Re-resolves the revision. Returns whether it now points to a different commit.
+func (fs *GitFileSystem) Refresh() (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	hash, err := fs.repo.ResolveRevision(plumbing.Revision(fs.rev))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", fs.rev, err)
+	}
+	if fs.commit != nil && fs.commit.Hash == *hash {
+		return false, nil
+	}
+
+	commit, err := fs.repo.CommitObject(*hash)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", fs.rev, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", fs.rev, err)
+	}
+	fs.commit, fs.tree = commit, tree
+	return true, nil
+}
+
+// Calls Refresh() every interval until ctx expires. Does nothing if interval is zero.
+//
+// Signals are left to the caller, eg. WatchReload(), which can build a new GitFileSystem (or
+// call Refresh()) on SIGHUP.
+func (fs *GitFileSystem) Watch(ctx context.Context, L *zap.Logger, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fs.logRefresh(L)
+		}
+	}
+}
+
+func (fs *GitFileSystem) logRefresh(L *zap.Logger) {
+	if changed, err := fs.Refresh(); err != nil {
+		L.Error("Couldn't refresh git revision", zap.String("rev", fs.rev), zap.Error(err))
+	} else if changed {
+		L.Info("Git revision updated", zap.String("rev", fs.rev), zap.Stringer("commit", fs.Commit()))
+	}
+}
+
+// Returns the hash of the commit currently being served.
+func (fs *GitFileSystem) Commit() plumbing.Hash {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.commit.Hash
+}
+
+// Looks up a path in the tree, resolving symlinks along the way, like symlinkFileSystem.
+// If followLast is false, a symlink in the final segment is returned as-is.
+// The caller must hold fs.mu.
+func (fs *GitFileSystem) lookup(filename string, followLast bool) (*object.TreeEntry, error) {
+	tree := fs.tree
+	pending := splitPath(filename)
+	resolved := ""
+	entry := &object.TreeEntry{Mode: filemode.Dir, Hash: tree.Hash}
+	for hops := 0; len(pending) > 0; {
+		seg := pending[0]
+		pending = pending[1:]
+
+		if entry.Mode != filemode.Dir {
+			return nil, os.ErrNotExist
+		}
+		dir, err := fs.repo.TreeObject(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		var next *object.TreeEntry
+		for i := range dir.Entries {
+			if dir.Entries[i].Name == seg {
+				next = &dir.Entries[i]
+				break
+			}
+		}
+		if next == nil || next.Mode == filemode.Submodule {
+			return nil, os.ErrNotExist
+		}
+
+		if next.Mode != filemode.Symlink || (len(pending) == 0 && !followLast) {
+			entry = next
+			resolved = path.Join(resolved, seg)
+			continue
+		}
+
+		if hops++; hops > maxSymlinks {
+			return nil, fmt.Errorf("%s: too many levels of symbolic links", filename)
+		}
+		target, err := fs.readBlob(next.Hash)
+		if err != nil {
+			return nil, err
+		}
+		// Symlinks can't point outside of the repository, nor to absolute paths on the host.
+		linkPath := path.Join(resolved, string(target))
+		if path.IsAbs(string(target)) || linkPath == ".." || strings.HasPrefix(linkPath, "../") {
+			return nil, os.ErrNotExist
+		}
+		pending = append(splitPath(linkPath), pending...)
+		resolved = ""
+		entry = &object.TreeEntry{Mode: filemode.Dir, Hash: tree.Hash}
+	}
+	return entry, nil
+}
+
+func (fs *GitFileSystem) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := fs.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (fs *GitFileSystem) stat(filename string, followLast bool) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, err := fs.lookup(filename, followLast)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(path.Base(path.Clean("/"+filename)), entry)
+}
+
+// The caller must hold fs.mu.
+func (fs *GitFileSystem) fileInfo(name string, entry *object.TreeEntry) (os.FileInfo, error) {
+	info := fileInfo{name: name, modTime: fs.commit.Committer.When}
+	switch entry.Mode {
+	case filemode.Dir:
+		info.mode = os.ModeDir | 0755
+	case filemode.Executable:
+		info.mode = 0755
+	case filemode.Symlink:
+		info.mode = os.ModeSymlink | 0777
+	default:
+		info.mode = 0644
+	}
+	if !info.mode.IsDir() {
+		obj, err := fs.repo.Storer.EncodedObject(plumbing.BlobObject, entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		info.size = obj.Size()
+	}
+	return info, nil
+}
+
+// Blobs are read into memory in their entirety, as they need to be seekable.
+func (fs *GitFileSystem) Open(filename string) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, err := fs.lookup(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode == filemode.Dir {
+		return nil, fmt.Errorf("%s: is a directory", filename)
+	}
+	data, err := fs.readBlob(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{name: filename, readOnlyContents: bytes.NewReader(data)}, nil
+}
+
+func (fs *GitFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if fs.isWrite(flag) {
+		return nil, billy.ErrReadOnly
+	}
+	return fs.Open(filename)
+}
+
+func (fs *GitFileSystem) Stat(filename string) (os.FileInfo, error) {
+	return fs.stat(filename, true)
+}
+
+func (fs *GitFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	return fs.stat(filename, false)
+}
+
+func (fs *GitFileSystem) Readlink(link string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, err := fs.lookup(link, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.Mode != filemode.Symlink {
+		return "", fmt.Errorf("%s: not a symlink", link)
+	}
+	target, err := fs.readBlob(entry.Hash)
+	return string(target), err
+}
+
+func (fs *GitFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, err := fs.lookup(dirname, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode != filemode.Dir {
+		return nil, fmt.Errorf("%s: not a directory", dirname)
+	}
+	dir, err := fs.repo.TreeObject(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(dir.Entries))
+	for i, e := range dir.Entries {
+		if e.Mode == filemode.Submodule {
+			continue
+		}
+		info, err := fs.fileInfo(e.Name, &dir.Entries[i])
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (fs *GitFileSystem) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(fs, path), nil
+}
+
+func (fs *GitFileSystem) Join(elem ...string) string { return filepath.Join(elem...) }
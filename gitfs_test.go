@@ -0,0 +1,186 @@
+package pubd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Commits the given files to a repository at /repo in hostFS.
+func gitCommit(t *testing.T, hostFS billy.Filesystem, when time.Time, files map[string]string) {
+	wtFS, err := hostFS.Chroot("/repo")
+	require.NoError(t, err)
+	dotGitFS, err := hostFS.Chroot("/repo/.git")
+	require.NoError(t, err)
+	storage := filesystem.NewStorage(dotGitFS, cache.NewObjectLRUDefault())
+
+	repo, err := git.Open(storage, wtFS)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.Init(storage, wtFS)
+	}
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+
+	for name, contents := range files {
+		require.NoError(t, util.WriteFile(wtFS, name, []byte(contents), 0644))
+		_, err := wt.Add(name)
+		require.NoError(t, err)
+	}
+	sig := &object.Signature{Name: "pubd", Email: "pubd@example.com", When: when}
+	_, err = wt.Commit("commit", &git.CommitOptions{Author: sig, Committer: sig})
+	require.NoError(t, err)
+}
+
+func TestGitFileSystem(t *testing.T) {
+	hostFS := memfs.New()
+	t1 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	gitCommit(t, hostFS, t1, map[string]string{
+		"index.html":     "v1",
+		"docs/about.txt": "about",
+	})
+	// Files changed in the working copy shouldn't be visible.
+	require.NoError(t, util.WriteFile(hostFS, "/repo/index.html", []byte("dirty"), 0644))
+
+	repo, err := OpenGitRepository(hostFS, "/repo")
+	require.NoError(t, err)
+	fs, err := NewGitFileSystem(repo, "master")
+	require.NoError(t, err)
+
+	t.Run("Open", func(t *testing.T) {
+		f, err := fs.Open("/index.html")
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "v1", string(data))
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := fs.Stat("/docs/about.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "about.txt", info.Name())
+		assert.Equal(t, int64(5), info.Size())
+		assert.Equal(t, os.FileMode(0644), info.Mode())
+		assert.True(t, t1.Equal(info.ModTime()))
+
+		info, err = fs.Stat("/docs")
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = fs.Stat("/nope")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+		_, err = fs.Stat("/index.html/nope")
+		assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		infos, err := fs.ReadDir("/")
+		require.NoError(t, err)
+		SortFileInfos(infos)
+		require.Len(t, infos, 2)
+		assert.Equal(t, "docs", infos[0].Name())
+		assert.True(t, infos[0].IsDir())
+		assert.Equal(t, "index.html", infos[1].Name())
+	})
+
+	t.Run("Chroot", func(t *testing.T) {
+		docsFS, err := fs.Chroot("/docs")
+		require.NoError(t, err)
+		_, err = docsFS.Stat("/about.txt")
+		assert.NoError(t, err)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		_, err := fs.Create("/new.txt")
+		assert.Equal(t, billy.ErrReadOnly, err)
+		_, err = fs.OpenFile("/index.html", os.O_WRONLY, 0644)
+		assert.Equal(t, billy.ErrReadOnly, err)
+		assert.Equal(t, billy.ErrReadOnly, fs.Remove("/index.html"))
+		assert.Equal(t, billy.ErrReadOnly, fs.MkdirAll("/dir", 0755))
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		changed, err := fs.Refresh()
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		t2 := t1.Add(time.Hour)
+		gitCommit(t, hostFS, t2, map[string]string{"index.html": "v2"})
+		changed, err = fs.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		info, err := fs.Stat("/index.html")
+		require.NoError(t, err)
+		assert.True(t, t2.Equal(info.ModTime()))
+		f, err := fs.Open("/index.html")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "v2", string(data))
+	})
+
+	t.Run("Invalid Revision", func(t *testing.T) {
+		_, err := NewGitFileSystem(repo, "nope")
+		assert.Error(t, err)
+	})
+}
+
+func TestGitFileSystemSymlinks(t *testing.T) {
+	hostFS := memfs.New()
+	gitCommit(t, hostFS, time.Now(), map[string]string{"docs/about.txt": "about"})
+	for link, target := range map[string]string{
+		"/repo/about.txt":  "docs/about.txt",
+		"/repo/docs2":      "docs",
+		"/repo/escape.txt": "../secret.txt",
+		"/repo/abs.txt":    "/etc/passwd",
+	} {
+		require.NoError(t, hostFS.Symlink(target, link))
+	}
+	wtFS, err := hostFS.Chroot("/repo")
+	require.NoError(t, err)
+	dotGitFS, err := hostFS.Chroot("/repo/.git")
+	require.NoError(t, err)
+	gitRepo, err := git.Open(filesystem.NewStorage(dotGitFS, cache.NewObjectLRUDefault()), wtFS)
+	require.NoError(t, err)
+	wt, err := gitRepo.Worktree()
+	require.NoError(t, err)
+	_, err = wt.Add(".")
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "pubd", Email: "pubd@example.com", When: time.Now()}
+	_, err = wt.Commit("links", &git.CommitOptions{Author: sig, Committer: sig})
+	require.NoError(t, err)
+
+	repo, err := OpenGitRepository(hostFS, "/repo")
+	require.NoError(t, err)
+	fs, err := NewGitFileSystem(repo, "HEAD")
+	require.NoError(t, err)
+
+	_, err = fs.Stat("/about.txt")
+	assert.NoError(t, err)
+	_, err = fs.Stat("/docs2/about.txt")
+	assert.NoError(t, err)
+	_, err = fs.Stat("/escape.txt")
+	assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+	_, err = fs.Stat("/abs.txt")
+	assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+
+	info, err := fs.Lstat("/about.txt")
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+	target, err := fs.Readlink("/about.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/about.txt", target)
+}
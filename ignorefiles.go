@@ -0,0 +1,169 @@
+package pubd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"go.uber.org/zap"
+)
+
+// How often cached ignore files (and per-directory config files, and PublicFilter()'s parent
+// directories) are checked for changes.
+var ignoreFileTTL = 2 * time.Second
+
+// Cached patterns from the ignore files in a single directory.
+type ignoreDir struct {
+	checkedAt time.Time
+	stamps    []os.FileInfo // One per ignore file name; nil if it doesn't exist.
+	patterns  []gitignore.Pattern
+}
+
+// Returns whether the stamps (from stat()ing the ignore files) differ from the cached ones.
+func (d *ignoreDir) changed(stamps []os.FileInfo) bool {
+	for i, stamp := range stamps {
+		old := d.stamps[i]
+		if (old == nil) != (stamp == nil) {
+			return true
+		}
+		if stamp != nil && (!old.ModTime().Equal(stamp.ModTime()) || old.Size() != stamp.Size()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cached ignore files for a directory, or the error from reading them.
+type ignoreEntry struct {
+	ignoreDir
+	err error
+}
+
+type ignoreFiles struct {
+	L     *zap.Logger
+	fs    billy.Filesystem
+	names []string
+
+	mu   sync.Mutex
+	dirs map[string]*ignoreEntry
+}
+
+// Returns a filter which reads .gitignore-style files (eg. ".gitignore", ".pubdignore") from
+// each directory in fs, and rejects files they match, the way git does; patterns in a file
+// apply to its own directory and everything below it, and deeper files take precedence.
+// The ignore files themselves are hidden, and so is everything below a directory with an
+// ignore file that can't be read, rather than risk serving files it meant to exclude.
+//
+// Parsed files are cached, and checked for changes at most every couple of seconds.
+// fs should be the unfiltered filesystem, or the ignore files themselves may be hidden.
+func IgnoreFileFilter(L *zap.Logger, fs billy.Filesystem, names []string) Filter {
+	if len(names) == 0 {
+		return func(string, os.FileMode) bool { return true }
+	}
+	ign := &ignoreFiles{L: L, fs: fs, names: names, dirs: make(map[string]*ignoreEntry)}
+	return ign.filter
+}
+
+func (ign *ignoreFiles) filter(filename string, mode os.FileMode) bool {
+	segments := strings.Split(strings.Trim(path.Clean("/"+filename), "/"), "/")
+	if segments[0] == "" {
+		return true // The root directory is always allowed.
+	}
+	for _, name := range ign.names {
+		if segments[len(segments)-1] == name {
+			return false
+		}
+	}
+
+	// Collect patterns from the root down to the file's parent directory.
+	var patterns []gitignore.Pattern
+	for i := 0; i < len(segments); i++ {
+		e := ign.entry(segments[:i])
+		if e.err != nil {
+			return false
+		}
+		patterns = append(patterns, e.patterns...)
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	return !gitignore.NewMatcher(patterns).Match(segments, mode.IsDir())
+}
+
+// Returns the (possibly cached) ignore files for a directory.
+func (ign *ignoreFiles) entry(domain []string) *ignoreEntry {
+	dir := "/" + path.Join(domain...)
+	now := time.Now()
+
+	ign.mu.Lock()
+	defer ign.mu.Unlock()
+
+	e := ign.dirs[dir]
+	if e != nil && now.Sub(e.checkedAt) < ignoreFileTTL {
+		return e
+	}
+
+	var err error
+	stamps := make([]os.FileInfo, len(ign.names))
+	for i, name := range ign.names {
+		info, serr := ign.fs.Stat(path.Join(dir, name))
+		if serr == nil && !info.IsDir() {
+			stamps[i] = info
+		} else if serr != nil && !os.IsNotExist(serr) && err == nil {
+			err = fmt.Errorf("%s: %w", path.Join(dir, name), serr)
+		}
+	}
+	// Errors aren't reflected in the stamps, eg. after a chmod; always retry those.
+	if e != nil && e.err == nil && err == nil && !e.changed(stamps) {
+		e.checkedAt = now
+		return e
+	}
+
+	next := &ignoreEntry{ignoreDir: ignoreDir{checkedAt: now, stamps: stamps}, err: err}
+	for i, name := range ign.names {
+		if next.err != nil {
+			break
+		}
+		if stamps[i] != nil {
+			var patterns []gitignore.Pattern
+			patterns, next.err = ign.readIgnoreFile(path.Join(dir, name), domain)
+			next.patterns = append(next.patterns, patterns...)
+		}
+	}
+	if next.err != nil && (e == nil || e.err == nil || e.err.Error() != next.err.Error()) {
+		ign.L.Error("Couldn't read ignore file, hiding its directory", zap.Error(next.err))
+	}
+	ign.dirs[dir] = next
+	return next
+}
+
+// Reads an ignore file.
+func (ign *ignoreFiles) readIgnoreFile(filename string, domain []string) ([]gitignore.Pattern, error) {
+	f, err := ign.fs.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	// The domain slice is shared with the caller, make sure patterns get their own copy.
+	domain = append([]string(nil), domain...)
+
+	var patterns []gitignore.Pattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "#") && len(strings.TrimSpace(line)) > 0 {
+			patterns = append(patterns, gitignore.ParsePattern(line, domain))
+		}
+	}
+	return patterns, nil
+}
@@ -0,0 +1,109 @@
+package pubd
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestIgnoreFileFilter(t *testing.T) {
+	fs := memfs.New()
+	require.NoError(t, util.WriteFile(fs, "/.gitignore", []byte("# comment\n*.log\nbuild/\n"), 0644))
+	require.NoError(t, util.WriteFile(fs, "/.pubdignore", []byte("secret.txt\n"), 0644))
+	require.NoError(t, util.WriteFile(fs, "/sub/.gitignore", []byte("/local.txt\n!keep.log\n"), 0644))
+	filter := IgnoreFileFilter(zap.NewNop(), fs, []string{".gitignore", ".pubdignore"})
+
+	testdata := map[string]bool{
+		"/":                   true,
+		"/index.html":         true,
+		"/debug.log":          false,
+		"/secret.txt":         false,
+		"/local.txt":          true,
+		"/build/out.bin":      false,
+		"/sub/debug.log":      false,
+		"/sub/keep.log":       true,
+		"/sub/local.txt":      false,
+		"/sub/deep/local.txt": true,
+		"/sub/secret.txt":     false,
+		"/.gitignore":         false,
+		"/sub/.pubdignore":    false,
+	}
+	for path, allowed := range testdata {
+		assert.Equal(t, allowed, filter(path, 0), path)
+	}
+	assert.False(t, filter("/build", os.ModeDir), "/build")
+	assert.True(t, filter("/sub", os.ModeDir), "/sub")
+}
+
+func TestIgnoreFileFilterRefresh(t *testing.T) {
+	defer func(ttl time.Duration) { ignoreFileTTL = ttl }(ignoreFileTTL)
+	ignoreFileTTL = 0
+
+	fs := memfs.New()
+	filter := IgnoreFileFilter(zap.NewNop(), fs, []string{".pubdignore"})
+	assert.True(t, filter("/secret.txt", 0))
+
+	require.NoError(t, util.WriteFile(fs, "/.pubdignore", []byte("secret.txt\n"), 0644))
+	assert.False(t, filter("/secret.txt", 0))
+
+	require.NoError(t, util.WriteFile(fs, "/.pubdignore", []byte("other.txt\n"), 0644))
+	assert.True(t, filter("/secret.txt", 0))
+
+	require.NoError(t, fs.Remove("/.pubdignore"))
+	assert.True(t, filter("/other.txt", 0))
+}
+
+func TestIgnoreFileFilterNone(t *testing.T) {
+	filter := IgnoreFileFilter(zap.NewNop(), memfs.New(), nil)
+	assert.True(t, filter("/anything", 0))
+}
+
+// A filesystem which can't open a particular file.
+type unreadableFileSystem struct {
+	billy.Filesystem
+	name string
+}
+
+func (fs *unreadableFileSystem) Open(filename string) (billy.File, error) {
+	if filename == fs.name {
+		return nil, errors.New("permission denied")
+	}
+	return fs.Filesystem.Open(filename)
+}
+
+func TestIgnoreFileFilterUnreadable(t *testing.T) {
+	defer func(ttl time.Duration) { ignoreFileTTL = ttl }(ignoreFileTTL)
+	ignoreFileTTL = 0
+
+	inner := memfs.New()
+	require.NoError(t, util.WriteFile(inner, "/sub/.pubdignore", []byte("secret.txt\n"), 0644))
+	require.NoError(t, util.WriteFile(inner, "/other/file.txt", []byte("hi"), 0644))
+	fs := &unreadableFileSystem{inner, "/sub/.pubdignore"}
+	core, logs := observer.New(zap.InfoLevel)
+	filter := IgnoreFileFilter(zap.New(core), fs, []string{".pubdignore"})
+
+	// The directory itself is listed, but nothing in it.
+	assert.True(t, filter("/sub", os.ModeDir))
+	assert.False(t, filter("/sub/secret.txt", 0))
+	assert.False(t, filter("/sub/public.txt", 0))
+	assert.False(t, filter("/sub/deep/public.txt", 0))
+	assert.True(t, filter("/other/file.txt", 0))
+
+	// The error's logged once, not for every file.
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "/sub/.pubdignore: permission denied", logs.All()[0].ContextMap()["error"])
+
+	// Once it's readable again, it's used as usual.
+	fs.name = ""
+	assert.False(t, filter("/sub/secret.txt", 0))
+	assert.True(t, filter("/sub/public.txt", 0))
+}
@@ -0,0 +1,86 @@
+package pubd
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// A thin wrapper around an inotify instance, shared by the cache and Watcher.
+type inotify struct {
+	fd int
+	f  *os.File // Wraps fd; don't call Fd() on it, that'd make it blocking.
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type inotifyEvent struct {
+	wd     int32
+	mask   uint32
+	cookie uint32
+	name   string // Empty for events about the watched directory itself.
+}
+
+func newInotify() (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, so the runtime poller is used, and close() interrupts a pending read().
+	return &inotify{fd: fd, f: os.NewFile(uintptr(fd), "inotify")}, nil
+}
+
+func (in *inotify) addWatch(filename string, mask uint32) (int32, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return 0, os.ErrClosed
+	}
+	wd, err := syscall.InotifyAddWatch(in.fd, filename, mask)
+	if err != nil {
+		return 0, &os.PathError{Op: "inotify_add_watch", Path: filename, Err: err}
+	}
+	return int32(wd), nil
+}
+
+func (in *inotify) rmWatch(wd int32) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.closed {
+		syscall.InotifyRmWatch(in.fd, uint32(wd))
+	}
+}
+
+func (in *inotify) close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	return in.f.Close()
+}
+
+// Reads events until the instance is closed, calling fn with each batch.
+func (in *inotify) run(fn func([]inotifyEvent)) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := in.f.Read(buf)
+		if err != nil {
+			return err
+		}
+		var events []inotifyEvent
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+			events = append(events, inotifyEvent{
+				wd:     raw.Wd,
+				mask:   raw.Mask,
+				cookie: raw.Cookie,
+				name:   string(bytes.TrimRight(name, "\x00")),
+			})
+		}
+		fn(events)
+	}
+}
@@ -1,6 +1,7 @@
 package pubd
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
@@ -14,27 +15,104 @@ func SplitAddr(rawAddr string) (network, addr string) {
 	return "tcp", rawAddr
 }
 
+// Options for Listen. The zero value is valid, and equivalent to calling Listen().
+type ListenConfig struct {
+	TLS *tls.Config // Required for tls/ addresses, which are the only ones it's used for.
+
+	// Sources allowed to send PROXY headers; one is required for proxy/ addresses. Peers on unix
+	// sockets have no IP, and are only trusted with ProxyTrustUnix. See NewProxyListener().
+	ProxyTrusted   []*net.IPNet
+	ProxyTrustUnix bool
+}
+
 // Listens on an address. rawAddr can be an address (localhost, 127.0.0.1:1337), or a
 // network/address pair (tcp/localhost:1337, unix//tmp/pubd.sock).
 //
+// If we were started by Upgrade(), listeners handed over for the same address are reused.
+//
 // Special network types:
 // - systemd/:
 //   Use systemd socket activation. Returns an error if not running from a socket unit.
 //   The best way to avoid this is to add an explicit Requires= to the unit definition.
+//   systemd/<name> only uses sockets with a matching FileDescriptorName=, eg. systemd/http.
+// - fd/:
+//   Use file descriptors passed by a supervisor, eg. fd/3 or fd/3,4. See ListenFD().
+// - inetd/:
+//   Serve a single connection on stdin/stdout, as passed by inetd or systemd with Accept=yes.
+//   See ListenInetd().
+// - tls/:
+//   Wraps the listener(s) for the rest of the address in TLS, eg. tls/localhost:443 or
+//   tls/systemd/. Requires ListenConfig.TLS to be set.
+// - proxy/:
+//   Accepts PROXY protocol v1/v2 headers from trusted sources (eg. HAProxy), and reports the
+//   original client's address as the RemoteAddr(), eg. proxy/:8080 or tls/proxy/:443.
+//   Requires ListenConfig.ProxyTrusted or ProxyTrustUnix to be set.
 func Listen(rawAddr string) ([]net.Listener, error) {
+	return ListenConfig{}.Listen(rawAddr)
+}
+
+// Like Listen(), with options.
+func (lc ListenConfig) Listen(rawAddr string) ([]net.Listener, error) {
 	network, addr := SplitAddr(rawAddr)
+	if lc.TLS != nil && network != "tls" {
+		return nil, fmt.Errorf("listen/%s: TLS is configured, but this isn't a tls/ address", network)
+	}
 	switch network {
 	case "systemd": // systemd socket activation.
-		ls, err := ListenSystemd(network, addr)
+		ls, err := inheritOrListen(rawAddr, func() ([]net.Listener, error) { return ListenSystemd(network, addr) })
 		if err != nil {
 			return nil, fmt.Errorf("listen/%s: %w", network, err)
 		}
 		return ls, nil
+	case "fd": // Inherited file descriptors.
+		ls, err := inheritOrListen(rawAddr, func() ([]net.Listener, error) { return ListenFD(network, addr) })
+		if err != nil {
+			return nil, fmt.Errorf("listen/%s: %w", network, err)
+		}
+		return ls, nil
+	case "inetd": // A single connection on stdin/stdout.
+		ls, err := ListenInetd(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen/%s: %w", network, err)
+		}
+		for i, l := range ls {
+			ls[i] = drainListener{l}
+		}
+		return ls, nil
+	case "tls": // TLS, on top of any other kind of listener.
+		if lc.TLS == nil {
+			return nil, fmt.Errorf("listen/%s: no certificate configured", network)
+		}
+		inner := lc
+		inner.TLS = nil
+		ls, err := inner.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range ls {
+			ls[i] = tls.NewListener(l, lc.TLS)
+		}
+		return ls, nil
+	case "proxy": // PROXY protocol, on top of any other kind of listener.
+		if len(lc.ProxyTrusted) == 0 && !lc.ProxyTrustUnix {
+			return nil, fmt.Errorf("listen/%s: no trusted proxies configured", network)
+		}
+		ls, err := lc.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range ls {
+			ls[i] = NewProxyListener(l, lc.ProxyTrusted, lc.ProxyTrustUnix)
+		}
+		return ls, nil
 	default: // Regular ol' net.Listen().
-		l, err := net.Listen(network, addr)
+		ls, err := inheritOrListen(rawAddr, func() ([]net.Listener, error) {
+			l, err := net.Listen(network, addr)
+			return []net.Listener{l}, err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("listen/%s: %w", network, err)
 		}
-		return []net.Listener{l}, nil
+		return ls, nil
 	}
 }
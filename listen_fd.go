@@ -0,0 +1,160 @@
+package pubd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by the inetd listener's Accept() once its only connection has been served.
+var ErrListenerDone = errors.New("no more connections")
+
+// The inetd listener's connection; swappable for testing.
+var inetdStdin, inetdStdout = os.Stdin, os.Stdout
+
+// Listen on file descriptors passed by a supervisor, eg. s6, runit or inetd with "wait".
+//
+// network must be "fd". addr is a comma-separated list of file descriptor numbers,
+// eg. "3" or "3,4".
+func ListenFD(network, addr string) ([]net.Listener, error) {
+	if network != "fd" {
+		return nil, fmt.Errorf("expected network 'fd', not '%s'", network)
+	}
+	if addr == "" {
+		return nil, errors.New("no file descriptors given, try eg. fd/3")
+	}
+	var listeners []net.Listener
+	for _, s := range strings.Split(addr, ",") {
+		fd, err := strconv.ParseUint(s, 10, 31)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("invalid file descriptor: '%s'", s)
+		}
+		f := os.NewFile(uintptr(fd), "fd/"+s)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener() dup()s the file descriptor.
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("[%s]: %w", s, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(ls []net.Listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// Serves a single, already accepted connection on stdin/stdout, as passed by inetd ("nowait")
+// or systemd with Accept=yes. Accept() returns it once, then blocks until it's closed, and
+// returns ErrListenerDone; pubd.Serve() treats this as a clean shutdown.
+//
+// Note that inetd also connects stderr to the connection, so logs must go elsewhere.
+//
+// network must be "inetd". addr is reserved for future arguments and must be empty.
+func ListenInetd(network, addr string) ([]net.Listener, error) {
+	if network != "inetd" {
+		return nil, fmt.Errorf("expected network 'inetd', not '%s'", network)
+	}
+	if len(addr) > 0 {
+		return nil, fmt.Errorf("no arguments defined, but got '%s'", addr)
+	}
+
+	// If stdin is a socket, use it as-is; otherwise (eg. pipes), stitch stdin/stdout together.
+	var conn net.Conn
+	if c, err := net.FileConn(inetdStdin); err == nil {
+		conn = c
+	} else {
+		conn = stdioConn{inetdStdin, inetdStdout}
+	}
+	l := &inetdListener{addr: conn.LocalAddr(), doneC: make(chan struct{})}
+	l.conn = &inetdConn{Conn: conn, l: l}
+	return []net.Listener{l}, nil
+}
+
+type inetdListener struct {
+	addr  net.Addr
+	mu    sync.Mutex
+	conn  net.Conn // Nil once accepted.
+	once  sync.Once
+	doneC chan struct{}
+}
+
+func (l *inetdListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.doneC
+	return nil, ErrListenerDone
+}
+
+// Stops Accept() from blocking; it doesn't affect an accepted connection.
+func (l *inetdListener) Close() error {
+	l.once.Do(func() { close(l.doneC) })
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (l *inetdListener) Addr() net.Addr { return l.addr }
+
+// Closes the listener when closed.
+type inetdConn struct {
+	net.Conn
+	l *inetdListener
+}
+
+func (c *inetdConn) Close() error {
+	err := c.Conn.Close()
+	c.l.once.Do(func() { close(c.l.doneC) })
+	return err
+}
+
+// A connection made out of stdin/stdout, when they aren't a socket.
+type stdioConn struct {
+	in, out *os.File
+}
+
+func (c stdioConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c stdioConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (c stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (c stdioConn) Close() error {
+	err := c.in.Close()
+	if err2 := c.out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (c stdioConn) SetDeadline(t time.Time) error {
+	if err := c.in.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.out.SetWriteDeadline(t)
+}
+func (c stdioConn) SetReadDeadline(t time.Time) error  { return c.in.SetReadDeadline(t) }
+func (c stdioConn) SetWriteDeadline(t time.Time) error { return c.out.SetWriteDeadline(t) }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
@@ -0,0 +1,150 @@
+package pubd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a new file descriptor for a listener.
+func listenerFD(t *testing.T) (*net.TCPListener, *os.File) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	return l.(*net.TCPListener), f
+}
+
+func TestListenFD(t *testing.T) {
+	l1, f1 := listenerFD(t)
+	defer l1.Close()
+	l2, f2 := listenerFD(t)
+	defer l2.Close()
+
+	ls, err := Listen("fd/" + strconv.Itoa(int(f1.Fd())) + "," + strconv.Itoa(int(f2.Fd())))
+	require.NoError(t, err)
+	require.Len(t, ls, 2)
+	for i, orig := range []net.Listener{l1, l2} {
+		defer ls[i].Close()
+		assert.Equal(t, orig.Addr().String(), ls[i].Addr().String())
+
+		conn, err := net.Dial("tcp", ls[i].Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+		conn, err = ls[i].Accept()
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		notASocket, err := ioutil.TempFile("", "pubd-")
+		require.NoError(t, err)
+		defer os.Remove(notASocket.Name())
+		defer notASocket.Close()
+
+		_, err = Listen("fd/")
+		assert.EqualError(t, err, "listen/fd: no file descriptors given, try eg. fd/3")
+		_, err = Listen("fd/three")
+		assert.EqualError(t, err, "listen/fd: invalid file descriptor: 'three'")
+		_, err = Listen("fd/-1")
+		assert.EqualError(t, err, "listen/fd: invalid file descriptor: '-1'")
+		fd := strconv.Itoa(int(notASocket.Fd()))
+		_, err = Listen("fd/" + fd)
+		assert.Error(t, err)
+	})
+}
+
+// Runs a Serve() on an inetd listener, which says "hi" to anyone who connects.
+func serveInetd(t *testing.T) (net.Addr, <-chan error) {
+	ls, err := Listen("inetd/")
+	require.NoError(t, err)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- Serve(context.Background(), ls, ServerFunc(func(ctx context.Context, l net.Listener) error {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return err
+				}
+				conn.Write([]byte("hi " + conn.RemoteAddr().Network()))
+				conn.Close()
+			}
+		}))
+	}()
+	return ls[0].Addr(), errC
+}
+
+func TestListenInetd(t *testing.T) {
+	defer func(in, out *os.File) { inetdStdin, inetdStdout = in, out }(inetdStdin, inetdStdout)
+
+	t.Run("Socket", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		client, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		f, err := conn.(*net.TCPConn).File()
+		require.NoError(t, err)
+		conn.Close()
+		inetdStdin, inetdStdout = f, f
+
+		addr, errC := serveInetd(t)
+		f.Close() // Our copy; the listener dup()s it.
+		assert.Equal(t, l.Addr().String(), addr.String())
+		data, err := ioutil.ReadAll(client)
+		require.NoError(t, err)
+		assert.Equal(t, "hi tcp", string(data))
+		assert.NoError(t, <-errC)
+	})
+
+	t.Run("Pipes", func(t *testing.T) {
+		inR, inW, err := os.Pipe()
+		require.NoError(t, err)
+		defer inW.Close()
+		outR, outW, err := os.Pipe()
+		require.NoError(t, err)
+		defer outR.Close()
+		inetdStdin, inetdStdout = inR, outW
+
+		addr, errC := serveInetd(t)
+		assert.Equal(t, "stdio", addr.String())
+		data, err := ioutil.ReadAll(outR)
+		require.NoError(t, err)
+		assert.Equal(t, "hi stdio", string(data))
+		assert.NoError(t, <-errC)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		inR, inW, err := os.Pipe()
+		require.NoError(t, err)
+		defer inW.Close()
+		outR, outW, err := os.Pipe()
+		require.NoError(t, err)
+		defer outR.Close()
+		inetdStdin, inetdStdout = inR, outW
+
+		// Closing the listener before the connection is accepted closes the connection too.
+		ls, err := Listen("inetd/")
+		require.NoError(t, err)
+		require.NoError(t, ls[0].Close())
+		_, err = ls[0].Accept()
+		assert.Equal(t, ErrListenerDone, err)
+		data, err := ioutil.ReadAll(outR)
+		require.NoError(t, err)
+		assert.Empty(t, data)
+	})
+
+	t.Run("Arguments", func(t *testing.T) {
+		_, err := Listen("inetd/blah")
+		assert.EqualError(t, err, "listen/inetd: no arguments defined, but got 'blah'")
+	})
+}
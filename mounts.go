@@ -0,0 +1,294 @@
+package pubd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+type mountFileSystem struct {
+	readOnlyFS
+	mounts map[string]billy.Filesystem // Keyed by root-relative path, eg. "docs/api".
+	paths  []string                    // Keys of mounts, longest first.
+}
+
+// Returns a filesystem which serves each of the given filesystems under a virtual path, like
+// mount points. The virtual directories leading up to the mount points are read-only, and
+// list only the mount points below them; everything else is handled by the mounted filesystems.
+//
+// Mount points are given as slash-separated paths, eg. "/docs" or "/pub/releases", and may be
+// nested inside each other. A mount at "/" is used to serve everything not covered by others.
+func FileSystemMounts(mounts map[string]billy.Filesystem) billy.Filesystem {
+	fs := mountFileSystem{mounts: make(map[string]billy.Filesystem, len(mounts))}
+	for mpath, mfs := range mounts {
+		mpath = path.Join(splitPath(mpath)...)
+		fs.mounts[mpath] = mfs
+		fs.paths = append(fs.paths, mpath)
+	}
+	sort.Slice(fs.paths, func(i, j int) bool { return len(fs.paths[i]) > len(fs.paths[j]) })
+	return fs
+}
+
+// Returns the mount point filename is on, if any.
+func (fs mountFileSystem) mountPoint(filename string) (string, bool) {
+	rpath := path.Join(splitPath(filename)...)
+	for _, mpath := range fs.paths {
+		if mpath == "" || rpath == mpath || strings.HasPrefix(rpath, mpath+"/") {
+			return mpath, true
+		}
+	}
+	return "", false
+}
+
+// Returns the filesystem filename is mounted on, and its path relative to it. Returns a nil
+// filesystem if the path isn't on any mount.
+func (fs mountFileSystem) resolve(filename string) (billy.Filesystem, string) {
+	mpath, ok := fs.mountPoint(filename)
+	if !ok {
+		return nil, ""
+	}
+	rpath := path.Join(splitPath(filename)...)
+	return fs.mounts[mpath], "/" + strings.TrimPrefix(strings.TrimPrefix(rpath, mpath), "/")
+}
+
+// Returns the names of the mount points and virtual directories directly inside dirname,
+// or nil if dirname isn't a virtual directory.
+func (fs mountFileSystem) children(dirname string) []string {
+	rpath := path.Join(splitPath(dirname)...)
+	var names []string
+	seen := make(map[string]bool)
+	for _, mpath := range fs.paths {
+		var rest string
+		if rpath == "" {
+			rest = mpath
+		} else if strings.HasPrefix(mpath, rpath+"/") {
+			rest = mpath[len(rpath)+1:]
+		} else {
+			continue
+		}
+		if rest == "" {
+			continue
+		}
+		name := strings.SplitN(rest, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if names == nil && rpath == "" {
+		return []string{} // The root always exists.
+	}
+	return names
+}
+
+// Returns information about a mount point or virtual directory.
+func (fs mountFileSystem) stat(filename string) (os.FileInfo, error) {
+	name := path.Base(path.Clean("/" + filename))
+	if mfs, rpath := fs.resolve(filename); mfs != nil {
+		info, err := mfs.Stat(rpath)
+		if err == nil {
+			// The root of the mounted filesystem may not know what it's mounted as.
+			return fileInfo{name: name, size: info.Size(), mode: info.Mode(), modTime: info.ModTime()}, nil
+		}
+		// Directories leading up to a nested mount exist, even if they don't on the outer one.
+		if !os.IsNotExist(err) || fs.children(filename) == nil {
+			return nil, err
+		}
+	} else if fs.children(filename) == nil {
+		return nil, os.ErrNotExist
+	}
+	return fileInfo{name: name, mode: os.ModeDir | 0555, modTime: time.Unix(0, 0)}, nil
+}
+
+// Returns the error for an operation that would modify filename, outside of any mounts;
+// virtual directories are read-only, and nothing else exists.
+func (fs mountFileSystem) virtual(filename string) error {
+	if fs.children(filename) != nil || fs.children(path.Dir(path.Clean("/"+filename))) != nil {
+		return billy.ErrReadOnly
+	}
+	return os.ErrNotExist
+}
+
+func (fs mountFileSystem) Create(filename string) (billy.File, error) {
+	if mfs, rpath := fs.resolve(filename); mfs != nil {
+		return mfs.Create(rpath)
+	}
+	return nil, fs.virtual(filename)
+}
+
+func (fs mountFileSystem) Open(filename string) (billy.File, error) {
+	if mfs, rpath := fs.resolve(filename); mfs != nil {
+		return mfs.Open(rpath)
+	}
+	if fs.children(filename) == nil {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("%s: is a directory", filename)
+}
+
+func (fs mountFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if mfs, rpath := fs.resolve(filename); mfs != nil {
+		return mfs.OpenFile(rpath, flag, perm)
+	}
+	if fs.isWrite(flag) {
+		return nil, fs.virtual(filename)
+	}
+	return fs.Open(filename)
+}
+
+func (fs mountFileSystem) Stat(filename string) (os.FileInfo, error) {
+	return fs.stat(filename)
+}
+
+// Symlinks can't be mounted, so this is the same as Stat() for mount points themselves.
+func (fs mountFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	if mfs, rpath := fs.resolve(filename); mfs != nil && rpath != "/" {
+		return mfs.Lstat(rpath)
+	}
+	return fs.stat(filename)
+}
+
+func (fs mountFileSystem) Readlink(link string) (string, error) {
+	if mfs, rpath := fs.resolve(link); mfs != nil {
+		return mfs.Readlink(rpath)
+	}
+	if fs.children(link) == nil {
+		return "", os.ErrNotExist
+	}
+	return "", fmt.Errorf("%s: not a symlink", link)
+}
+
+// Renaming files between different mounts isn't supported, like across filesystems.
+func (fs mountFileSystem) Rename(oldpath, newpath string) error {
+	oldFS, oldRPath := fs.resolve(oldpath)
+	newFS, newRPath := fs.resolve(newpath)
+	oldMount, _ := fs.mountPoint(oldpath)
+	newMount, _ := fs.mountPoint(newpath)
+	if oldFS == nil {
+		return fs.virtual(oldpath)
+	} else if newFS == nil {
+		return fs.virtual(newpath)
+	} else if oldMount != newMount {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return oldFS.Rename(oldRPath, newRPath)
+}
+
+func (fs mountFileSystem) Remove(filename string) error {
+	if mfs, rpath := fs.resolve(filename); mfs != nil && rpath != "/" {
+		return mfs.Remove(rpath)
+	}
+	return fs.virtual(filename)
+}
+
+func (fs mountFileSystem) MkdirAll(filename string, perm os.FileMode) error {
+	if mfs, rpath := fs.resolve(filename); mfs != nil {
+		return mfs.MkdirAll(rpath, perm)
+	}
+	if fs.children(filename) != nil {
+		return nil // It already exists.
+	}
+	return fs.virtual(filename)
+}
+
+func (fs mountFileSystem) Symlink(target, link string) error {
+	if mfs, rpath := fs.resolve(link); mfs != nil {
+		return mfs.Symlink(target, rpath)
+	}
+	return fs.virtual(link)
+}
+
+func (fs mountFileSystem) TempFile(dir, prefix string) (billy.File, error) {
+	if mfs, rpath := fs.resolve(dir); mfs != nil {
+		return mfs.TempFile(rpath, prefix)
+	}
+	return nil, fs.virtual(dir)
+}
+
+func (fs mountFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	names := fs.children(dirname)
+	var infos []os.FileInfo
+	if mfs, rpath := fs.resolve(dirname); mfs != nil {
+		var err error
+		if infos, err = mfs.ReadDir(rpath); err != nil && (!os.IsNotExist(err) || names == nil) {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return infos, nil
+		}
+	} else if names == nil {
+		return nil, os.ErrNotExist
+	}
+
+	// Mount points hide whatever's in their place on the filesystem they're nested in.
+	hidden := make(map[string]bool, len(names))
+	for _, name := range names {
+		hidden[name] = true
+	}
+	merged := make([]os.FileInfo, 0, len(infos)+len(names))
+	for _, info := range infos {
+		if !hidden[info.Name()] {
+			merged = append(merged, info)
+		}
+	}
+	for _, name := range names {
+		// Leave out mounts that can't be stat()ed, eg. because their directory is missing.
+		if info, err := fs.stat(path.Join("/", dirname, name)); err == nil {
+			merged = append(merged, info)
+		}
+	}
+	SortFileInfos(merged)
+	return merged, nil
+}
+
+// Chrooting into a mounted filesystem returns a chroot of it; otherwise, the result has the
+// mounts below dir, relative to it.
+func (fs mountFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	rdir := path.Join(splitPath(dir)...)
+	mounts := make(map[string]billy.Filesystem)
+	for mpath, mfs := range fs.mounts {
+		if rdir == "" {
+			mounts[mpath] = mfs
+		} else if strings.HasPrefix(mpath, rdir+"/") {
+			mounts[mpath[len(rdir)+1:]] = mfs
+		}
+	}
+	if mfs, rpath := fs.resolve(dir); mfs != nil {
+		inner, err := mfs.Chroot(rpath)
+		if err != nil {
+			return nil, err
+		}
+		if len(mounts) == 0 {
+			return inner, nil
+		}
+		mounts[""] = inner
+	} else if fs.children(dir) == nil {
+		return nil, os.ErrNotExist
+	}
+	return FileSystemMounts(mounts), nil
+}
+
+// Virtual directories have no configs; mounted ones have their filesystem's.
+func (fs mountFileSystem) DirConfig(dir string) (DirConfig, error) {
+	if mfs, rpath := fs.resolve(dir); mfs != nil {
+		return DirConfigOf(mfs, rpath)
+	}
+	return DirConfig{}, nil
+}
+
+func (fs mountFileSystem) Capabilities() billy.Capability {
+	caps := fs.readOnlyFS.Capabilities()
+	for _, mfs := range fs.mounts {
+		caps |= billy.Capabilities(mfs)
+	}
+	return caps
+}
+
+func (fs mountFileSystem) Join(elem ...string) string { return filepath.Join(elem...) }
@@ -0,0 +1,89 @@
+package pubd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSystemMounts(t *testing.T) {
+	docs, releases, api := memfs.New(), memfs.New(), memfs.New()
+	require.NoError(t, util.WriteFile(docs, "index.html", []byte("docs"), 0644))
+	require.NoError(t, util.WriteFile(docs, "api/hidden.html", []byte("hidden"), 0644))
+	require.NoError(t, util.WriteFile(releases, "v1.0.tar.gz", []byte("v1.0"), 0644))
+	require.NoError(t, util.WriteFile(api, "index.html", []byte("api"), 0644))
+	fs := FileSystemMounts(map[string]billy.Filesystem{
+		"/docs":         docs,
+		"/docs/api":     api,
+		"/pub/releases": releases,
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		testdata := map[string]string{
+			"/docs/index.html":                "docs",
+			"docs/api/index.html":             "api",
+			"/pub/releases/v1.0.tar.gz":       "v1.0",
+			"/pub/../docs/../docs/index.html": "docs",
+		}
+		for name, content := range testdata {
+			t.Run(name, func(t *testing.T) {
+				assert.Equal(t, content, readFile(t, fs, name))
+			})
+		}
+
+		t.Run("/docs/api/hidden.html", func(t *testing.T) {
+			_, err := fs.Open("/docs/api/hidden.html")
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+		t.Run("/missing.txt", func(t *testing.T) {
+			_, err := fs.Open("/missing.txt")
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		for _, name := range []string{"/", "/pub", "/docs", "/docs/api"} {
+			t.Run(name, func(t *testing.T) {
+				info, err := fs.Stat(name)
+				require.NoError(t, err)
+				assert.True(t, info.IsDir())
+			})
+		}
+		info, err := fs.Stat("/pub/releases")
+		require.NoError(t, err)
+		assert.Equal(t, "releases", info.Name())
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		assert.Equal(t, []string{"docs", "pub"}, readDirNames(t, fs, "/"))
+		assert.Equal(t, []string{"releases"}, readDirNames(t, fs, "/pub"))
+		assert.Equal(t, []string{"api", "index.html"}, readDirNames(t, fs, "/docs"))
+		assert.Equal(t, []string{"index.html"}, readDirNames(t, fs, "/docs/api"))
+	})
+
+	t.Run("Chroot", func(t *testing.T) {
+		pub, err := fs.Chroot("/pub")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"releases"}, readDirNames(t, pub, "/"))
+
+		d, err := fs.Chroot("/docs")
+		require.NoError(t, err)
+		assert.Equal(t, "api", readFile(t, d, "/api/index.html"))
+		assert.Equal(t, "docs", readFile(t, d, "/index.html"))
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		require.NoError(t, util.WriteFile(fs, "/docs/new.html", []byte("new"), 0644))
+		assert.Equal(t, "new", readFile(t, docs, "/new.html"))
+
+		_, err := fs.Create("/pub/new.html")
+		assert.Equal(t, billy.ErrReadOnly, err)
+		assert.Equal(t, billy.ErrReadOnly, fs.Remove("/pub/releases"))
+		assert.Error(t, fs.Rename("/docs/new.html", "/pub/releases/new.html"))
+	})
+}
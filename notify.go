@@ -0,0 +1,43 @@
+package pubd
+
+import (
+	"context"
+	"time"
+)
+
+// States for Notify(); see sd_notify(3).
+const (
+	NotifyReady     = "READY=1"     // Startup or a reload is finished.
+	NotifyReloading = "RELOADING=1" // Reloading configuration; follow up with NotifyReady.
+	NotifyStopping  = "STOPPING=1"  // Shutting down gracefully.
+	NotifyWatchdog  = "WATCHDOG=1"  // Still alive; see Watchdog().
+)
+
+// Tells the service manager we're reloading while fn runs, and ready again afterwards.
+func NotifyReload(fn func()) {
+	Notify(NotifyReloading)
+	defer Notify(NotifyReady)
+	fn()
+}
+
+// Pings the service manager's watchdog, at half the interval it expects, until ctx expires
+// or WithUpgradeHandler() has handed the service over to a new process.
+// Does nothing if the watchdog isn't enabled, eg. with WatchdogSec= in a systemd unit.
+func Watchdog(ctx context.Context) error {
+	interval, err := WatchdogInterval()
+	if err != nil || interval <= 0 {
+		return err
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if ok, err := notifyUnlessHandedOver(ctx, NotifyWatchdog); !ok || err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/liclac/pubd"
 )
 
 // Ensures that the prefix for WithPrefix has a leading '/', but not a trailing one.
@@ -73,7 +75,7 @@ func (rw *accessLogResponseWriter) WriteHeader(statusCode int) {
 	rw.RW.WriteHeader(statusCode)
 }
 
-// Logs all requests and response codes.
+// Logs all requests and response codes, with the client's address and identity, if any.
 func WithAccessLog(L *zap.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw_ http.ResponseWriter, req *http.Request) {
 		rw := accessLogResponseWriter{RW: rw_, StatusCode: http.StatusOK}
@@ -85,7 +87,11 @@ func WithAccessLog(L *zap.Logger, next http.Handler) http.Handler {
 		}
 		if ce := L.Check(level, ""); ce != nil {
 			ce.Message = req.Method + " " + req.URL.Path
-			ce.Write(zap.Int("status", rw.StatusCode))
+			fields := []zap.Field{zap.String("addr", req.RemoteAddr), zap.Int("status", rw.StatusCode)}
+			if id := pubd.IdentityFrom(req.Context()); id != "" {
+				fields = append(fields, zap.String("identity", id))
+			}
+			ce.Write(fields...)
 		}
 	})
 }
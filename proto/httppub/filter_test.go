@@ -1,11 +1,18 @@
 package httppub
 
 import (
+	"crypto/x509"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liclac/pubd/testutil"
 )
 
 func TestCleanPrefix(t *testing.T) {
@@ -53,3 +60,30 @@ func TestWithPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestWithAccessLog(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	handler := WithIdentity(WithAccessLog(zap.New(core),
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/" {
+				http.NotFound(rw, req)
+			}
+		})))
+
+	client, err := testutil.NewCert("alice", nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "https://example.com/missing", nil)
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{client.Cert}}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "GET /", entries[0].Message)
+	assert.Equal(t, map[string]interface{}{"addr": "192.0.2.1:1234", "status": int64(200)}, entries[0].ContextMap())
+	assert.Equal(t, "GET /missing", entries[1].Message)
+	assert.Equal(t, zapcore.WarnLevel, entries[1].Level)
+	assert.Equal(t, map[string]interface{}{"addr": "192.0.2.1:1234", "status": int64(404), "identity": "alice"}, entries[1].ContextMap())
+}
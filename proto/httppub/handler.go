@@ -1,6 +1,7 @@
 package httppub
 
 import (
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -37,6 +38,20 @@ func handle(L *zap.Logger, rw http.ResponseWriter, req *http.Request, fs billy.F
 		return nil
 	}
 
+	// Add headers from per-directory config files, if any; see pubd.DirConfig.
+	dir := req.URL.Path
+	if !isDir {
+		dir = path.Dir(dir)
+	}
+	dcfg, err := pubd.DirConfigOf(fs, dir)
+	if err != nil {
+		L.Warn("Invalid directory config", zap.Error(err))
+		return err
+	}
+	if len(dcfg.Headers) > 0 {
+		rw = &headerResponseWriter{ResponseWriter: rw, headers: dcfg.Headers}
+	}
+
 	if isDir {
 		// If we have an indexer, render an index.
 		if idx != nil {
@@ -102,3 +117,38 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 	w.Header().Set("Location", newPath)
 	w.WriteHeader(http.StatusMovedPermanently)
 }
+
+// http.ResponseWriter wrapper which adds headers to successful (2xx or 304) responses only, so
+// eg. a Cache-Control header doesn't make an error stick around.
+type headerResponseWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (rw *headerResponseWriter) WriteHeader(statusCode int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		if (statusCode >= 200 && statusCode < 300) || statusCode == http.StatusNotModified {
+			for name, value := range rw.headers {
+				rw.ResponseWriter.Header().Set(name, value)
+			}
+		}
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *headerResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Don't hide the underlying ResponseWriter's sendfile() support from http.ServeContent().
+func (rw *headerResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(rw.ResponseWriter, r)
+}
@@ -1,6 +1,8 @@
 package httppub
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -12,6 +14,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+
+	"github.com/liclac/pubd"
 )
 
 func TestHandlerNoIndex(t *testing.T) {
@@ -142,3 +146,92 @@ func Test_redirectForCanon(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerArchiveRange(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, method := range map[string]uint16{"stored.txt": zip.Store, "deflated.txt": zip.Deflate} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		require.NoError(t, err)
+		_, err = w.Write([]byte("0123456789"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	fs := memfs.New()
+	require.NoError(t, util.WriteFile(fs, "/bundle.zip", buf.Bytes(), 0644))
+	srv := httptest.NewServer(Handler(zap.NewNop(), pubd.FileSystemArchives(fs, pubd.SymlinksFollow, 0), SimpleIndex(IndexConfig{})))
+	defer srv.Close()
+
+	for _, name := range []string{"stored.txt", "deflated.txt"} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL+"/bundle.zip/"+name, nil)
+			require.NoError(t, err)
+			req.Header.Set("Range", "bytes=3-5")
+			rsp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusPartialContent, rsp.StatusCode)
+			body, err := ioutil.ReadAll(rsp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "345", string(body))
+		})
+	}
+
+	t.Run("Index", func(t *testing.T) {
+		rsp, err := http.Get(srv.URL + "/bundle.zip/")
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "deflated.txt\nstored.txt\n", string(body))
+	})
+}
+
+func TestHandlerDirConfig(t *testing.T) {
+	inner := memfs.New()
+	for filename, data := range map[string]string{
+		".pubd.toml":        "[headers]\nCache-Control = \"no-cache\"\n",
+		"a.txt":             "a",
+		"README":            "top-level readme",
+		"sub/.pubd.toml":    "readme = [\"ABOUT\"]\n[headers]\nCache-Control = \"max-age=60\"\n",
+		"sub/ABOUT":         "about sub",
+		"sub/README":        "not this one",
+		"broken/.pubd.toml": "nope = 1\n",
+	} {
+		require.NoError(t, util.WriteFile(inner, filename, []byte(data), 0644))
+	}
+	dcs := pubd.NewDirConfigs(inner, ".pubd.toml")
+	fs := pubd.FileSystemDirConfigs(pubd.FileSystemFilter(inner, dcs.Filter()), dcs)
+	srv := httptest.NewServer(Handler(zap.NewNop(), fs, SimpleIndex(IndexConfig{READMEs: []string{"README"}})))
+	defer srv.Close()
+
+	testdata := map[string]struct {
+		Status       int
+		CacheControl string
+		ContentType  string
+		Body         string
+	}{
+		"/":           {200, "no-cache", "text/plain; charset=utf-8", "README\na.txt\nbroken/\nsub/\n\ntop-level readme"},
+		"/a.txt":      {200, "no-cache", "text/plain; charset=utf-8", "a"},
+		"/.pubd.toml": {404, "", "text/plain; charset=utf-8", "404 Not Found\n"},
+		"/sub/":       {200, "max-age=60", "text/plain; charset=utf-8", "ABOUT\nREADME\n\nabout sub"},
+		"/sub/ABOUT":  {200, "max-age=60", "text/plain; charset=utf-8", "about sub"},
+		"/sub/nope":   {404, "", "text/plain; charset=utf-8", "404 Not Found\n"},
+		"/broken/":    {500, "", "text/plain; charset=utf-8", "500 Internal Server Error\n"},
+	}
+	for path, tdata := range testdata {
+		t.Run(path, func(t *testing.T) {
+			rsp, err := http.Get(srv.URL + path)
+			require.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, tdata.Status, rsp.StatusCode)
+			assert.Equal(t, tdata.CacheControl, rsp.Header.Get("Cache-Control"))
+			assert.Equal(t, tdata.ContentType, rsp.Header.Get("Content-Type"))
+			body, err := ioutil.ReadAll(rsp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tdata.Body, string(body))
+		})
+	}
+}
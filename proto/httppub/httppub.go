@@ -4,12 +4,14 @@ import (
 	"context"
 	"net"
 	"net/http"
+
+	"github.com/liclac/pubd"
 )
 
 // Serves HTTP requests until the context terminates, then closes the
 // listener in order to shut down gracefully.
 func Serve(ctx context.Context, l net.Listener, h http.Handler) error {
-	srv := http.Server{Handler: h}
+	srv := http.Server{Handler: WithIdentity(h)}
 	go func() {
 		<-ctx.Done()
 		srv.Shutdown(context.Background())
@@ -19,3 +21,40 @@ func Serve(ctx context.Context, l net.Listener, h http.Handler) error {
 	}
 	return nil
 }
+
+// Attaches verified TLS client identities to request contexts; see pubd.IdentityFrom().
+func WithIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			if id := pubd.TLSIdentity(*req.TLS); id != "" {
+				req = req.WithContext(pubd.WithIdentity(req.Context(), id))
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// An http.Handler which can be replaced while serving, eg. after reloading configuration.
+// Requests in flight finish with the handler they started with; each handler's done func (see
+// pubd.WatchReload()) is called once it's been replaced, and its last request has finished.
+type SwapHandler struct {
+	gens pubd.Generations
+}
+
+func NewSwapHandler(h http.Handler, done func()) *SwapHandler {
+	var sh SwapHandler
+	sh.Swap(h, done)
+	return &sh
+}
+
+func (sh *SwapHandler) Swap(h http.Handler, done func()) { sh.gens.Swap(h, done) }
+
+// Calls the current handler's done func once its last request has finished; call this once
+// the server's stopped.
+func (sh *SwapHandler) Close() { sh.gens.Close() }
+
+func (sh *SwapHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h, release := sh.gens.Acquire()
+	defer release()
+	h.(http.Handler).ServeHTTP(rw, req)
+}
@@ -0,0 +1,49 @@
+package httppub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwapHandler(t *testing.T) {
+	say := func(s string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(s))
+		})
+	}
+	get := func(h http.Handler) string {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw.Body.String()
+	}
+
+	var done []string
+	h := NewSwapHandler(say("old"), func() { done = append(done, "old") })
+	assert.Equal(t, "old", get(h))
+	h.Swap(http.NotFoundHandler(), nil) // A different type.
+	assert.Equal(t, "404 page not found\n", get(h))
+	assert.Equal(t, []string{"old"}, done)
+
+	// A request in flight keeps its handler around until it finishes.
+	started, finish := make(chan struct{}), make(chan struct{})
+	h.Swap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-finish
+		rw.Write([]byte("slow"))
+	}), func() { done = append(done, "slow") })
+	slowC := make(chan string)
+	go func() { slowC <- get(h) }()
+	<-started
+	h.Swap(say("new"), func() { done = append(done, "new") })
+	assert.Equal(t, "new", get(h))
+	assert.Equal(t, []string{"old"}, done)
+	close(finish)
+	assert.Equal(t, "slow", <-slowC)
+	assert.Equal(t, []string{"old", "slow"}, done)
+
+	h.Close()
+	assert.Equal(t, []string{"old", "slow", "new"}, done)
+}
@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 
 	"github.com/go-git/go-billy/v5"
+
+	"github.com/liclac/pubd"
 )
 
 type IndexConfig struct {
@@ -44,6 +46,15 @@ func (idx simpleIndex) Render(rw http.ResponseWriter, req *http.Request, fs bill
 		fmt.Fprintf(rw, "<pre>\n")
 	}
 
+	// Per-directory config files can pick their own READMEs.
+	readmes := idx.READMEs
+	if dcfg, _ := pubd.DirConfigOf(fs, req.URL.Path); dcfg.READMEs != nil {
+		readmes = make(map[string]bool, len(dcfg.READMEs))
+		for _, filename := range dcfg.READMEs {
+			readmes[filename] = true
+		}
+	}
+
 	// Print a directory listing.
 	foundREADME := ""
 	for _, info := range infos {
@@ -51,7 +62,7 @@ func (idx simpleIndex) Render(rw http.ResponseWriter, req *http.Request, fs bill
 		switch {
 		case info.IsDir():
 			name += "/"
-		case idx.READMEs[name]:
+		case readmes[name]:
 			foundREADME = name
 		}
 
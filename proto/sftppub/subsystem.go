@@ -109,11 +109,16 @@ func (h Handler) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 		}
 		return listerAt{info}, nil
 	case "Readlink":
+		// The request server replies with the Name() of the first FileInfo as the target.
 		info, err := h.FS.Lstat(req.Filepath)
 		if err != nil {
 			return nil, h.handleErr(req, err)
 		}
-		return listerAt{info}, nil
+		target, err := h.FS.Readlink(req.Filepath)
+		if err != nil {
+			return nil, h.handleErr(req, err)
+		}
+		return listerAt{linkInfo{info, target}}, nil
 	default:
 		return nil, sftp.ErrSshFxOpUnsupported
 	}
@@ -131,3 +136,11 @@ func (f listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 	}
 	return n, nil
 }
+
+// FileInfo for a symlink, with its target as its name, for Readlink requests.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (i linkInfo) Name() string { return i.target }
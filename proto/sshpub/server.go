@@ -15,6 +15,7 @@ import (
 )
 
 var _ pubd.Server = Server{}
+var _ pubd.Server = &SwapServer{}
 
 // A subsystem offered by the SSH session's 'subsystem' command.
 type Subsystem interface {
@@ -34,9 +35,41 @@ func New(L *zap.Logger, hostKey ssh.Signer) Server {
 }
 
 func (s Server) Serve(ctx context.Context, l net.Listener) error {
-	cfg := ssh.ServerConfig{NoClientAuth: true}
-	cfg.AddHostKey(s.HostKey)
+	return serve(ctx, l, func() (Server, func()) { return s, func() {} })
+}
+
+// A Server whose settings can be replaced while it's running, eg. after reloading configuration.
+// New connections use the latest settings; existing ones keep theirs. Each Server's done func
+// (see pubd.WatchReload()) is called once it's been replaced, and its last connection is closed.
+type SwapServer struct {
+	gens pubd.Generations
+}
+
+func NewSwapServer(s Server, done func()) *SwapServer {
+	var ss SwapServer
+	ss.Swap(s, done)
+	return &ss
+}
+
+func (ss *SwapServer) Swap(s Server, done func()) { ss.gens.Swap(s, done) }
+
+// Calls the current Server's done func once its last connection is closed; call this once
+// Serve() has returned.
+func (ss *SwapServer) Close() { ss.gens.Close() }
+
+// Returns the current Server, and a func to call once finished with it.
+func (ss *SwapServer) Acquire() (Server, func()) {
+	s, release := ss.gens.Acquire()
+	return s.(Server), release
+}
 
+func (ss *SwapServer) Serve(ctx context.Context, l net.Listener) error {
+	return serve(ctx, l, ss.Acquire)
+}
+
+// Accepts connections on l, serving each with whatever get() returns at the time, and releasing
+// it once the connection is closed.
+func serve(ctx context.Context, l net.Listener, get func() (Server, func())) error {
 	// Make sure the listener doesn't leak if we error out.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -65,9 +98,14 @@ func (s Server) Serve(ctx context.Context, l net.Listener) error {
 			}
 		}
 
+		s, release := get()
+		cfg := ssh.ServerConfig{NoClientAuth: true}
+		cfg.AddHostKey(s.HostKey)
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer release()
 			s.ServeConn(ctx, nConn, cfg)
 		}()
 	}
@@ -76,6 +114,18 @@ func (s Server) Serve(ctx context.Context, l net.Listener) error {
 func (s *Server) ServeConn(ctx context.Context, nConn net.Conn, cfg ssh.ServerConfig) {
 	L := s.L.With(zap.Stringer("addr", nConn.RemoteAddr()))
 
+	// If we're behind a tls/ listener, identify the client by its certificate.
+	id, err := pubd.ConnIdentity(nConn)
+	if err != nil {
+		nConn.Close()
+		L.Warn("TLS handshake failed", zap.Error(err))
+		return
+	}
+	if id != "" {
+		L = L.With(zap.String("identity", id))
+		ctx = pubd.WithIdentity(ctx, id)
+	}
+
 	// Log authentication attempts.
 	authL := L.Named("auth")
 	cfg.AuthLogCallback = func(meta ssh.ConnMetadata, method string, err error) {
@@ -0,0 +1,78 @@
+package pubd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"go.uber.org/zap"
+)
+
+// Returns the default configuration for a service speaking a protocol, which its section of a
+// config file is decoded into, eg. [http]. See RegisterProtocol().
+type Protocol func() ServiceConfig
+
+// Configuration for a service; see Protocol.
+type ServiceConfig interface {
+	// Addresses to listen on; see Listen(). The service is disabled if there are none.
+	ListenAddrs() []string
+
+	// Returns a Server which serves fs. hostFS is the host's filesystem, eg. for loading keys.
+	// ctx and done are a generation's, see WatchReload(); done is called once fs is unused.
+	Server(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, done func()) (SwappableServer, error)
+}
+
+// A Server which can take over another one's configuration while it's running, eg. on reload.
+type SwappableServer interface {
+	Server
+
+	// Serves new requests or connections with next's configuration; next must be from the same
+	// protocol, and isn't served itself. Ones in progress finish with the old configuration,
+	// whose done func is called once they have.
+	Swap(next SwappableServer)
+
+	// Calls the current configuration's done func once it's no longer in use; call this once
+	// Serve() has returned.
+	Close()
+}
+
+var protocols struct {
+	sync.Mutex
+	m map[string]Protocol
+}
+
+// Makes a protocol available by name, eg. to the pubd command's config file. Typically called
+// from an init() function. Panics if the name is already taken.
+func RegisterProtocol(name string, p Protocol) {
+	protocols.Lock()
+	defer protocols.Unlock()
+	if _, ok := protocols.m[name]; ok {
+		panic(fmt.Sprintf("pubd: protocol registered twice: %s", name))
+	}
+	if protocols.m == nil {
+		protocols.m = make(map[string]Protocol)
+	}
+	protocols.m[name] = p
+}
+
+// Returns a registered protocol.
+func LookupProtocol(name string) (Protocol, bool) {
+	protocols.Lock()
+	defer protocols.Unlock()
+	p, ok := protocols.m[name]
+	return p, ok
+}
+
+// Returns the names of all registered protocols, in alphabetical order.
+func Protocols() []string {
+	protocols.Lock()
+	defer protocols.Unlock()
+	names := make([]string, 0, len(protocols.m))
+	for name := range protocols.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
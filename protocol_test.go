@@ -0,0 +1,38 @@
+package pubd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type testServiceConfig struct{ Addrs []string }
+
+func (c *testServiceConfig) ListenAddrs() []string { return c.Addrs }
+
+func (c *testServiceConfig) Server(ctx context.Context, L *zap.Logger, hostFS, fs billy.Filesystem, done func()) (SwappableServer, error) {
+	return nil, nil
+}
+
+func TestRegisterProtocol(t *testing.T) {
+	defer func(m map[string]Protocol) { protocols.m = m }(protocols.m)
+	protocols.m = nil
+
+	newTest := func() ServiceConfig { return &testServiceConfig{} }
+	RegisterProtocol("test-b", newTest)
+	RegisterProtocol("test-a", newTest)
+	assert.Equal(t, []string{"test-a", "test-b"}, Protocols())
+
+	p, ok := LookupProtocol("test-a")
+	assert.True(t, ok)
+	assert.Equal(t, &testServiceConfig{}, p())
+	_, ok = LookupProtocol("test-c")
+	assert.False(t, ok)
+
+	assert.PanicsWithValue(t, "pubd: protocol registered twice: test-a", func() {
+		RegisterProtocol("test-a", newTest)
+	})
+}
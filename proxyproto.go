@@ -0,0 +1,259 @@
+package pubd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a trusted proxy gets to send a PROXY header, before the connection is failed.
+var proxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Parses CIDRs or bare IPs, eg. for ListenConfig.ProxyTrusted.
+func ParseCIDRs(ss []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: '%s'", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Wraps a listener, such that connections from trusted sources must start with a PROXY protocol
+// (v1 or v2) header, which is used for the connections' RemoteAddr() and LocalAddr(). Untrusted
+// connections are passed through untouched, and any header they send is treated as data.
+//
+// Connections over unix sockets are only trusted if trustUnix is set; anyone who can connect to
+// the socket can then claim to be anyone, so its permissions had better be tight.
+func NewProxyListener(l net.Listener, trusted []*net.IPNet, trustUnix bool) net.Listener {
+	return proxyListener{l, trusted, trustUnix}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted   []*net.IPNet
+	trustUnix bool
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.isTrusted(conn.RemoteAddr()) {
+		return conn, err
+	}
+	// Headers are read on first use, so a slow client doesn't block Accept().
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (l proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		_, isUnix := addr.(*net.UnixAddr)
+		return isUnix && l.trustUnix
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A connection from a trusted proxy.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once         sync.Once
+	err          error
+	src, dst     net.Addr
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Remember deadlines set by the user, so they can be restored after reading the header.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Reads the PROXY header, if it hasn't been already.
+func (c *proxyConn) init() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy: %w", c.err)
+		}
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	})
+	return c.err
+}
+
+// Reads a PROXY v1 or v2 header. Returns nil addresses if the proxy didn't provide any, eg. for
+// health checks (v1 UNKNOWN, v2 LOCAL) or non-IP sockets.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if bytes.HasPrefix(proxyV2Signature, prefix) {
+		if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil, errors.New("missing PROXY header")
+}
+
+// | PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+//
+// The whole line is at most 107 bytes.
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1: malformed header: %q", line)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("v1: malformed header: %q", line)
+	}
+	srcAddr, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(ipStr, portStr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("v1: invalid IP: '%s'", ipStr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("v1: invalid port: '%s'", portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// | signature[12] | ver_cmd | fam | len (uint16be) | addresses... | TLVs...
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	verCmd, fam, size := hdr[12], hdr[13], binary.BigEndian.Uint16(hdr[14:])
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("v2: unsupported version: %d", verCmd>>4)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch verCmd & 0xF {
+	case 0x0: // LOCAL: the proxy's own connection, eg. a health check.
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("v2: unsupported command: %d", verCmd&0xF)
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX: nothing useful to report.
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("v2: address block too short")
+	}
+	srcIP, dstIP := net.IP(body[:ipLen]), net.IP(body[ipLen:2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	if fam&0xF == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
@@ -0,0 +1,223 @@
+package pubd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/pubd/testutil"
+)
+
+// Builds a v2 header with the given command, family and address block.
+func proxyV2(cmd, fam byte, addrs []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Addrs := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x01, 0xBB}
+	v6Addrs := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x01, 0xBB)
+
+	testdata := map[string]struct {
+		Src, Dst string
+		Err      string
+	}{
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n":    {Src: "192.168.0.1:56324", Dst: "10.0.0.1:443"},
+		"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n": {Src: "[2001:db8::1]:56324", Dst: "[2001:db8::2]:443"},
+		"PROXY UNKNOWN\r\n":                                {},
+		"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n":            {},
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n":        {Err: `v1: malformed header: "PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"`},
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n":      {Err: `v1: malformed header: "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n"`},
+		"PROXY TCP4 192.168.0.1 nope 56324 443\r\n":        {Err: "v1: invalid IP: 'nope'"},
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 99999\r\n":  {Err: "v1: invalid port: '99999'"},
+		"PROXY " + strings.Repeat("x", 200) + "\r\n":       {Err: `v1: malformed header: "PROXY ` + strings.Repeat("x", 101) + `"`},
+		"GET / HTTP/1.1\r\n":                               {Err: "missing PROXY header"},
+		"\r\n\r\n\x00\r\nNOPE\n\x21\x11\x00\x00":           {Err: "missing PROXY header"},
+		proxyV2(0x1, 0x11, v4Addrs):                        {Src: "192.168.0.1:56324", Dst: "10.0.0.1:443"},
+		proxyV2(0x1, 0x12, v4Addrs):                        {Src: "192.168.0.1:56324", Dst: "10.0.0.1:443"},
+		proxyV2(0x1, 0x21, v6Addrs):                        {Src: "[2001:db8::1]:56324", Dst: "[2001:db8::2]:443"},
+		proxyV2(0x1, 0x11, append(v4Addrs, 0x04, 0, 1, 0)): {Src: "192.168.0.1:56324", Dst: "10.0.0.1:443"}, // With a TLV.
+		proxyV2(0x0, 0x11, v4Addrs):                        {},
+		proxyV2(0x1, 0x00, nil):                            {},
+		proxyV2(0x1, 0x11, v4Addrs[:8]):                    {Err: "v2: address block too short"},
+		proxyV2(0x2, 0x11, v4Addrs):                        {Err: "v2: unsupported command: 2"},
+	}
+	for input, tdata := range testdata {
+		t.Run(input, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(input + "data"))
+			src, dst, err := readProxyHeader(r)
+			if tdata.Err != "" {
+				assert.EqualError(t, err, tdata.Err)
+				return
+			}
+			require.NoError(t, err)
+			if tdata.Src == "" {
+				assert.Nil(t, src)
+				assert.Nil(t, dst)
+			} else {
+				assert.Equal(t, tdata.Src, src.String())
+				assert.Equal(t, tdata.Dst, dst.String())
+			}
+			rest, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(rest))
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "127.0.0.1", "::1", "fd00::/8"})
+	require.NoError(t, err)
+	var ss []string
+	for _, n := range nets {
+		ss = append(ss, n.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128", "fd00::/8"}, ss)
+
+	_, err = ParseCIDRs([]string{"nope"})
+	assert.EqualError(t, err, "invalid IP: 'nope'")
+	_, err = ParseCIDRs([]string{"10.0.0.0/99"})
+	assert.EqualError(t, err, "invalid CIDR address: 10.0.0.0/99")
+}
+
+func TestListenProxy(t *testing.T) {
+	loopback, err := ParseCIDRs([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	elsewhere, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	server, err := testutil.NewCert("127.0.0.1", nil)
+	require.NoError(t, err)
+
+	// Accepts a connection, then returns its RemoteAddr and everything it sent.
+	accept := func(t *testing.T, l net.Listener) (string, string, error) {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		data, err := ioutil.ReadAll(conn)
+		return conn.RemoteAddr().String(), string(data), err
+	}
+	header := "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"
+
+	t.Run("Trusted", func(t *testing.T) {
+		ls, err := ListenConfig{ProxyTrusted: loopback}.Listen("proxy/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+
+		conn, err := net.Dial("tcp", ls[0].Addr().String())
+		require.NoError(t, err)
+		conn.Write([]byte(header + "hi"))
+		conn.Close()
+
+		addr, data, err := accept(t, ls[0])
+		require.NoError(t, err)
+		assert.Equal(t, "192.168.0.1:56324", addr)
+		assert.Equal(t, "hi", data)
+	})
+
+	t.Run("Trusted, No Header", func(t *testing.T) {
+		ls, err := ListenConfig{ProxyTrusted: loopback}.Listen("proxy/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+
+		conn, err := net.Dial("tcp", ls[0].Addr().String())
+		require.NoError(t, err)
+		conn.Write([]byte("hi there, no header here"))
+		conn.Close()
+
+		_, _, err = accept(t, ls[0])
+		assert.EqualError(t, err, "proxy: missing PROXY header")
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		ls, err := ListenConfig{ProxyTrusted: elsewhere}.Listen("proxy/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+
+		conn, err := net.Dial("tcp", ls[0].Addr().String())
+		require.NoError(t, err)
+		conn.Write([]byte(header + "hi"))
+		conn.Close()
+
+		addr, data, err := accept(t, ls[0])
+		require.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr().String(), addr)
+		assert.Equal(t, header+"hi", data, "header should be passed through")
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		lc := ListenConfig{
+			TLS:          &tls.Config{Certificates: []tls.Certificate{server.TLS()}},
+			ProxyTrusted: loopback,
+		}
+		ls, err := lc.Listen("tls/proxy/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+
+		go func() {
+			conn, err := net.Dial("tcp", ls[0].Addr().String())
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(header))
+			tlsConn := tls.Client(conn, &tls.Config{RootCAs: server.Pool(), ServerName: "127.0.0.1"})
+			tlsConn.Write([]byte("hi"))
+			tlsConn.Close()
+		}()
+
+		addr, data, err := accept(t, ls[0])
+		require.NoError(t, err)
+		assert.Equal(t, "192.168.0.1:56324", addr)
+		assert.Equal(t, "hi", data)
+	})
+
+	// Anyone who can connect to a unix socket could claim any address, so they must be trusted
+	// explicitly; an IP range that happens to include everything isn't enough.
+	for name, lc := range map[string]ListenConfig{
+		"Unix, Trusted":   {ProxyTrustUnix: true},
+		"Unix, Untrusted": {ProxyTrusted: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}},
+	} {
+		lc := lc
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pubd-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			ls, err := lc.Listen("proxy/unix/" + filepath.Join(dir, "pubd.sock"))
+			require.NoError(t, err)
+			defer ls[0].Close()
+
+			conn, err := net.Dial("unix", ls[0].Addr().String())
+			require.NoError(t, err)
+			conn.Write([]byte(header + "hi"))
+			conn.Close()
+
+			addr, data, err := accept(t, ls[0])
+			require.NoError(t, err)
+			if lc.ProxyTrustUnix {
+				assert.Equal(t, "192.168.0.1:56324", addr)
+				assert.Equal(t, "hi", data)
+			} else {
+				assert.Equal(t, header+"hi", data, "header should be passed through")
+			}
+		})
+	}
+
+	t.Run("No Trusted Proxies", func(t *testing.T) {
+		_, err := Listen("proxy/127.0.0.1:0")
+		assert.EqualError(t, err, "listen/proxy: no trusted proxies configured")
+	})
+	t.Run("Proxy Over TLS", func(t *testing.T) {
+		_, err := ListenConfig{TLS: &tls.Config{}, ProxyTrusted: loopback}.Listen("proxy/tls/127.0.0.1:0")
+		assert.EqualError(t, err, "listen/proxy: TLS is configured, but this isn't a tls/ address")
+	})
+}
@@ -0,0 +1,65 @@
+package pubd
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Implements the writing half of billy.Filesystem for read-only filesystems.
+type readOnlyFS struct{}
+
+func (readOnlyFS) Create(filename string) (billy.File, error)       { return nil, billy.ErrReadOnly }
+func (readOnlyFS) Rename(oldpath, newpath string) error             { return billy.ErrReadOnly }
+func (readOnlyFS) Remove(filename string) error                     { return billy.ErrReadOnly }
+func (readOnlyFS) MkdirAll(filename string, perm os.FileMode) error { return billy.ErrReadOnly }
+func (readOnlyFS) Symlink(target, link string) error                { return billy.ErrReadOnly }
+func (readOnlyFS) TempFile(dir, prefix string) (billy.File, error)  { return nil, billy.ErrReadOnly }
+func (readOnlyFS) Capabilities() billy.Capability                   { return billy.ReadCapability | billy.SeekCapability }
+func (readOnlyFS) Root() string                                     { return "/" }
+func (readOnlyFS) isWrite(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+}
+
+// Contents of a file on a read-only filesystem, eg. a *bytes.Reader or *io.SectionReader.
+type readOnlyContents interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// A billy.File that can only be read from. onClose is optional.
+type readOnlyFile struct {
+	readOnlyContents
+	name    string
+	onClose func() error
+}
+
+func (f *readOnlyFile) Name() string                { return f.name }
+func (f *readOnlyFile) Write(p []byte) (int, error) { return 0, billy.ErrReadOnly }
+func (f *readOnlyFile) Lock() error                 { return nil }
+func (f *readOnlyFile) Unlock() error               { return nil }
+func (f *readOnlyFile) Truncate(size int64) error   { return billy.ErrReadOnly }
+func (f *readOnlyFile) Close() error {
+	if f.onClose != nil {
+		return f.onClose()
+	}
+	return nil
+}
+
+// os.FileInfo for files on synthetic filesystems.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() os.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() interface{}   { return nil }
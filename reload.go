@@ -0,0 +1,128 @@
+package pubd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Calls fn once, then again upon receiving SIGHUP until ctx expires, eg. to re-read a config
+// file and swap in whatever it builds.
+//
+// Each call gets a context for background tasks, which carries ctx's values, but isn't cancelled
+// with it: requests may still be using a generation while the server drains. Instead, fn takes
+// over the done func which cancels it, and should hand it to whatever serves the generation,
+// eg. a Generations, to be called once nothing's using it anymore. If fn fails, done is called
+// for it.
+//
+// An error from the first call is returned; later ones are logged, and the last working
+// configuration is left in place.
+func WatchReload(ctx context.Context, L *zap.Logger, fn func(ctx context.Context, done context.CancelFunc) error) error {
+	build := func() error {
+		genCtx, done := context.WithCancel(detachedContext{ctx})
+		if err := fn(genCtx, done); err != nil {
+			done()
+			return err
+		}
+		return nil
+	}
+	if err := build(); err != nil {
+		return err
+	}
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigC)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigC:
+			}
+			NotifyReload(func() {
+				if err := build(); err != nil {
+					L.Error("Couldn't reload configuration, keeping the old one", zap.Error(err))
+					return
+				}
+				L.Info("Configuration reloaded")
+			})
+		}
+	}()
+	return nil
+}
+
+// A context with its parent's values, but not its cancellation.
+type detachedContext struct{ parent context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool)           { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}                 { return nil }
+func (detachedContext) Err() error                            { return nil }
+func (ctx detachedContext) Value(key interface{}) interface{} { return ctx.parent.Value(key) }
+
+// Holds the current generation of something built by WatchReload(), eg. a handler, and calls
+// each generation's done func once it's been replaced (or closed), and its last user is done.
+type Generations struct {
+	mu  sync.Mutex
+	cur *generation
+}
+
+type generation struct {
+	v       interface{}
+	done    func()
+	users   int
+	retired bool
+}
+
+// Makes v the current generation. done may be nil.
+func (g *Generations) Swap(v interface{}, done func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retire()
+	g.cur = &generation{v: v, done: done}
+}
+
+// Returns the current generation, and a func to call once finished with it. There must be one,
+// ie. Swap() must've been called first.
+func (g *Generations) Acquire() (interface{}, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gen := g.cur
+	gen.users++
+	var once sync.Once
+	return gen.v, func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			gen.users--
+			g.finish(gen)
+		})
+	}
+}
+
+// Retires the current generation, eg. once the server using it has stopped. It's still
+// returned by Acquire(), but done is called as soon as it has no users.
+func (g *Generations) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retire()
+}
+
+func (g *Generations) retire() {
+	if g.cur != nil && !g.cur.retired {
+		g.cur.retired = true
+		g.finish(g.cur)
+	}
+}
+
+func (g *Generations) finish(gen *generation) {
+	if gen.retired && gen.users == 0 && gen.done != nil {
+		gen.done()
+		gen.done = nil
+	}
+}
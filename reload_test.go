@@ -0,0 +1,111 @@
+package pubd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWatchReload(t *testing.T) {
+	t.Run("Error", func(t *testing.T) {
+		var genCtx context.Context
+		err := WatchReload(context.Background(), zap.NewNop(), func(ctx context.Context, done context.CancelFunc) error {
+			genCtx = ctx
+			return errors.New("broken")
+		})
+		assert.EqualError(t, err, "broken")
+		assert.Error(t, genCtx.Err(), "a failed generation should be cancelled")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	core, logs := observer.New(zap.InfoLevel)
+
+	// Each call sends its context and done func, and fails if told to.
+	type gen struct {
+		ctx  context.Context
+		done context.CancelFunc
+	}
+	genC := make(chan gen, 1)
+	failC := make(chan error, 1)
+	failC <- nil
+	require.NoError(t, WatchReload(context.WithValue(ctx, "key", "value"), zap.New(core),
+		func(ctx context.Context, done context.CancelFunc) error {
+			if err := <-failC; err != nil {
+				return err
+			}
+			genC <- gen{ctx, done}
+			return nil
+		}))
+	gen1 := <-genC
+	assert.Equal(t, "value", gen1.ctx.Value("key"))
+
+	hup := func() {
+		proc, err := os.FindProcess(os.Getpid())
+		require.NoError(t, err)
+		require.NoError(t, proc.Signal(syscall.SIGHUP))
+	}
+	waitForLog := func(msg string) {
+		for i := 0; i < 100 && logs.FilterMessage(msg).Len() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, 1, logs.FilterMessage(msg).Len(), "%s: %v", msg, logs.AllUntimed())
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		failC <- nil
+		hup()
+		gen2 := <-genC
+		waitForLog("Configuration reloaded")
+		assert.NoError(t, gen1.ctx.Err(), "the old generation is cancelled by its done func")
+		gen1.done()
+		assert.Error(t, gen1.ctx.Err())
+		assert.NoError(t, gen2.ctx.Err())
+
+		t.Run("Broken", func(t *testing.T) {
+			failC <- errors.New("broken")
+			hup()
+			waitForLog("Couldn't reload configuration, keeping the old one")
+			assert.NoError(t, gen2.ctx.Err(), "the old generation should be left alone")
+		})
+
+		t.Run("Shutdown", func(t *testing.T) {
+			cancel()
+			assert.NoError(t, gen2.ctx.Err(), "requests may still be draining")
+			gen2.done()
+			assert.Error(t, gen2.ctx.Err())
+		})
+	})
+}
+
+func TestGenerations(t *testing.T) {
+	var done []string
+	var g Generations
+	g.Swap("gen1", func() { done = append(done, "gen1") })
+
+	v, release1 := g.Acquire()
+	assert.Equal(t, "gen1", v)
+	g.Swap("gen2", func() { done = append(done, "gen2") })
+	assert.Empty(t, done, "gen1 is still in use")
+
+	v, release2 := g.Acquire()
+	assert.Equal(t, "gen2", v)
+	release1()
+	release1() // Releasing twice is harmless.
+	assert.Equal(t, []string{"gen1"}, done)
+
+	g.Close()
+	assert.Equal(t, []string{"gen1"}, done, "gen2 is still in use")
+	release2()
+	assert.Equal(t, []string{"gen1", "gen2"}, done)
+	g.Close()
+	assert.Equal(t, []string{"gen1", "gen2"}, done)
+}
@@ -2,8 +2,11 @@ package pubd
 
 import (
 	"context"
+	"errors"
 	"net"
+	"time"
 
+	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -19,20 +22,119 @@ func (fn ServerFunc) Serve(ctx context.Context, l net.Listener) error {
 	return fn(ctx, l)
 }
 
+// Options for Serve. The zero value is valid, and equivalent to calling Serve().
+type ServeConfig struct {
+	// How long to wait for connections to finish once ctx expires, before closing them;
+	// zero waits forever. Another SIGINT/SIGTERM skips the wait; see WithSignalHandler().
+	DrainTimeout time.Duration
+
+	L *zap.Logger // Logs shutdown progress, if set.
+}
+
 // Runs an instance of srv for each listener. The context passed to each srv is a child
-// of ctx, which is cancelled when the first instance returns.
+// of ctx, which is cancelled when the first instance returns an error.
+//
+// A listener that's run out of connections (ErrListenerDone, eg. for inetd/) is not an error.
+//
+// If running under systemd, it's notified when we're ready and when we begin shutting down,
+// and its watchdog is pinged if enabled, until we return. If we were started by Upgrade(), the old process is
+// told we're ready, so it can shut down.
 func Serve(ctx context.Context, listeners []net.Listener, srv Server) error {
+	return ServeConfig{}.Serve(ctx, listeners, srv)
+}
+
+// Like Serve(), with options.
+func (sc ServeConfig) Serve(ctx context.Context, listeners []net.Listener, srv Server) error {
+	return sc.ServeServices(ctx, []Service{{Listeners: listeners, Server: srv}})
+}
+
+// A Server, and the listeners to run it on; see ServeConfig.ServeServices().
+type Service struct {
+	Listeners []net.Listener
+	Server    Server
+}
+
+// Like Serve(), but runs several servers, each on its own listeners. If one of them returns an
+// error, all of them are shut down.
+func (sc ServeConfig) ServeServices(ctx context.Context, services []Service) error {
+	// Keep pinging the watchdog while draining; we're still alive until we return. It stops by
+	// itself if we've been upgraded, as the service then belongs to the new process.
+	watchdogCtx, stopWatchdog := context.WithCancel(detachedContext{ctx})
+	defer stopWatchdog()
+	go Watchdog(watchdogCtx)
+
 	g, ctx := errgroup.WithContext(ctx)
-	for _, l := range listeners {
-		l := l
-		g.Go(func() error { return srv.Serve(ctx, l) })
+	go func() {
+		<-ctx.Done()
+		notifyUnlessHandedOver(ctx, NotifyStopping)
+	}()
+	for _, svc := range services {
+		for _, l := range svc.Listeners {
+			srv, l := svc.Server, l
+			g.Go(func() error {
+				if err := srv.Serve(ctx, l); err != nil && !errors.Is(err, ErrListenerDone) {
+					return err
+				}
+				return nil
+			})
+		}
+	}
+	Notify(NotifyReady)
+	upgradeReady()
+
+	doneC := make(chan error, 1)
+	go func() { doneC <- g.Wait() }()
+	select {
+	case err := <-doneC:
+		return err
+	case <-ctx.Done():
+		return sc.drain(ctx, doneC)
 	}
-	return g.Wait()
+}
+
+// Waits for servers to shut down gracefully, closing any connections that outstay the
+// drain timeout, or a forced shutdown.
+func (sc ServeConfig) drain(ctx context.Context, doneC <-chan error) error {
+	L := sc.L
+	if L == nil {
+		L = zap.NewNop()
+	}
+	L.Info("Draining connections", zap.Int("conns", countConns()), zap.Duration("timeout", sc.DrainTimeout))
+
+	var timeoutC <-chan time.Time
+	if sc.DrainTimeout > 0 {
+		timeout := time.NewTimer(sc.DrainTimeout)
+		defer timeout.Stop()
+		timeoutC = timeout.C
+	}
+	select {
+	case err := <-doneC:
+		return err
+	case <-timeoutC:
+		L.Warn("Drain timed out, closing connections", zap.Int("conns", closeConns()))
+	case <-forceFrom(ctx):
+		L.Warn("Shutdown forced, closing connections", zap.Int("conns", closeConns()))
+	}
+	return <-doneC
+}
+
+// Shorthand for calling sc.Serve(ctx, lc.Listen(addr), srv).
+func (sc ServeConfig) ListenAndServe(ctx context.Context, lc ListenConfig, addr string, srv Server) error {
+	listeners, err := lc.Listen(addr)
+	if err != nil {
+		return err
+	}
+	return sc.Serve(ctx, listeners, srv)
 }
 
 // Shorthand for calling Serve(ctx, Listen(addr), srv).
 func ListenAndServe(ctx context.Context, addr string, srv Server) error {
-	listeners, err := Listen(addr)
+	return ListenConfig{}.ListenAndServe(ctx, addr, srv)
+}
+
+// Shorthand for calling Serve(ctx, lc.Listen(addr), srv).
+func (lc ListenConfig) ListenAndServe(ctx context.Context, addr string, srv Server) error {
+	listeners, err := lc.Listen(addr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,281 @@
+package pubd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Policy for symlinks encountered in a served tree; see FileSystemSymlinks.
+type SymlinkPolicy string
+
+const (
+	SymlinksFollow     SymlinkPolicy = "follow"      // Follow symlinks wherever they lead.
+	SymlinksDeny       SymlinkPolicy = "deny"        // Pretend symlinks don't exist.
+	SymlinksWithinRoot SymlinkPolicy = "within-root" // Follow symlinks that don't leave the root.
+)
+
+// Maximum number of symlinks followed while resolving a path, same as Linux' MAXSYMLINKS.
+const maxSymlinks = 40
+
+// Parses a --symlinks value. An empty string is treated as SymlinksFollow.
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(s); p {
+	case "":
+		return SymlinksFollow, nil
+	case SymlinksFollow, SymlinksDeny, SymlinksWithinRoot:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid symlink policy '%s'; must be one of: %s, %s, %s",
+			s, SymlinksFollow, SymlinksDeny, SymlinksWithinRoot)
+	}
+}
+
+type symlinkFileSystem struct {
+	billy.Filesystem
+	policy SymlinkPolicy
+}
+
+// Returns a filesystem which applies the given policy to symlinks. Denied symlinks, and any
+// paths that would traverse them, look like they don't exist.
+//
+// Symlinks are resolved relative to the root of fs, which should be chrooted to the served
+// directory; absolute symlinks are expected to be rewritten to be relative to it, which the
+// billy chroot helper used by osfs does. Filesystems returned by Chroot() apply the same
+// policy relative to their new root.
+func FileSystemSymlinks(fs billy.Filesystem, policy SymlinkPolicy) billy.Filesystem {
+	if policy == SymlinksFollow || policy == "" {
+		return fs
+	}
+	return symlinkFileSystem{fs, policy}
+}
+
+// Like FileSystemSymlinks(fs, SymlinksFollow), but resolves symlinks within the root itself,
+// rather than leaving them to fs, so that fs sees the paths they lead to, eg. to filter them.
+// Symlinks leading out of the root are still left to fs.
+func FileSystemResolveSymlinks(fs billy.Filesystem) billy.Filesystem {
+	return symlinkFileSystem{fs, SymlinksFollow}
+}
+
+// Splits a path into cleaned, root-relative segments. Returns nil for the root itself.
+func splitPath(filename string) []string {
+	filename = strings.Trim(path.Clean("/"+filename), "/")
+	if filename == "" {
+		return nil
+	}
+	return strings.Split(filename, "/")
+}
+
+// Resolves a symlink's target relative to the directory it's in; returns false if the policy
+// doesn't allow following it. Targets outside the root are only allowed by SymlinksFollow, and
+// returned as "", to be left to the underlying filesystem.
+func (fs symlinkFileSystem) followLink(dir, link string) (string, bool, error) {
+	if fs.policy == SymlinksDeny {
+		return "", false, nil
+	}
+	target, err := fs.Filesystem.Readlink(path.Join(dir, link))
+	if err != nil {
+		return "", false, err
+	}
+	// Absolute targets are relative to the root, relative ones to the link's directory.
+	// Don't let path.Clean() quietly swallow leading ".."s by starting with a "/".
+	if strings.HasPrefix(target, "/") {
+		target = path.Clean(strings.TrimLeft(target, "/"))
+	} else {
+		target = path.Join(strings.Trim(dir, "/"), target)
+	}
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", fs.policy == SymlinksFollow, nil
+	}
+	return "/" + target, true, nil
+}
+
+// Resolves all symlinks in a path. If followLast is false, the final segment is checked,
+// but not resolved, like lstat() would. Returns ErrNotExist if a denied symlink is found.
+func (fs symlinkFileSystem) resolve(filename string, followLast bool) (string, error) {
+	pending := splitPath(filename)
+	resolved := "/"
+	for hops := 0; len(pending) > 0; {
+		seg := pending[0]
+		pending = pending[1:]
+
+		info, err := fs.Filesystem.Lstat(path.Join(resolved, seg))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Nonexistent files can't be symlinks, let the caller deal with them.
+				return path.Join(append([]string{resolved, seg}, pending...)...), nil
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = path.Join(resolved, seg)
+			continue
+		}
+
+		target, ok, err := fs.followLink(resolved, seg)
+		if err != nil {
+			return "", err
+		} else if !ok {
+			return "", os.ErrNotExist
+		}
+		if len(pending) == 0 && !followLast {
+			return path.Join(resolved, seg), nil
+		}
+		if target == "" {
+			// It leads out of the root, let the underlying filesystem follow it.
+			return path.Join(append([]string{resolved, seg}, pending...)...), nil
+		}
+		if hops++; hops > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", filename)
+		}
+		pending = append(splitPath(target), pending...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
+
+func (fs symlinkFileSystem) Create(filename string) (billy.File, error) {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Create(rpath)
+}
+
+func (fs symlinkFileSystem) Open(filename string) (billy.File, error) {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Open(rpath)
+}
+
+func (fs symlinkFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.OpenFile(rpath, flag, perm)
+}
+
+func (fs symlinkFileSystem) Stat(filename string) (os.FileInfo, error) {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Stat(rpath)
+}
+
+func (fs symlinkFileSystem) Rename(oldpath, newpath string) error {
+	oldRPath, err := fs.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	newRPath, err := fs.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	return fs.Filesystem.Rename(oldRPath, newRPath)
+}
+
+func (fs symlinkFileSystem) Remove(filename string) error {
+	rpath, err := fs.resolve(filename, false)
+	if err != nil {
+		return err
+	}
+	return fs.Filesystem.Remove(rpath)
+}
+
+func (fs symlinkFileSystem) TempFile(dir, prefix string) (billy.File, error) {
+	if dir != "" {
+		rdir, err := fs.resolve(dir, true)
+		if err != nil {
+			return nil, err
+		}
+		dir = rdir
+	}
+	return fs.Filesystem.TempFile(dir, prefix)
+}
+
+// Directory listings leave out symlinks which would be denied.
+func (fs symlinkFileSystem) ReadDir(filename string) ([]os.FileInfo, error) {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	realInfos, err := fs.Filesystem.ReadDir(rpath)
+	if err != nil {
+		return nil, err
+	}
+	filteredInfos := make([]os.FileInfo, 0, len(realInfos))
+	for _, info := range realInfos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, err := fs.resolve(path.Join(rpath, info.Name()), true); err != nil {
+				continue
+			}
+		}
+		filteredInfos = append(filteredInfos, info)
+	}
+	return filteredInfos, nil
+}
+
+func (fs symlinkFileSystem) MkdirAll(filename string, perm os.FileMode) error {
+	rpath, err := fs.resolve(filename, true)
+	if err != nil {
+		return err
+	}
+	return fs.Filesystem.MkdirAll(rpath, perm)
+}
+
+// Lstat() on a symlink describes the link itself, but only if it'd be allowed to follow it.
+func (fs symlinkFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	rpath, err := fs.resolve(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Filesystem.Lstat(rpath)
+}
+
+func (fs symlinkFileSystem) Symlink(target, link string) error {
+	rpath, err := fs.resolve(link, false)
+	if err != nil {
+		return err
+	}
+	return fs.Filesystem.Symlink(target, rpath)
+}
+
+func (fs symlinkFileSystem) Readlink(link string) (string, error) {
+	rpath, err := fs.resolve(link, false)
+	if err != nil {
+		return "", err
+	}
+	return fs.Filesystem.Readlink(rpath)
+}
+
+func (fs symlinkFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	rpath, err := fs.resolve(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := fs.Filesystem.Chroot(rpath)
+	if err != nil {
+		return nil, err
+	}
+	return symlinkFileSystem{inner, fs.policy}, nil
+}
+
+// Configs are looked up where the directory really is.
+func (fs symlinkFileSystem) DirConfig(dir string) (DirConfig, error) {
+	rpath, err := fs.resolve(dir, true)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	return DirConfigOf(fs.Filesystem, rpath)
+}
+
+func (fs symlinkFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
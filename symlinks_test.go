@@ -0,0 +1,212 @@
+package pubd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	testdata := map[string]SymlinkPolicy{
+		"":            SymlinksFollow,
+		"follow":      SymlinksFollow,
+		"deny":        SymlinksDeny,
+		"within-root": SymlinksWithinRoot,
+	}
+	for in, out := range testdata {
+		t.Run(`"`+in+`"`, func(t *testing.T) {
+			policy, err := ParseSymlinkPolicy(in)
+			require.NoError(t, err)
+			assert.Equal(t, out, policy)
+		})
+	}
+
+	t.Run(`"blah"`, func(t *testing.T) {
+		_, err := ParseSymlinkPolicy("blah")
+		assert.EqualError(t, err, "invalid symlink policy 'blah'; must be one of: follow, deny, within-root")
+	})
+}
+
+func TestFileSystemSymlinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// tmp/
+	//   secret.txt
+	//   www/
+	//     index.html
+	//     sub/about.html
+	//     abs.html -> /www/index.html (within root)
+	//     rel.html -> sub/about.html (within root)
+	//     subl -> ./sub (within root)
+	//     chain.html -> subl/about.html (within root, via another link)
+	//     escape.txt -> ../secret.txt (outside root)
+	//     escapeabs.txt -> $tmp/secret.txt (outside root)
+	//     loop -> loop
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "www", "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "secret.txt"), []byte("secret"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "www", "index.html"), []byte("index"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "www", "sub", "about.html"), []byte("about"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(tmp, "www", "index.html"), filepath.Join(tmp, "www", "abs.html")))
+	require.NoError(t, os.Symlink("sub/about.html", filepath.Join(tmp, "www", "rel.html")))
+	require.NoError(t, os.Symlink("./sub", filepath.Join(tmp, "www", "subl")))
+	require.NoError(t, os.Symlink("subl/about.html", filepath.Join(tmp, "www", "chain.html")))
+	require.NoError(t, os.Symlink("../secret.txt", filepath.Join(tmp, "www", "escape.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(tmp, "secret.txt"), filepath.Join(tmp, "www", "escapeabs.txt")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(tmp, "www", "loop")))
+
+	testdata := map[SymlinkPolicy]map[string]string{
+		SymlinksFollow: {
+			"/index.html":      "index",
+			"/abs.html":        "index",
+			"/rel.html":        "about",
+			"/subl/about.html": "about",
+			"/chain.html":      "about",
+			"/escape.txt":      "secret",
+			"/escapeabs.txt":   "secret",
+		},
+		SymlinksDeny: {
+			"/index.html":      "index",
+			"/sub/about.html":  "about",
+			"/abs.html":        "",
+			"/rel.html":        "",
+			"/subl/about.html": "",
+			"/chain.html":      "",
+			"/escape.txt":      "",
+			"/escapeabs.txt":   "",
+		},
+		SymlinksWithinRoot: {
+			"/index.html":      "index",
+			"/abs.html":        "index",
+			"/rel.html":        "about",
+			"/subl/about.html": "about",
+			"/chain.html":      "about",
+			"/escape.txt":      "",
+			"/escapeabs.txt":   "",
+		},
+	}
+	for policy, pathdata := range testdata {
+		t.Run(string(policy), func(t *testing.T) {
+			rootFS, err := osfs.New("/").Chroot(filepath.Join(tmp, "www"))
+			require.NoError(t, err)
+			fs := FileSystemSymlinks(rootFS, policy)
+
+			for path, contents := range pathdata {
+				t.Run(path, func(t *testing.T) {
+					t.Run("Open", func(t *testing.T) {
+						f, err := fs.Open(path)
+						if contents == "" {
+							assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+							return
+						}
+						require.NoError(t, err)
+						defer f.Close()
+						data, err := ioutil.ReadAll(f)
+						require.NoError(t, err)
+						assert.Equal(t, contents, string(data))
+					})
+					t.Run("Stat", func(t *testing.T) {
+						_, err := fs.Stat(path)
+						if contents == "" {
+							assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+						} else {
+							assert.NoError(t, err)
+						}
+					})
+					t.Run("Lstat", func(t *testing.T) {
+						_, err := fs.Lstat(path)
+						if contents == "" {
+							assert.True(t, os.IsNotExist(err), "should return ErrNotExist")
+						} else {
+							assert.NoError(t, err)
+						}
+					})
+				})
+			}
+
+			t.Run("ReadDir", func(t *testing.T) {
+				infos, err := fs.ReadDir("/")
+				require.NoError(t, err)
+				names := map[string]bool{}
+				for _, info := range infos {
+					names[info.Name()] = true
+				}
+				for path, contents := range pathdata {
+					if filepath.Dir(path) == "/" {
+						assert.Equal(t, contents != "", names[filepath.Base(path)], path)
+					}
+				}
+			})
+		})
+	}
+
+	t.Run("Readlink", func(t *testing.T) {
+		rootFS, err := osfs.New("/").Chroot(filepath.Join(tmp, "www"))
+		require.NoError(t, err)
+		for policy, targets := range map[SymlinkPolicy]map[string]string{
+			SymlinksDeny:       {"/rel.html": "", "/escape.txt": ""},
+			SymlinksWithinRoot: {"/rel.html": "sub/about.html", "/abs.html": "/index.html", "/escape.txt": ""},
+		} {
+			fs := FileSystemSymlinks(rootFS, policy)
+			for link, target := range targets {
+				actual, err := fs.Readlink(link)
+				if target == "" {
+					assert.True(t, os.IsNotExist(err), "%s: %s: should return ErrNotExist", policy, link)
+				} else {
+					require.NoError(t, err)
+					assert.Equal(t, target, actual, "%s: %s", policy, link)
+				}
+			}
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		// Resolving links ourselves follows the same links, but the underlying filesystem
+		// sees the paths they lead to; those leaving the root are left to it.
+		rootFS, err := osfs.New("/").Chroot(filepath.Join(tmp, "www"))
+		require.NoError(t, err)
+		fs := FileSystemResolveSymlinks(rootFS)
+		for path, contents := range testdata[SymlinksFollow] {
+			f, err := fs.Open(path)
+			require.NoError(t, err, path)
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			require.NoError(t, err, path)
+			assert.Equal(t, contents, string(data), path)
+		}
+
+		fs = FileSystemResolveSymlinks(FileSystemExclude(rootFS, []string{"/sub/about.html"}))
+		for _, path := range []string{"/rel.html", "/subl/about.html", "/chain.html"} {
+			_, err := fs.Open(path)
+			assert.True(t, os.IsNotExist(err), "%s: should return ErrNotExist", path)
+		}
+		for _, path := range []string{"/index.html", "/escape.txt"} {
+			_, err := fs.Stat(path)
+			assert.NoError(t, err, path)
+		}
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		rootFS, err := osfs.New("/").Chroot(filepath.Join(tmp, "www"))
+		require.NoError(t, err)
+		_, err = FileSystemSymlinks(rootFS, SymlinksWithinRoot).Open("/loop")
+		assert.EqualError(t, err, "/loop: too many levels of symbolic links")
+	})
+
+	t.Run("Chroot", func(t *testing.T) {
+		rootFS, err := osfs.New("/").Chroot(filepath.Join(tmp, "www"))
+		require.NoError(t, err)
+		var fs billy.Filesystem = FileSystemSymlinks(rootFS, SymlinksWithinRoot)
+		fs, err = fs.Chroot("/subl")
+		require.NoError(t, err)
+		_, err = fs.Stat("/about.html")
+		assert.NoError(t, err)
+	})
+}
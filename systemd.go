@@ -6,8 +6,17 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"time"
 )
 
 func ListenSystemd(network, addr string) ([]net.Listener, error) {
 	return nil, fmt.Errorf("systemd support not built for %s", runtime.GOOS)
 }
+
+func Notify(state string) error {
+	return nil
+}
+
+func WatchdogInterval() (time.Duration, error) {
+	return 0, nil
+}
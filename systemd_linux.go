@@ -3,10 +3,27 @@ package pubd
 import (
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
 )
 
+// Files passed by systemd; activation.Files() clears the environment, so we can only call it once.
+var (
+	systemdOnce  sync.Once
+	systemdFiles []*os.File
+	listenFiles  = activation.Files // Swappable for testing.
+)
+
+func activatedFiles() []*os.File {
+	systemdOnce.Do(func() { systemdFiles = listenFiles(true) })
+	return systemdFiles
+}
+
 // Listen on file descriptors passed by systemd socket activation.
 //
 // Returns an error if no file descriptors were passed, which means either we're not
@@ -14,30 +31,51 @@ import (
 // The easiest way to avoid the latter is to add an explicit "Requires=" to the service;
 // see the sample units provided in ./etc/systemd-*.
 //
-// network must be "systemd". addr is reserved for future arguments and must be empty.
+// network must be "systemd". If addr is empty, all passed sockets are used; otherwise, only
+// ones whose FileDescriptorName= is addr. The default name is the socket unit's, so eg.
+// "systemd/pubd-http" matches sockets from pubd-http.socket. This can be called repeatedly,
+// eg. to serve different sockets passed to the same service with different settings.
 //
 // See also: https://www.freedesktop.org/software/systemd/man/systemd.socket.html
 func ListenSystemd(network, addr string) ([]net.Listener, error) {
 	if network != "systemd" {
 		return nil, fmt.Errorf("expected network 'systemd', not '%s'", network)
 	}
-	if len(addr) > 0 {
-		return nil, fmt.Errorf("no arguments defined, but got '%s'; if you have an idea for an argument, we'd love to hear it: https://github.com/liclac/pubd/issues", addr)
-	}
 
 	// We use Files() rather than Listeners(), because we don't want to swallow errors.
-	files := activation.Files(true)
-	listeners := make([]net.Listener, len(files))
+	files := activatedFiles()
+	if len(files) == 0 {
+		return nil, fmt.Errorf("not socket activated; if running in a systemd service, maybe you need to add a 'Requires=foo.socket' dependency?")
+	}
+	var listeners []net.Listener
+	var names []string
 	for i, f := range files {
+		names = append(names, f.Name())
+		if addr != "" && f.Name() != addr && f.Name() != addr+".socket" {
+			continue
+		}
 		l, err := net.FileListener(f)
 		if err != nil {
+			closeListeners(listeners)
 			return nil, fmt.Errorf("[%d]: %s: %w", i, f.Name(), err)
 		}
-		listeners[i] = l
+		listeners = append(listeners, l)
 	}
 
 	if len(listeners) == 0 {
-		return nil, fmt.Errorf("not socket activated; if running in a systemd service, maybe you need to add a 'Requires=foo.socket' dependency?")
+		return nil, fmt.Errorf("no sockets named '%s'; available: %s", addr, strings.Join(names, ", "))
 	}
 	return listeners, nil
 }
+
+// Sends a state update to systemd, eg. NotifyReady; see sd_notify(3). Does nothing if we're
+// not running under systemd, or the unit isn't Type=notify.
+func Notify(state string) error {
+	_, err := daemon.SdNotify(false, state)
+	return err
+}
+
+// Returns how often systemd expects NotifyWatchdog, or 0 if WatchdogSec= isn't set.
+func WatchdogInterval() (time.Duration, error) {
+	return daemon.SdWatchdogEnabled(false)
+}
@@ -1,21 +1,222 @@
 package pubd
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-// TODO: Test this by emulating the environment variables used by sd_listen_fds().
-// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+// Emulates sd_listen_fds() passing the given listeners, by name.
+func fakeActivation(t *testing.T, names ...string) map[string]net.Listener {
+	listeners := make(map[string]net.Listener, len(names))
+	var files []*os.File
+	for _, name := range names {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		listeners[name] = l
+		files = append(files, os.NewFile(f.Fd(), name))
+	}
+	systemdOnce = sync.Once{}
+	listenFiles = func(bool) []*os.File { return files }
+	return listeners
+}
+
 func TestListen_Systemd(t *testing.T) {
-	t.Run("Extra Argument", func(t *testing.T) {
-		_, err := Listen("systemd/blah")
-		assert.EqualError(t, err, "listen/systemd: no arguments defined, but got 'blah'; if you have an idea for an argument, we'd love to hear it: https://github.com/liclac/pubd/issues")
-	})
+	defer func(fn func(bool) []*os.File) {
+		systemdOnce = sync.Once{}
+		listenFiles = fn
+	}(listenFiles)
 
 	t.Run("Not Socket Activated", func(t *testing.T) {
+		fakeActivation(t)
 		_, err := Listen("systemd/")
 		assert.EqualError(t, err, "listen/systemd: not socket activated; if running in a systemd service, maybe you need to add a 'Requires=foo.socket' dependency?")
+		_, err = Listen("systemd/http")
+		assert.EqualError(t, err, "listen/systemd: not socket activated; if running in a systemd service, maybe you need to add a 'Requires=foo.socket' dependency?")
+	})
+
+	// Asserts that the returned listeners are the given ones, in order.
+	assertListeners := func(t *testing.T, expected []net.Listener, actual []net.Listener) {
+		require.Len(t, actual, len(expected))
+		for i, l := range expected {
+			assert.Equal(t, l.Addr().String(), actual[i].Addr().String())
+			actual[i].Close()
+		}
+	}
+
+	t.Run("All", func(t *testing.T) {
+		ls := fakeActivation(t, "http", "ssh", "pubd.socket")
+		actual, err := Listen("systemd/")
+		require.NoError(t, err)
+		assertListeners(t, []net.Listener{ls["http"], ls["ssh"], ls["pubd.socket"]}, actual)
+	})
+
+	t.Run("Named", func(t *testing.T) {
+		ls := fakeActivation(t, "http", "ssh", "http", "pubd.socket")
+
+		// Sockets can be requested repeatedly, by different servers.
+		for i := 0; i < 2; i++ {
+			actual, err := Listen("systemd/ssh")
+			require.NoError(t, err)
+			assertListeners(t, []net.Listener{ls["ssh"]}, actual)
+		}
+
+		actual, err := Listen("systemd/http")
+		require.NoError(t, err)
+		require.Len(t, actual, 2)
+		for _, l := range actual {
+			l.Close()
+		}
+
+		// Names default to the socket unit's name, which can be given with or without ".socket".
+		actual, err = Listen("systemd/pubd")
+		require.NoError(t, err)
+		assertListeners(t, []net.Listener{ls["pubd.socket"]}, actual)
+		actual, err = Listen("systemd/pubd.socket")
+		require.NoError(t, err)
+		assertListeners(t, []net.Listener{ls["pubd.socket"]}, actual)
+
+		_, err = Listen("systemd/blah")
+		assert.EqualError(t, err, "listen/systemd: no sockets named 'blah'; available: http, ssh, http, pubd.socket")
+	})
+}
+
+// Listens on a fake $NOTIFY_SOCKET, and returns a function that reads the next message.
+func fakeNotifySocket(t *testing.T) (func() string, func()) {
+	dir, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "notify.sock"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	require.NoError(t, err)
+	os.Setenv("NOTIFY_SOCKET", addr.Name)
+	recv := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+	return recv, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Run("Not Under systemd", func(t *testing.T) {
+		assert.NoError(t, Notify(NotifyReady))
+		interval, err := WatchdogInterval()
+		require.NoError(t, err)
+		assert.Zero(t, interval)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		recv, cleanup := fakeNotifySocket(t)
+		defer cleanup()
+
+		called := false
+		NotifyReload(func() { called = true })
+		assert.True(t, called)
+		assert.Equal(t, NotifyReloading, recv())
+		assert.Equal(t, NotifyReady, recv())
+	})
+
+	t.Run("Serve", func(t *testing.T) {
+		recv, cleanup := fakeNotifySocket(t)
+		defer cleanup()
+		os.Setenv("WATCHDOG_USEC", "20000")
+		os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+		defer os.Unsetenv("WATCHDOG_USEC")
+		defer os.Unsetenv("WATCHDOG_PID")
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errC := make(chan error, 1)
+		go func() {
+			errC <- Serve(ctx, []net.Listener{l}, ServerFunc(func(ctx context.Context, l net.Listener) error {
+				<-ctx.Done()
+				return nil
+			}))
+		}()
+
+		// We're ready once serving, then ping the watchdog until we stop.
+		assert.Equal(t, NotifyReady, recv())
+		assert.Equal(t, NotifyWatchdog, recv())
+		assert.Equal(t, NotifyWatchdog, recv())
+		cancel()
+		for msg := recv(); msg != NotifyStopping; msg = recv() {
+			assert.Equal(t, NotifyWatchdog, msg)
+		}
+		assert.NoError(t, <-errC)
+
+		t.Run("Draining", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			releaseC := make(chan struct{})
+			errC := make(chan error, 1)
+			go func() {
+				errC <- Serve(ctx, []net.Listener{l}, ServerFunc(func(ctx context.Context, l net.Listener) error {
+					<-ctx.Done()
+					<-releaseC
+					return nil
+				}))
+			}()
+			assert.Equal(t, NotifyReady, recv())
+			cancel()
+			for msg := recv(); msg != NotifyStopping; msg = recv() {
+				assert.Equal(t, NotifyWatchdog, msg)
+			}
+
+			// The watchdog is still pinged until the servers have shut down.
+			assert.Equal(t, NotifyWatchdog, recv())
+			assert.Equal(t, NotifyWatchdog, recv())
+			close(releaseC)
+			assert.NoError(t, <-errC)
+		})
+
+		t.Run("Upgraded", func(t *testing.T) {
+			h := &handover{}
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), handoverKey{}, h))
+			defer cancel()
+			releaseC := make(chan struct{})
+			errC := make(chan error, 1)
+			go func() {
+				errC <- Serve(ctx, []net.Listener{l}, ServerFunc(func(ctx context.Context, l net.Listener) error {
+					<-ctx.Done()
+					<-releaseC
+					return nil
+				}))
+			}()
+			assert.Equal(t, NotifyReady, recv())
+			h.handOver(1234, cancel)
+			for msg := recv(); msg != "MAINPID=1234"; msg = recv() {
+				assert.Equal(t, NotifyWatchdog, msg)
+			}
+
+			// The service belongs to the new process now; stopping or pinging the watchdog
+			// would be taken to be about it. Drain for a few watchdog intervals, then check
+			// that nothing was sent in the meantime.
+			time.Sleep(50 * time.Millisecond)
+			close(releaseC)
+			assert.NoError(t, <-errC)
+			require.NoError(t, Notify("X-TEST=done"))
+			assert.Equal(t, "X-TEST=done", recv())
+		})
 	})
 }
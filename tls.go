@@ -0,0 +1,114 @@
+package pubd
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often CertificateLoader.Watch() checks certificate files for changes.
+var certCheckInterval = 10 * time.Second
+
+// Loads a TLS certificate and key from files, and can reload them without restarting; pass
+// GetCertificate to a tls.Config, and new connections will use whatever's currently loaded.
+type CertificateLoader struct {
+	certFile, keyFile string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	stamps [2]os.FileInfo
+}
+
+// Loads a PEM-encoded certificate (chain) and key.
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	c := &CertificateLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns a server-side tls.Config using the loaded certificate.
+func (c *CertificateLoader) Config() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+func (c *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Returns stamps for the certificate and key files, to tell if they've changed.
+func (c *CertificateLoader) stat() ([2]os.FileInfo, error) {
+	var stamps [2]os.FileInfo
+	for i, filename := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return stamps, err
+		}
+		stamps[i] = info
+	}
+	return stamps, nil
+}
+
+// Reloads the certificate if the files have changed. If they can't be loaded, eg. because
+// they're only halfway written, the old certificate is kept, and an error is returned.
+func (c *CertificateLoader) Reload() (bool, error) {
+	stamps, err := c.stat()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && sameStamps(c.stamps, stamps)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.stamps = &cert, stamps
+	return true, nil
+}
+
+func sameStamps(a, b [2]os.FileInfo) bool {
+	for i := range a {
+		if !a[i].ModTime().Equal(b[i].ModTime()) || a[i].Size() != b[i].Size() {
+			return false
+		}
+	}
+	return true
+}
+
+// Calls Check() periodically until ctx expires. SIGHUP is left to the caller, eg. WatchReload().
+func (c *CertificateLoader) Watch(ctx context.Context, L *zap.Logger) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Check(L)
+		}
+	}
+}
+
+// Calls Reload(), and logs whether the certificate was reloaded, or why it couldn't be.
+func (c *CertificateLoader) Check(L *zap.Logger) {
+	if changed, err := c.Reload(); err != nil {
+		L.Error("Couldn't reload certificate", zap.String("cert", c.certFile), zap.Error(err))
+	} else if changed {
+		L.Info("Certificate reloaded", zap.String("cert", c.certFile))
+	}
+}
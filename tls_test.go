@@ -0,0 +1,114 @@
+package pubd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/pubd/testutil"
+)
+
+func writeCert(t *testing.T, dir, name string) *testutil.Cert {
+	cert, err := testutil.NewCert(name, nil)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), cert.CertPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), cert.KeyPEM, 0600))
+	return cert
+}
+
+func TestCertificateLoader(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	cert1 := writeCert(t, tmp, "127.0.0.1")
+	loader, err := NewCertificateLoader(filepath.Join(tmp, "cert.pem"), filepath.Join(tmp, "key.pem"))
+	require.NoError(t, err)
+
+	ls, err := ListenConfig{TLS: loader.Config()}.Listen("tls/127.0.0.1:0")
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	l := ls[0]
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("hi"))
+				conn.Close()
+			}()
+		}
+	}()
+
+	// Connects, trusting only the given certificate.
+	dial := func(roots *testutil.Cert) (*tls.Conn, error) {
+		return tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots.Pool()})
+	}
+
+	conn1, err := dial(cert1)
+	require.NoError(t, err)
+	defer conn1.Close()
+
+	t.Run("Unchanged", func(t *testing.T) {
+		changed, err := loader.Reload()
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "key.pem"), []byte("garbage"), 0600))
+		_, err := loader.Reload()
+		assert.Error(t, err)
+		conn, err := dial(cert1)
+		require.NoError(t, err, "the old certificate should still be used")
+		conn.Close()
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond) // Make sure modtimes differ on coarse filesystems.
+		cert2 := writeCert(t, tmp, "127.0.0.1")
+		changed, err := loader.Reload()
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		_, err = dial(cert1)
+		assert.Error(t, err)
+		conn, err := dial(cert2)
+		require.NoError(t, err)
+		conn.Close()
+
+		// Existing connections aren't affected.
+		data, err := ioutil.ReadAll(conn1)
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(data))
+	})
+}
+
+func TestListenTLS(t *testing.T) {
+	t.Run("No Config", func(t *testing.T) {
+		_, err := Listen("tls/127.0.0.1:0")
+		assert.EqualError(t, err, "listen/tls: no certificate configured")
+	})
+	t.Run("Not TLS", func(t *testing.T) {
+		_, err := ListenConfig{TLS: &tls.Config{}}.Listen("127.0.0.1:0")
+		assert.EqualError(t, err, "listen/tcp: TLS is configured, but this isn't a tls/ address")
+	})
+	t.Run("Wrapped", func(t *testing.T) {
+		ls, err := ListenConfig{TLS: &tls.Config{}}.Listen("tls/tcp/127.0.0.1:0")
+		require.NoError(t, err)
+		defer ls[0].Close()
+		assert.Equal(t, "tcp", ls[0].Addr().Network())
+		_, isTCP := ls[0].(*net.TCPListener)
+		assert.False(t, isTCP, "listener should be wrapped")
+	})
+}
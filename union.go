@@ -0,0 +1,182 @@
+package pubd
+
+import (
+	"os"
+	"path"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+type unionFileSystem struct {
+	billy.Filesystem // The first layer; all writes go here.
+	layers           []billy.Filesystem
+}
+
+// Returns a filesystem which layers several filesystems on top of each other, like an overlay
+// mount. Files in earlier layers shadow the same paths in later ones, and directories that
+// exist in several layers have their contents merged; a file shadows a directory, though.
+//
+// Anything that modifies the filesystem goes to the first layer.
+func FileSystemUnion(layers ...billy.Filesystem) billy.Filesystem {
+	if len(layers) == 1 {
+		return layers[0]
+	}
+	return unionFileSystem{layers[0], layers}
+}
+
+// Calls fn for each layer, until it returns something other than ErrNotExist, or a layer
+// has a file in place of one of filename's parent directories, shadowing the rest.
+func (fs unionFileSystem) first(filename string, fn func(billy.Filesystem) error) error {
+	err := error(os.ErrNotExist)
+	for _, layer := range fs.layers {
+		if err = fn(layer); !os.IsNotExist(err) || shadowsBelow(layer, filename) {
+			return err
+		}
+	}
+	return err
+}
+
+// Returns whether the closest existing parent of filename in layer isn't a directory.
+func shadowsBelow(layer billy.Filesystem, filename string) bool {
+	for dir := path.Dir(path.Clean("/" + filename)); dir != "/"; dir = path.Dir(dir) {
+		if info, err := layer.Stat(dir); err == nil {
+			return !info.IsDir()
+		}
+	}
+	return false
+}
+
+func (fs unionFileSystem) Open(filename string) (f billy.File, err error) {
+	err = fs.first(filename, func(layer billy.Filesystem) (err error) {
+		f, err = layer.Open(filename)
+		return err
+	})
+	return f, err
+}
+
+// Opening a file for writing always goes to the first layer.
+func (fs unionFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (f billy.File, err error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+	err = fs.first(filename, func(layer billy.Filesystem) (err error) {
+		f, err = layer.OpenFile(filename, flag, perm)
+		return err
+	})
+	return f, err
+}
+
+func (fs unionFileSystem) Stat(filename string) (info os.FileInfo, err error) {
+	err = fs.first(filename, func(layer billy.Filesystem) (err error) {
+		info, err = layer.Stat(filename)
+		return err
+	})
+	return info, err
+}
+
+func (fs unionFileSystem) Lstat(filename string) (info os.FileInfo, err error) {
+	err = fs.first(filename, func(layer billy.Filesystem) (err error) {
+		info, err = layer.Lstat(filename)
+		return err
+	})
+	return info, err
+}
+
+func (fs unionFileSystem) Readlink(link string) (target string, err error) {
+	err = fs.first(link, func(layer billy.Filesystem) (err error) {
+		target, err = layer.Readlink(link)
+		return err
+	})
+	return target, err
+}
+
+// Returns the layers in which filename is a directory, from the first one it exists in,
+// until the first one it's something else in.
+func (fs unionFileSystem) dirLayers(filename string) ([]billy.Filesystem, error) {
+	var layers []billy.Filesystem
+	for _, layer := range fs.layers {
+		info, err := layer.Stat(filename)
+		if os.IsNotExist(err) {
+			if shadowsBelow(layer, filename) {
+				break
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			break
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+func (fs unionFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	layers, err := fs.dirLayers(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		// Let the first layer that has it produce an error, eg. "not a directory".
+		var infos []os.FileInfo
+		err = fs.first(dirname, func(layer billy.Filesystem) (err error) {
+			infos, err = layer.ReadDir(dirname)
+			return err
+		})
+		return infos, err
+	}
+
+	var merged []os.FileInfo
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		infos, err := layer.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !seen[info.Name()] {
+				seen[info.Name()] = true
+				merged = append(merged, info)
+			}
+		}
+	}
+	SortFileInfos(merged)
+	return merged, nil
+}
+
+// The chrooted filesystem is a union of all layers which have dir as a directory.
+func (fs unionFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	layers, err := fs.dirLayers(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, os.ErrNotExist
+	}
+	chroots := make([]billy.Filesystem, len(layers))
+	for i, layer := range layers {
+		if chroots[i], err = layer.Chroot(dir); err != nil {
+			return nil, err
+		}
+	}
+	return FileSystemUnion(chroots...), nil
+}
+
+// Configs come from the first layer which has dir.
+func (fs unionFileSystem) DirConfig(dir string) (cfg DirConfig, err error) {
+	err = fs.first(dir, func(layer billy.Filesystem) error {
+		if _, err := layer.Stat(dir); err != nil {
+			return err
+		}
+		cfg, err = DirConfigOf(layer, dir)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return DirConfig{}, nil
+	}
+	return cfg, err
+}
+
+func (fs unionFileSystem) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.Filesystem)
+}
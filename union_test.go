@@ -0,0 +1,105 @@
+package pubd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readDirNames(t *testing.T, fs billy.Filesystem, dirname string) []string {
+	infos, err := fs.ReadDir(dirname)
+	require.NoError(t, err)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names
+}
+
+func readFile(t *testing.T, fs billy.Filesystem, filename string) string {
+	f, err := fs.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFileSystemUnion(t *testing.T) {
+	// top/
+	//   index.html
+	//   sub/top.txt
+	//   shadow (a file)
+	// bottom/
+	//   index.html
+	//   bottom.txt
+	//   sub/bottom.txt
+	//   shadow/hidden.txt
+	top, bottom := memfs.New(), memfs.New()
+	require.NoError(t, util.WriteFile(top, "index.html", []byte("top"), 0644))
+	require.NoError(t, util.WriteFile(top, "sub/top.txt", []byte("top"), 0644))
+	require.NoError(t, util.WriteFile(top, "shadow", []byte("top"), 0644))
+	require.NoError(t, util.WriteFile(bottom, "index.html", []byte("bottom"), 0644))
+	require.NoError(t, util.WriteFile(bottom, "bottom.txt", []byte("bottom"), 0644))
+	require.NoError(t, util.WriteFile(bottom, "sub/bottom.txt", []byte("bottom"), 0644))
+	require.NoError(t, util.WriteFile(bottom, "shadow/hidden.txt", []byte("bottom"), 0644))
+	fs := FileSystemUnion(top, bottom)
+
+	t.Run("Open", func(t *testing.T) {
+		testdata := map[string]string{
+			"index.html":     "top",
+			"bottom.txt":     "bottom",
+			"sub/top.txt":    "top",
+			"sub/bottom.txt": "bottom",
+			"shadow":         "top",
+		}
+		for name, content := range testdata {
+			t.Run(name, func(t *testing.T) {
+				assert.Equal(t, content, readFile(t, fs, name))
+			})
+		}
+
+		t.Run("shadow/hidden.txt", func(t *testing.T) {
+			_, err := fs.Stat("shadow/hidden.txt")
+			assert.Error(t, err)
+		})
+		t.Run("shadow/", func(t *testing.T) {
+			infos, _ := fs.ReadDir("shadow")
+			assert.Empty(t, infos)
+			_, err := fs.Chroot("shadow")
+			assert.Error(t, err)
+		})
+		t.Run("missing.txt", func(t *testing.T) {
+			_, err := fs.Open("missing.txt")
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		assert.Equal(t, []string{"bottom.txt", "index.html", "shadow", "sub"}, readDirNames(t, fs, "/"))
+		assert.Equal(t, []string{"bottom.txt", "top.txt"}, readDirNames(t, fs, "sub"))
+
+		infos, err := fs.ReadDir("/")
+		require.NoError(t, err)
+		assert.False(t, infos[2].IsDir(), "shadow should be the top layer's file")
+	})
+
+	t.Run("Chroot", func(t *testing.T) {
+		sub, err := fs.Chroot("sub")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bottom.txt", "top.txt"}, readDirNames(t, sub, "/"))
+		assert.Equal(t, "bottom", readFile(t, sub, "bottom.txt"))
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		require.NoError(t, util.WriteFile(fs, "bottom.txt", []byte("new"), 0644))
+		assert.Equal(t, "new", readFile(t, top, "bottom.txt"))
+		assert.Equal(t, "bottom", readFile(t, bottom, "bottom.txt"))
+	})
+}
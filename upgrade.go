@@ -0,0 +1,303 @@
+package pubd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Environment variables used to hand listeners to a new process; see Upgrade().
+const (
+	upgradeEnvFDs   = "PUBD_UPGRADE_FDS"      // JSON object of addresses to file descriptors.
+	upgradeEnvReady = "PUBD_UPGRADE_READY_FD" // Write a byte here once serving.
+)
+
+// How long a new process gets to start serving, before we give up on it.
+var upgradeTimeout = time.Minute
+
+// The command Upgrade() runs; swappable for testing.
+var upgradeCommand = func() (string, []string, error) {
+	exe, err := os.Executable()
+	return exe, os.Args[1:], err
+}
+
+// Listeners opened by Listen(), by address, so they can be handed to a new process;
+// and ones handed to us by a previous process, which Listen() hasn't claimed yet.
+var listeners struct {
+	sync.Mutex
+	open      map[*trackedListener]struct{}
+	inherited map[string][]net.Listener
+	once      sync.Once
+}
+
+type trackedListener struct {
+	net.Listener
+	addr string
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	return drainListener{l.Listener}.Accept()
+}
+
+func (l *trackedListener) Close() error {
+	listeners.Lock()
+	delete(listeners.open, l)
+	listeners.Unlock()
+	return l.Listener.Close()
+}
+
+// Returns listeners a previous process handed over for rawAddr, if any, or calls fn. Either way,
+// they're remembered, so they can be handed over to the next process in turn.
+func inheritOrListen(rawAddr string, fn func() ([]net.Listener, error)) ([]net.Listener, error) {
+	listeners.once.Do(loadInherited)
+	listeners.Lock()
+	ls, ok := listeners.inherited[rawAddr]
+	delete(listeners.inherited, rawAddr)
+	listeners.Unlock()
+	if !ok {
+		var err error
+		if ls, err = fn(); err != nil {
+			return nil, err
+		}
+	}
+
+	listeners.Lock()
+	defer listeners.Unlock()
+	if listeners.open == nil {
+		listeners.open = make(map[*trackedListener]struct{})
+	}
+	for i, l := range ls {
+		tl := &trackedListener{l, rawAddr}
+		listeners.open[tl] = struct{}{}
+		ls[i] = tl
+	}
+	return ls, nil
+}
+
+// Picks up listeners from the process that started us with Upgrade(), if any.
+func loadInherited() {
+	data := os.Getenv(upgradeEnvFDs)
+	os.Unsetenv(upgradeEnvFDs)
+	if data == "" {
+		return
+	}
+	var fds map[string][]int
+	if err := json.Unmarshal([]byte(data), &fds); err != nil {
+		return
+	}
+	listeners.inherited = make(map[string][]net.Listener, len(fds))
+	for addr, addrFDs := range fds {
+		for _, fd := range addrFDs {
+			f := os.NewFile(uintptr(fd), "inherited/"+addr)
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				continue
+			}
+			listeners.inherited[addr] = append(listeners.inherited[addr], l)
+		}
+	}
+}
+
+var upgradeReadyOnce sync.Once
+
+// Tells the process that started us with Upgrade() that we're serving; see Serve().
+func upgradeReady() {
+	upgradeReadyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(upgradeEnvReady))
+		os.Unsetenv(upgradeEnvReady)
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "upgrade-ready")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
+
+// Re-executes the running binary (which may have been replaced on disk) with the same arguments,
+// handing it all listeners opened by Listen(), and waits for it to start serving; the caller
+// should then shut down gracefully. If it fails or times out, it's killed, and nothing changes.
+func Upgrade(ctx context.Context) (_ *os.Process, err error) {
+	exe, args, err := upgradeCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dup all listeners; the new process gets them as fd 3, 4, 5... in order.
+	var files []*os.File
+	var unixListeners []*net.UnixListener
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			for _, ul := range unixListeners {
+				ul.SetUnlinkOnClose(true)
+			}
+		}
+	}()
+	fds := make(map[string][]int)
+	listeners.Lock()
+	for l := range listeners.open {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			listeners.Unlock()
+			return nil, fmt.Errorf("%s: can't hand over a %T", l.addr, l.Listener)
+		}
+		var f *os.File
+		if f, err = filer.File(); err != nil {
+			listeners.Unlock()
+			return nil, fmt.Errorf("%s: %w", l.addr, err)
+		}
+		// Don't delete unix sockets out from under the new process when we close them.
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+			unixListeners = append(unixListeners, ul)
+		}
+		fds[l.addr] = append(fds[l.addr], 3+len(files))
+		files = append(files, f)
+	}
+	listeners.Unlock()
+	fdsJSON, err := json.Marshal(fds)
+	if err != nil {
+		return nil, err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(upgradeEnviron(),
+		upgradeEnvFDs+"="+string(fdsJSON),
+		upgradeEnvReady+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The child writes a byte once it's serving; if it exits first, we get an EOF instead.
+	readyC := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		readyC <- err
+	}()
+	timeout := time.NewTimer(upgradeTimeout)
+	defer timeout.Stop()
+	select {
+	case err = <-readyC:
+		if errors.Is(err, io.EOF) {
+			err = errors.New("new process exited before it was ready")
+		}
+	case <-timeout.C:
+		err = errors.New("timed out waiting for the new process")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	go cmd.Wait() // Don't leave a zombie behind if it exits before we do.
+	return cmd.Process, nil
+}
+
+// Returns our environment, minus anything that only applies to this process.
+func upgradeEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch kv[:strings.IndexByte(kv+"=", '=')] {
+		case upgradeEnvFDs, upgradeEnvReady, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// Returns a context which is cancelled after a successful Upgrade(), which is triggered by
+// SIGUSR2. Pass it to Serve(), and we'll drain existing connections and exit afterwards.
+func WithUpgradeHandler(ctx context.Context, L *zap.Logger) context.Context {
+	if upgradeSignal == nil {
+		return ctx
+	}
+	h := &handover{}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, handoverKey{}, h))
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, upgradeSignal)
+	go func() {
+		defer signal.Stop(sigC)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigC:
+			}
+			L.Info("Upgrading...")
+			proc, err := Upgrade(ctx)
+			if err != nil {
+				L.Error("Upgrade failed", zap.Error(err))
+				continue
+			}
+			L.Info("New process is serving, shutting down", zap.Int("pid", proc.Pid))
+			h.handOver(proc.Pid, cancel)
+			return
+		}
+	}()
+	return ctx
+}
+
+// Context key for the *handover of a WithUpgradeHandler() context.
+type handoverKey struct{}
+
+// Tracks whether the service has been handed over to a new process. From then on, the service
+// belongs to it: telling systemd we're stopping, or pinging its watchdog, would now be about the
+// new process, and with NotifyAccess=all, get it killed.
+type handover struct {
+	mu   sync.Mutex
+	done bool
+}
+
+// Tells the service manager that pid is now the main process, and cancels our context.
+func (h *handover) handOver(pid int, cancel context.CancelFunc) {
+	h.mu.Lock()
+	h.done = true
+	Notify("MAINPID=" + strconv.Itoa(pid))
+	h.mu.Unlock()
+	cancel()
+}
+
+// Like Notify(), but does nothing (and returns false) if ctx is from WithUpgradeHandler(), and
+// the service has been handed over to a new process.
+func notifyUnlessHandedOver(ctx context.Context, state string) (bool, error) {
+	h, _ := ctx.Value(handoverKey{}).(*handover)
+	if h == nil {
+		return true, Notify(state)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return false, nil
+	}
+	return true, Notify(state)
+}
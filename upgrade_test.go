@@ -0,0 +1,142 @@
+package pubd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Forgets about inherited listeners, as if we'd just started.
+func resetInherited() {
+	listeners.Lock()
+	listeners.inherited = nil
+	listeners.once = sync.Once{}
+	listeners.Unlock()
+}
+
+func TestListenInherited(t *testing.T) {
+	defer resetInherited()
+	l, f := listenerFD(t)
+	defer l.Close()
+	defer f.Close()
+
+	fds, err := json.Marshal(map[string][]int{"127.0.0.1:0": {int(f.Fd())}})
+	require.NoError(t, err)
+	os.Setenv(upgradeEnvFDs, string(fds))
+	defer os.Unsetenv(upgradeEnvFDs)
+	resetInherited()
+
+	ls, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ls[0].Close()
+	assert.Equal(t, l.Addr().String(), ls[0].Addr().String())
+	assert.Empty(t, os.Getenv(upgradeEnvFDs))
+
+	// It can only be claimed once; the next Listen() gets a new listener.
+	ls2, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ls2[0].Close()
+	assert.NotEqual(t, l.Addr().String(), ls2[0].Addr().String())
+}
+
+func TestListenTracked(t *testing.T) {
+	ls, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	tl, ok := ls[0].(*trackedListener)
+	require.True(t, ok, "%T", ls[0])
+	assert.Equal(t, "127.0.0.1:0", tl.addr)
+
+	listeners.Lock()
+	_, ok = listeners.open[tl]
+	listeners.Unlock()
+	assert.True(t, ok, "should be tracked")
+
+	require.NoError(t, ls[0].Close())
+	listeners.Lock()
+	_, ok = listeners.open[tl]
+	listeners.Unlock()
+	assert.False(t, ok, "should be untracked once closed")
+}
+
+// Run as a child process by TestUpgrade; serves one "hi from the new process" on the handed over
+// listener, or exits straight away if PUBD_TEST_UPGRADE_HELPER=fail.
+func TestUpgradeHelper(t *testing.T) {
+	mode := os.Getenv("PUBD_TEST_UPGRADE_HELPER")
+	if mode == "" {
+		t.Skip("only run by TestUpgrade")
+	}
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	ls, err := Listen(mode)
+	if err != nil {
+		os.Exit(2)
+	}
+	Serve(context.Background(), ls, ServerFunc(func(ctx context.Context, l net.Listener) error {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		conn.Write([]byte("hi from the new process"))
+		conn.Close()
+		return nil
+	}))
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	defer func(fn func() (string, []string, error)) { upgradeCommand = fn }(upgradeCommand)
+	upgradeCommand = func() (string, []string, error) {
+		return os.Args[0], []string{"-test.run=^TestUpgradeHelper$"}, nil
+	}
+	defer os.Unsetenv("PUBD_TEST_UPGRADE_HELPER")
+
+	ls, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ls[0].Close()
+	addr := ls[0].Addr().String()
+
+	t.Run("Fail", func(t *testing.T) {
+		os.Setenv("PUBD_TEST_UPGRADE_HELPER", "fail")
+		_, err := Upgrade(context.Background())
+		assert.EqualError(t, err, "new process exited before it was ready")
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		os.Setenv("PUBD_TEST_UPGRADE_HELPER", "127.0.0.1:0")
+		proc, err := Upgrade(context.Background())
+		require.NoError(t, err)
+		assert.NotEqual(t, os.Getpid(), proc.Pid)
+
+		// Once we stop accepting, connections go to the new process.
+		require.NoError(t, ls[0].Close())
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		data, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "hi from the new process", string(data))
+	})
+}
+
+func TestUpgradeEnviron(t *testing.T) {
+	for _, k := range []string{upgradeEnvFDs, upgradeEnvReady, "LISTEN_FDS", "WATCHDOG_PID"} {
+		os.Setenv(k, "1")
+		defer os.Unsetenv(k)
+	}
+	os.Setenv("PUBD_TEST_KEEP", "1")
+	defer os.Unsetenv("PUBD_TEST_KEEP")
+
+	env := upgradeEnviron()
+	assert.Contains(t, env, "PUBD_TEST_KEEP=1")
+	for _, k := range []string{upgradeEnvFDs, upgradeEnvReady, "LISTEN_FDS", "WATCHDOG_PID"} {
+		assert.NotContains(t, env, k+"=1")
+	}
+}
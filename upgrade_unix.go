@@ -0,0 +1,11 @@
+// +build !windows
+
+package pubd
+
+import (
+	"os"
+	"syscall"
+)
+
+// Triggers WithUpgradeHandler().
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,8 @@
+package pubd
+
+import (
+	"os"
+)
+
+// Upgrades aren't supported on Windows.
+var upgradeSignal os.Signal
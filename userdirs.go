@@ -0,0 +1,271 @@
+package pubd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// How long users' filesystems (or the errors from opening them) are cached.
+var userDirTTL = 10 * time.Second
+
+// Opens a user's directory for FileSystemUserDirs. Returning os.ErrNotExist hides the user.
+// If the filesystem is an io.Closer, it's closed once it's dropped from the cache.
+type UserDirFunc func(username string) (billy.Filesystem, error)
+
+type userDir struct {
+	openedAt time.Time
+	fs       billy.Filesystem
+	err      error
+}
+
+func (u *userDir) close() {
+	if c, ok := u.fs.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+type userDirFileSystem struct {
+	readOnlyFS
+	open UserDirFunc
+
+	mu    sync.Mutex
+	users map[string]*userDir
+}
+
+// Returns a filesystem which serves users' directories as "/~user/", like Apache's mod_userdir.
+// Directories are opened by calling open() the first time they're accessed, and the result is
+// cached for a few seconds; nothing but the users' directories exists, and the root directory
+// is always empty, so as not to list every account on the system.
+func FileSystemUserDirs(open UserDirFunc) billy.Filesystem {
+	return &userDirFileSystem{open: open, users: make(map[string]*userDir)}
+}
+
+// Returns the user's filesystem for filename, and the path relative to it. Returns a nil
+// filesystem for the root.
+func (fs *userDirFileSystem) resolve(filename string) (billy.Filesystem, string, error) {
+	segments := splitPath(filename)
+	if len(segments) == 0 {
+		return nil, "", nil
+	}
+	if !strings.HasPrefix(segments[0], "~") || len(segments[0]) == 1 {
+		return nil, "", os.ErrNotExist
+	}
+	ufs, err := fs.user(segments[0][1:])
+	if err != nil {
+		return nil, "", err
+	}
+	return ufs, "/" + path.Join(segments[1:]...), nil
+}
+
+// Returns the (possibly cached) filesystem for a user.
+func (fs *userDirFileSystem) user(username string) (billy.Filesystem, error) {
+	if u := fs.cached(username, time.Now()); u != nil {
+		return u.fs, u.err
+	}
+
+	// Opening a directory can be slow (looking up the user, reading config files), so don't
+	// hold everyone else up meanwhile. If someone else opens it at the same time, the first
+	// one to finish wins, and the other is closed again.
+	now := time.Now()
+	ufs, err := fs.open(username)
+	next := &userDir{openedAt: now, fs: ufs, err: err}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if u := fs.cachedLocked(username, now); u != nil {
+		next.close()
+		return u.fs, u.err
+	}
+	// Throw out stale entries, so requests for random usernames can't fill up the cache.
+	for name, u := range fs.users {
+		if now.Sub(u.openedAt) >= userDirTTL {
+			delete(fs.users, name)
+			u.close()
+		}
+	}
+	fs.users[username] = next
+	return ufs, err
+}
+
+// Returns a user's cached directory, if it's not stale yet.
+func (fs *userDirFileSystem) cached(username string, now time.Time) *userDir {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.cachedLocked(username, now)
+}
+
+func (fs *userDirFileSystem) cachedLocked(username string, now time.Time) *userDir {
+	if u := fs.users[username]; u != nil && now.Sub(u.openedAt) < userDirTTL {
+		return u
+	}
+	return nil
+}
+
+func (fs *userDirFileSystem) rootInfo() os.FileInfo {
+	return fileInfo{name: "/", mode: os.ModeDir | 0555, modTime: time.Unix(0, 0)}
+}
+
+func (fs *userDirFileSystem) Create(filename string) (billy.File, error) {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil || ufs == nil {
+		return nil, orReadOnly(err)
+	}
+	return ufs.Create(rpath)
+}
+
+func (fs *userDirFileSystem) Open(filename string) (billy.File, error) {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil {
+		return nil, fmt.Errorf("%s: is a directory", filename)
+	}
+	return ufs.Open(rpath)
+}
+
+func (fs *userDirFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil {
+		if fs.isWrite(flag) {
+			return nil, billy.ErrReadOnly
+		}
+		return nil, fmt.Errorf("%s: is a directory", filename)
+	}
+	return ufs.OpenFile(rpath, flag, perm)
+}
+
+// A user's directory is named after the user, eg. "~alice".
+func (fs *userDirFileSystem) Stat(filename string) (os.FileInfo, error) {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil {
+		return fs.rootInfo(), nil
+	}
+	info, err := ufs.Stat(rpath)
+	if err != nil || rpath != "/" {
+		return info, err
+	}
+	return fileInfo{name: splitPath(filename)[0], size: info.Size(), mode: info.Mode(), modTime: info.ModTime()}, nil
+}
+
+func (fs *userDirFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil || rpath == "/" {
+		return fs.Stat(filename)
+	}
+	return ufs.Lstat(rpath)
+}
+
+func (fs *userDirFileSystem) Readlink(link string) (string, error) {
+	ufs, rpath, err := fs.resolve(link)
+	if err != nil {
+		return "", err
+	} else if ufs == nil {
+		return "", fmt.Errorf("%s: not a symlink", link)
+	}
+	return ufs.Readlink(rpath)
+}
+
+// Renaming files between users isn't supported, like across filesystems.
+func (fs *userDirFileSystem) Rename(oldpath, newpath string) error {
+	oldFS, oldRPath, err := fs.resolve(oldpath)
+	if err != nil || oldFS == nil {
+		return orReadOnly(err)
+	}
+	newFS, newRPath, err := fs.resolve(newpath)
+	if err != nil || newFS == nil {
+		return orReadOnly(err)
+	}
+	if splitPath(oldpath)[0] != splitPath(newpath)[0] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return oldFS.Rename(oldRPath, newRPath)
+}
+
+func (fs *userDirFileSystem) Remove(filename string) error {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil || ufs == nil || rpath == "/" {
+		return orReadOnly(err)
+	}
+	return ufs.Remove(rpath)
+}
+
+func (fs *userDirFileSystem) MkdirAll(filename string, perm os.FileMode) error {
+	ufs, rpath, err := fs.resolve(filename)
+	if err != nil || ufs == nil {
+		return err
+	}
+	return ufs.MkdirAll(rpath, perm)
+}
+
+func (fs *userDirFileSystem) Symlink(target, link string) error {
+	ufs, rpath, err := fs.resolve(link)
+	if err != nil || ufs == nil {
+		return orReadOnly(err)
+	}
+	return ufs.Symlink(target, rpath)
+}
+
+func (fs *userDirFileSystem) TempFile(dir, prefix string) (billy.File, error) {
+	ufs, rpath, err := fs.resolve(dir)
+	if err != nil || ufs == nil {
+		return nil, orReadOnly(err)
+	}
+	return ufs.TempFile(rpath, prefix)
+}
+
+func (fs *userDirFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	ufs, rpath, err := fs.resolve(dirname)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil {
+		return []os.FileInfo{}, nil
+	}
+	return ufs.ReadDir(rpath)
+}
+
+func (fs *userDirFileSystem) Chroot(dir string) (billy.Filesystem, error) {
+	ufs, rpath, err := fs.resolve(dir)
+	if err != nil {
+		return nil, err
+	} else if ufs == nil {
+		return fs, nil
+	}
+	return ufs.Chroot(rpath)
+}
+
+func (fs *userDirFileSystem) DirConfig(dir string) (DirConfig, error) {
+	ufs, rpath, err := fs.resolve(dir)
+	if err != nil || ufs == nil {
+		return DirConfig{}, err
+	}
+	return DirConfigOf(ufs, rpath)
+}
+
+func (fs *userDirFileSystem) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities
+}
+
+func (fs *userDirFileSystem) Join(elem ...string) string { return filepath.Join(elem...) }
+
+// Returns err, or ErrReadOnly if it's nil; for writes to the read-only root.
+func orReadOnly(err error) error {
+	if err == nil {
+		return billy.ErrReadOnly
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package pubd
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSystemUserDirs(t *testing.T) {
+	alice := memfs.New()
+	require.NoError(t, util.WriteFile(alice, "index.html", []byte("alice"), 0644))
+	opened := map[string]int{}
+	fs := FileSystemUserDirs(func(username string) (billy.Filesystem, error) {
+		opened[username]++
+		if username == "alice" {
+			return alice, nil
+		}
+		return nil, os.ErrNotExist
+	})
+
+	assert.Equal(t, "alice", readFile(t, fs, "/~alice/index.html"))
+	assert.Equal(t, []string{"index.html"}, readDirNames(t, fs, "/~alice"))
+	info, err := fs.Stat("/~alice/")
+	require.NoError(t, err)
+	assert.Equal(t, "~alice", info.Name())
+	assert.True(t, info.IsDir())
+
+	assert.Empty(t, readDirNames(t, fs, "/"), "users shouldn't be listed")
+	for _, name := range []string{"/~bob/index.html", "/~/index.html", "/alice/index.html"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := fs.Open(name)
+			assert.True(t, os.IsNotExist(err), "%v", err)
+		})
+	}
+
+	// Lookups are cached, including failed ones.
+	_, _ = fs.Stat("/~bob")
+	assert.Equal(t, map[string]int{"alice": 1, "bob": 1}, opened)
+
+	assert.Equal(t, billy.ErrReadOnly, fs.Remove("/~alice"))
+	assert.Error(t, fs.Rename("/~alice/index.html", "/~bob/index.html"))
+}
+
+type closerFS struct {
+	billy.Filesystem
+	closed *int
+}
+
+func (fs closerFS) Close() error {
+	*fs.closed++
+	return nil
+}
+
+func TestFileSystemUserDirsClose(t *testing.T) {
+	defer func(ttl time.Duration) { userDirTTL = ttl }(userDirTTL)
+	userDirTTL = 0
+
+	closed := 0
+	fs := FileSystemUserDirs(func(username string) (billy.Filesystem, error) {
+		ufs := memfs.New()
+		require.NoError(t, util.WriteFile(ufs, "index.html", []byte("alice"), 0644))
+		return closerFS{ufs, &closed}, nil
+	})
+	for i := 0; i < 3; i++ {
+		_, err := fs.Stat("/~alice/index.html")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, closed, "replaced filesystems should be closed")
+}
+
+func TestFileSystemUserDirsConcurrent(t *testing.T) {
+	closed := 0
+	openingC := make(chan string, 2)
+	releaseC := map[string]chan struct{}{"slow": make(chan struct{}), "alice": make(chan struct{})}
+	fs := FileSystemUserDirs(func(username string) (billy.Filesystem, error) {
+		openingC <- username
+		if c := releaseC[username]; c != nil {
+			<-c
+		}
+		ufs := memfs.New()
+		require.NoError(t, util.WriteFile(ufs, "index.html", []byte(username), 0644))
+		return closerFS{ufs, &closed}, nil
+	})
+
+	// Someone else's slow directory doesn't hold up the rest.
+	slowC := make(chan error, 1)
+	go func() {
+		_, err := fs.Stat("/~slow/index.html")
+		slowC <- err
+	}()
+	assert.Equal(t, "slow", <-openingC)
+	go fs.Stat("/~bob/index.html")
+	select {
+	case name := <-openingC:
+		assert.Equal(t, "bob", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening a directory blocked another one from being opened")
+	}
+	close(releaseC["slow"])
+	assert.NoError(t, <-slowC)
+
+	// If two requests open the same directory at once, only one of them is kept.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fs.Stat("/~alice/index.html")
+			assert.NoError(t, err)
+		}()
+	}
+	<-openingC
+	<-openingC
+	close(releaseC["alice"])
+	wg.Wait()
+	assert.Equal(t, 1, closed, "the losing filesystem should be closed")
+}
@@ -0,0 +1,205 @@
+package pubd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"go.uber.org/zap"
+)
+
+// Kind of change reported by a Watcher.
+type EventOp int
+
+const (
+	EventCreate   EventOp = iota + 1 // A file or directory was created.
+	EventModify                      // A file's contents or attributes changed.
+	EventDelete                      // A file or directory was deleted.
+	EventRename                      // A file or directory was moved from Event.From to Event.Path.
+	EventOverflow                    // Events were lost; anything may have changed.
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventModify:
+		return "modify"
+	case EventDelete:
+		return "delete"
+	case EventRename:
+		return "rename"
+	case EventOverflow:
+		return "overflow"
+	default:
+		return fmt.Sprintf("EventOp(%d)", int(op))
+	}
+}
+
+// A change to a watched tree. Paths are slash-separated, with a leading slash.
+type Event struct {
+	Op    EventOp
+	Path  string
+	From  string // The old path, for renames.
+	IsDir bool
+}
+
+func (ev Event) String() string {
+	if ev.Op == EventRename {
+		return fmt.Sprintf("%s %s -> %s", ev.Op, ev.From, ev.Path)
+	}
+	return fmt.Sprintf("%s %s", ev.Op, ev.Path)
+}
+
+// Reports changes to a served tree. The channel is closed when the context the watcher was
+// created with expires, or if it fails; this is logged.
+//
+// Events for files rejected by the watcher's filter, or anything inside of a rejected
+// directory, are never reported. A rename between a rejected and an allowed path is reported
+// as a creation or deletion of the allowed one.
+type Watcher interface {
+	Events() <-chan Event
+}
+
+// Returns a Watcher for fs. If root is the host directory backing fs, it's watched with inotify
+// where that's available; otherwise, or if that fails, fs is polled every interval. If interval
+// is zero, there's no fallback, and an error is returned instead; fs may be nil then.
+// filter may be nil, eg. if fs is already filtered.
+func NewWatcher(ctx context.Context, L *zap.Logger, fs billy.Filesystem, root string, filter Filter, interval time.Duration) (Watcher, error) {
+	if filter == nil {
+		filter = func(string, os.FileMode) bool { return true }
+	}
+	if root != "" {
+		w, err := newInotifyWatcher(ctx, L, root, filter)
+		if err == nil {
+			return w, nil
+		} else if interval <= 0 {
+			return nil, err
+		}
+		L.Warn("Couldn't watch for changes with inotify, polling instead", zap.Error(err))
+	} else if interval <= 0 {
+		return nil, errors.New("no host directory to watch, and no polling interval")
+	}
+	return NewPollWatcher(ctx, L, fs, filter, interval), nil
+}
+
+// Size of Watchers' event buffers.
+const watcherBuffer = 64
+
+// Snapshot of a file, used to detect changes by polling.
+type pollState struct {
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+}
+
+type pollWatcher struct {
+	L      *zap.Logger
+	fs     billy.Filesystem
+	filter Filter
+	c      chan Event
+	state  map[string]pollState
+}
+
+// Returns a Watcher which walks fs every interval, comparing it to the previous walk. This
+// works with any filesystem, eg. memfs, but can't tell renames apart from a deletion and a
+// creation, and doesn't notice changes that happen within a single interval.
+func NewPollWatcher(ctx context.Context, L *zap.Logger, fs billy.Filesystem, filter Filter, interval time.Duration) Watcher {
+	if filter == nil {
+		filter = func(string, os.FileMode) bool { return true }
+	}
+	w := &pollWatcher{L: L, fs: fs, filter: filter, c: make(chan Event, watcherBuffer)}
+	w.state = w.walk()
+	go w.run(ctx, interval)
+	return w
+}
+
+func (w *pollWatcher) Events() <-chan Event { return w.c }
+
+func (w *pollWatcher) run(ctx context.Context, interval time.Duration) {
+	defer close(w.c)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		state := w.walk()
+		for _, ev := range w.diff(w.state, state) {
+			select {
+			case w.c <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		w.state = state
+	}
+}
+
+// Returns the state of every allowed file in the tree.
+func (w *pollWatcher) walk() map[string]pollState {
+	start := time.Now()
+	state := make(map[string]pollState)
+	var walk func(dir string)
+	walk = func(dir string) {
+		infos, err := w.fs.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				w.L.Debug("Couldn't read directory", zap.String("path", dir), zap.Error(err))
+			}
+			return
+		}
+		for _, info := range infos {
+			name := path.Join(dir, info.Name())
+			if !w.filter(name, info.Mode()) {
+				continue
+			}
+			// Some filesystems (eg. memfs) just return the current time; ignore those.
+			modTime := info.ModTime()
+			if !modTime.Before(start) {
+				modTime = time.Time{}
+			}
+			state[name] = pollState{info.Mode(), info.Size(), modTime}
+			if info.IsDir() {
+				walk(name)
+			}
+		}
+	}
+	walk("/")
+	return state
+}
+
+// Returns events turning old into new; creations parent-first, deletions children-first.
+func (w *pollWatcher) diff(old, new map[string]pollState) []Event {
+	var events []Event
+	for name, st := range new {
+		if ost, ok := old[name]; !ok {
+			events = append(events, Event{Op: EventCreate, Path: name, IsDir: st.mode.IsDir()})
+		} else if ost.mode != st.mode || (!st.mode.IsDir() && (ost.size != st.size || !ost.modTime.Equal(st.modTime))) {
+			events = append(events, Event{Op: EventModify, Path: name, IsDir: st.mode.IsDir()})
+		}
+	}
+	for name, ost := range old {
+		if _, ok := new[name]; !ok {
+			events = append(events, Event{Op: EventDelete, Path: name, IsDir: ost.mode.IsDir()})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if (a.Op == EventDelete) != (b.Op == EventDelete) {
+			return b.Op == EventDelete
+		}
+		if a.Op == EventDelete {
+			return a.Path > b.Path
+		}
+		return a.Path < b.Path
+	})
+	return events
+}
@@ -0,0 +1,299 @@
+package pubd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// Events reported by inotify Watchers; CLOSE_WRITE rather than MODIFY, to get one event
+// per write instead of one per write() call.
+const watcherInotifyMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+type inotifyWatcher struct {
+	L      *zap.Logger
+	in     *inotify
+	root   string
+	filter Filter
+	c      chan Event
+	done   <-chan struct{}
+
+	// Only touched by the goroutine reading events, after construction.
+	wds  map[int32]string // Watch descriptor -> directory, relative to root.
+	dirs map[string]int32
+	seen map[string]bool // Allowed paths; once they're gone, they can't be filtered anymore.
+	full bool            // Set when we've run out of watches.
+}
+
+// A MOVED_FROM event waiting for its MOVED_TO.
+type inotifyMove struct {
+	path    string
+	isDir   bool
+	visible bool
+}
+
+// Watches root and every allowed directory below it with inotify.
+func newInotifyWatcher(ctx context.Context, L *zap.Logger, root string, filter Filter) (Watcher, error) {
+	in, err := newInotify()
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		L:      L,
+		in:     in,
+		root:   root,
+		filter: filter,
+		c:      make(chan Event, watcherBuffer),
+		done:   ctx.Done(),
+		wds:    make(map[int32]string),
+		dirs:   make(map[string]int32),
+		seen:   make(map[string]bool),
+	}
+	if err := w.addTree("/", false); err != nil {
+		in.close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		w.in.close()
+	}()
+	go func() {
+		defer close(w.c)
+		err := w.in.run(w.handle)
+		L.Debug("Stopped watching for changes", zap.Error(err))
+	}()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan Event { return w.c }
+
+// Sends an event. Returns false if the watcher is shutting down.
+func (w *inotifyWatcher) emit(ev Event) bool {
+	select {
+	case w.c <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// Watches dir and all allowed directories below it. If report is true, creation events are
+// sent for everything found, as they may have appeared before the watches were in place.
+// Only errors watching dir itself are returned; anything below it is skipped, and logged.
+func (w *inotifyWatcher) addTree(dir string, report bool) error {
+	wd, err := w.in.addWatch(filepath.Join(w.root, dir), watcherInotifyMask)
+	if err != nil {
+		return err
+	}
+	w.wds[wd] = dir
+	w.dirs[dir] = wd
+
+	infos, err := ioutil.ReadDir(filepath.Join(w.root, dir))
+	if err != nil {
+		w.L.Debug("Couldn't read directory", zap.String("path", dir), zap.Error(err))
+		return nil
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if !w.filter(name, info.Mode()) {
+			continue
+		}
+		w.seen[name] = true
+		if report && !w.emit(Event{Op: EventCreate, Path: name, IsDir: info.IsDir()}) {
+			return nil
+		}
+		if info.IsDir() {
+			w.watchTree(name, report)
+		}
+	}
+	return nil
+}
+
+// Like addTree(), but logs errors.
+func (w *inotifyWatcher) watchTree(dir string, report bool) {
+	err := w.addTree(dir, report)
+	if errors.Is(err, syscall.ENOSPC) {
+		if !w.full {
+			w.L.Warn("Out of inotify watches; raise fs.inotify.max_user_watches", zap.String("path", dir))
+			w.full = true
+		}
+	} else if err != nil {
+		w.L.Debug("Couldn't watch directory", zap.String("path", dir), zap.Error(err))
+	}
+}
+
+// Returns whether name is dir or below it.
+func isBelow(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Stops watching dir and everything below it, and forgets that any of it was allowed.
+func (w *inotifyWatcher) removeTree(dir string) {
+	for name, wd := range w.dirs {
+		if isBelow(name, dir) {
+			w.in.rmWatch(wd)
+			delete(w.wds, wd)
+			delete(w.dirs, name)
+		}
+	}
+	for name := range w.seen {
+		if isBelow(name, dir) {
+			delete(w.seen, name)
+		}
+	}
+}
+
+// Updates the paths of watched directories after a rename; the watches move along.
+func (w *inotifyWatcher) renameTree(from, to string) {
+	for name, wd := range w.dirs {
+		if isBelow(name, from) {
+			newName := to + strings.TrimPrefix(name, from)
+			delete(w.dirs, name)
+			w.dirs[newName] = wd
+			w.wds[wd] = newName
+		}
+	}
+	for name := range w.seen {
+		if isBelow(name, from) {
+			delete(w.seen, name)
+			w.seen[to+strings.TrimPrefix(name, from)] = true
+		}
+	}
+}
+
+// Checks name against the filter with its real mode, and remembers it if it's allowed.
+// Anything that can't be Lstat()ed, eg. because it's already gone again, isn't.
+func (w *inotifyWatcher) allow(name string) bool {
+	info, err := os.Lstat(filepath.Join(w.root, name))
+	if err != nil || !w.filter(name, info.Mode()) {
+		return false
+	}
+	w.seen[name] = true
+	return true
+}
+
+// Forgets about name, and anything below it if it's a directory. Returns whether it was allowed.
+func (w *inotifyWatcher) forget(name string, isDir bool) bool {
+	seen := w.seen[name]
+	if isDir {
+		w.removeTree(name)
+	} else {
+		delete(w.seen, name)
+	}
+	return seen
+}
+
+func (w *inotifyWatcher) handle(events []inotifyEvent) {
+	moves := make(map[uint32]inotifyMove)
+	for _, ev := range events {
+		if ev.mask&syscall.IN_Q_OVERFLOW != 0 {
+			if !w.emit(Event{Op: EventOverflow, Path: "/"}) {
+				return
+			}
+			continue
+		}
+		dir, ok := w.wds[ev.wd]
+		if !ok {
+			continue
+		}
+		if ev.mask&syscall.IN_IGNORED != 0 {
+			delete(w.wds, ev.wd)
+			if w.dirs[dir] == ev.wd {
+				delete(w.dirs, dir)
+			}
+			continue
+		}
+		if ev.name == "" {
+			continue // Events about the directory itself are reported through its parent.
+		}
+
+		name := path.Join(dir, ev.name)
+		isDir := ev.mask&syscall.IN_ISDIR != 0
+
+		cont := true
+		switch {
+		case ev.mask&syscall.IN_MOVED_FROM != 0:
+			moves[ev.cookie] = inotifyMove{name, isDir, w.seen[name]}
+		case ev.mask&syscall.IN_MOVED_TO != 0:
+			from, paired := moves[ev.cookie]
+			delete(moves, ev.cookie)
+			cont = w.moved(from, paired, name, isDir, w.allow(name))
+		case ev.mask&syscall.IN_CREATE != 0:
+			if w.allow(name) {
+				cont = w.emit(Event{Op: EventCreate, Path: name, IsDir: isDir})
+				if cont && isDir {
+					w.watchTree(name, true)
+				}
+			}
+		case ev.mask&syscall.IN_DELETE != 0:
+			if w.forget(name, isDir) {
+				cont = w.emit(Event{Op: EventDelete, Path: name, IsDir: isDir})
+			}
+		case ev.mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+			// A mode change can make something appear or disappear, eg. with PublicFilter().
+			seen := w.seen[name]
+			switch visible := w.allow(name); {
+			case seen && visible:
+				cont = w.emit(Event{Op: EventModify, Path: name, IsDir: isDir})
+			case visible:
+				cont = w.emit(Event{Op: EventCreate, Path: name, IsDir: isDir})
+				if cont && isDir {
+					w.watchTree(name, true)
+				}
+			case seen:
+				w.forget(name, isDir)
+				cont = w.emit(Event{Op: EventDelete, Path: name, IsDir: isDir})
+			}
+		}
+		if !cont {
+			return
+		}
+	}
+
+	// Anything moved out of the tree is as good as deleted.
+	for _, from := range moves {
+		w.forget(from.path, from.isDir)
+		if from.visible && !w.emit(Event{Op: EventDelete, Path: from.path, IsDir: from.isDir}) {
+			return
+		}
+	}
+}
+
+// Handles a MOVED_TO event, and its MOVED_FROM if it was paired. Returns false if the
+// watcher is shutting down.
+func (w *inotifyWatcher) moved(from inotifyMove, paired bool, name string, isDir, visible bool) bool {
+	switch {
+	case paired && from.visible && visible:
+		if isDir {
+			w.renameTree(from.path, name)
+		} else {
+			delete(w.seen, from.path)
+		}
+		return w.emit(Event{Op: EventRename, Path: name, From: from.path, IsDir: isDir})
+	case paired && from.visible:
+		w.forget(from.path, isDir)
+		return w.emit(Event{Op: EventDelete, Path: from.path, IsDir: isDir})
+	case visible:
+		// Moved in from outside the tree, or from a rejected path.
+		if paired {
+			w.forget(from.path, isDir)
+		}
+		if !w.emit(Event{Op: EventCreate, Path: name, IsDir: isDir}) {
+			return false
+		}
+		if isDir {
+			w.watchTree(name, true)
+		}
+	}
+	return true
+}
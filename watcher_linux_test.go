@@ -0,0 +1,98 @@
+package pubd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInotifyWatcher(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "dir"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "secret"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "a.txt"), []byte("a"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := newInotifyWatcher(ctx, zap.NewNop(), tmp, ExcludeFilter([]string{"secret", "*.bak"}))
+	require.NoError(t, err)
+
+	t.Run("Modify", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "a.txt"), []byte("aaa"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "a.bak"), []byte("a"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "secret", "a.txt"), []byte("a"), 0644))
+		assert.Equal(t, []string{"modify /dir/a.txt"}, collectEvents(t, w))
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(filepath.Join(tmp, "dir", "sub", "subsub"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "dir", "sub", "subsub", "b.txt"), []byte("b"), 0644))
+		events := collectEvents(t, w)
+		assert.Subset(t, events, []string{"create /dir/sub", "create /dir/sub/subsub", "create /dir/sub/subsub/b.txt"})
+		assert.NotContains(t, events, "delete /dir/sub")
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		require.NoError(t, os.Rename(filepath.Join(tmp, "dir", "sub"), filepath.Join(tmp, "sub")))
+		assert.Equal(t, []string{"rename /dir/sub -> /sub"}, collectEvents(t, w))
+
+		// The moved directory's watches should follow it.
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "sub", "subsub", "c.txt"), []byte("c"), 0644))
+		assert.Equal(t, []string{"create /sub/subsub/c.txt", "modify /sub/subsub/c.txt"}, collectEvents(t, w))
+
+		require.NoError(t, os.Rename(filepath.Join(tmp, "sub"), filepath.Join(tmp, "secret", "sub")))
+		assert.Equal(t, []string{"delete /sub"}, collectEvents(t, w))
+		require.NoError(t, os.Rename(filepath.Join(tmp, "secret", "sub"), filepath.Join(tmp, "dir", "sub")))
+		assert.Subset(t, collectEvents(t, w), []string{"create /dir/sub", "create /dir/sub/subsub/c.txt"})
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(filepath.Join(tmp, "dir")))
+		events := collectEvents(t, w)
+		assert.Contains(t, events, "delete /dir/a.txt")
+		assert.Contains(t, events, "delete /dir")
+		assert.NotContains(t, events, "delete /dir/a.bak")
+	})
+
+	cancel()
+	_, ok := <-w.Events()
+	assert.False(t, ok, "channel should be closed")
+}
+
+func TestInotifyWatcherPublicFilter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	require.NoError(t, os.Chmod(tmp, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "public.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "private.txt"), []byte("a"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := newInotifyWatcher(ctx, zap.NewNop(), tmp, PublicFilter(osfs.New(tmp)))
+	require.NoError(t, err)
+
+	// Events are filtered by the files' real modes.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "public.txt"), []byte("aaa"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "private.txt"), []byte("aaa"), 0600))
+	assert.Equal(t, []string{"modify /public.txt"}, collectEvents(t, w))
+
+	// Changing a file's mode can make it appear or disappear.
+	require.NoError(t, os.Chmod(filepath.Join(tmp, "private.txt"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(tmp, "public.txt"), 0600))
+	assert.Equal(t, []string{"create /private.txt", "delete /public.txt"}, collectEvents(t, w))
+
+	// Deleted files can't be stat()ed anymore, but we remember which ones were visible.
+	require.NoError(t, os.Remove(filepath.Join(tmp, "private.txt")))
+	require.NoError(t, os.Remove(filepath.Join(tmp, "public.txt")))
+	assert.Equal(t, []string{"delete /private.txt"}, collectEvents(t, w))
+}
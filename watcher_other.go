@@ -0,0 +1,15 @@
+// +build !linux
+
+package pubd
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"go.uber.org/zap"
+)
+
+func newInotifyWatcher(ctx context.Context, L *zap.Logger, root string, filter Filter) (Watcher, error) {
+	return nil, fmt.Errorf("inotify support not built for %s", runtime.GOOS)
+}
@@ -0,0 +1,93 @@
+package pubd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Collects events from w until none arrive for a little while.
+func collectEvents(t *testing.T, w Watcher) []string {
+	var events []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, ev.String())
+		case <-time.After(200 * time.Millisecond):
+			return events
+		case <-timeout:
+			t.Fatal("timed out waiting for events")
+		}
+	}
+}
+
+func TestEventOpString(t *testing.T) {
+	testdata := map[EventOp]string{
+		EventCreate:   "create",
+		EventModify:   "modify",
+		EventDelete:   "delete",
+		EventRename:   "rename",
+		EventOverflow: "overflow",
+		EventOp(0):    "EventOp(0)",
+	}
+	for op, s := range testdata {
+		assert.Equal(t, s, op.String())
+	}
+}
+
+func TestPollWatcher(t *testing.T) {
+	// memfs isn't safe for concurrent use, which the race detector doesn't like.
+	tmp, err := ioutil.TempDir("", "pubd-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	fs := osfs.New(tmp)
+	require.NoError(t, util.WriteFile(fs, "dir/a.txt", []byte("a"), 0644))
+	require.NoError(t, util.WriteFile(fs, "secret/a.txt", []byte("a"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewPollWatcher(ctx, zap.NewNop(), fs, ExcludeFilter([]string{"secret", "*.bak"}), 10*time.Millisecond)
+
+	require.NoError(t, util.WriteFile(fs, "dir/a.txt", []byte("aaa"), 0644))
+	require.NoError(t, util.WriteFile(fs, "dir/sub/b.txt", []byte("b"), 0644))
+	require.NoError(t, util.WriteFile(fs, "dir/b.bak", []byte("b"), 0644))
+	require.NoError(t, util.WriteFile(fs, "secret/b.txt", []byte("b"), 0644))
+	assert.Equal(t, []string{
+		"create /dir/sub",
+		"create /dir/sub/b.txt",
+		"modify /dir/a.txt",
+	}, sortedCreatesFirst(collectEvents(t, w)))
+
+	require.NoError(t, fs.Remove("dir/sub/b.txt"))
+	require.NoError(t, fs.Remove("dir/sub"))
+	assert.Equal(t, []string{"delete /dir/sub/b.txt", "delete /dir/sub"}, collectEvents(t, w))
+
+	cancel()
+	_, ok := <-w.Events()
+	assert.False(t, ok, "channel should be closed")
+}
+
+// Events within a single poll are ordered by path, not by kind; put them in a stable order.
+func sortedCreatesFirst(events []string) []string {
+	var creates, rest []string
+	for _, ev := range events {
+		if len(ev) > 7 && ev[:7] == "create " {
+			creates = append(creates, ev)
+		} else {
+			rest = append(rest, ev)
+		}
+	}
+	return append(creates, rest...)
+}